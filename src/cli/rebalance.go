@@ -0,0 +1,71 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cli command line interface
+package cli
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+
+	"github.com/spf13/cobra"
+
+	"github.com/MohawkTSDB/mohawk/src/storage"
+	"github.com/MohawkTSDB/mohawk/src/storage/sharded"
+)
+
+// RebalanceCmd move the series of a sharded storage after the number of shards changed
+var RebalanceCmd = &cobra.Command{
+	Use:   "rebalance",
+	Short: "Move the series of a sharded storage after the number of shards changed",
+	Long: `Move the series of a sharded storage after the number of shards changed.
+
+Stop the server, and run rebalance with the new sharded storage options, and the
+number of shards before the change, e.g. growing from 2 to 4 shards:
+
+  mohawk rebalance --from-shards 2 --options "shards=4&backend.db-dirname=/data/shard-{shard}"
+
+An interrupted rebalance can run again with the same options.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		optionsQuery, _ := cmd.Flags().GetString("options")
+		fromShards, _ := cmd.Flags().GetInt("from-shards")
+
+		// the number of shards before the change has no default
+		if fromShards < 1 {
+			log.Fatal("Missing or bad --from-shards, the number of shards before the change")
+		}
+
+		options, err := url.ParseQuery(optionsQuery)
+		if err != nil {
+			log.Fatal("Can't parse options:", optionsQuery)
+		}
+
+		moved, err := sharded.Rebalance(storage.New, options, fromShards)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Printf("Moved %d series\n", moved)
+	},
+}
+
+func init() {
+	// Flag definition
+	RebalanceCmd.Flags().String("options", "", "sharded storage options, use \"mohawk --options=help\" for help")
+	RebalanceCmd.Flags().Int("from-shards", 0, "number of shards before the change (required)")
+
+	RootCmd.AddCommand(RebalanceCmd)
+}
@@ -30,7 +30,7 @@ import (
 )
 
 // errBadMetricID a new error with bad metrics id message
-var errBadMetricID = errors.New("Bad metrics ID")
+var errBadMetricID = storage.BadIDError{}
 
 // const defaultLimit default REST API call query limit
 const defaultLimit = 20000
@@ -113,6 +113,24 @@ func (h APIHhandler) GetTenants(w http.ResponseWriter, r *http.Request, argv map
 	return nil
 }
 
+// GetStorageStats return the storage internal statistics,
+// an empty object if the storage does not report statistics
+func (h APIHhandler) GetStorageStats(w http.ResponseWriter, r *http.Request, argv map[string]string) error {
+	res := map[string]float64{}
+
+	if s, ok := h.Storage.(storage.StatsReporter); ok {
+		res = s.Stats()
+	}
+
+	resJSON, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, string(resJSON))
+	return nil
+}
+
 // GetMetricsHelper helper function to return a list of metrics definitions
 func (h APIHhandler) GetMetricsHelper(w http.ResponseWriter, r *http.Request, argv map[string]string) ([]storage.Item, error) {
 	var res []storage.Item
@@ -195,28 +213,28 @@ func (h APIHhandler) GetExports(w http.ResponseWriter, r *http.Request, argv map
 
 		// print name
 		if name, ok := i.Tags["__name__"]; ok {
-			fmt.Fprintf(w, name)
+			fmt.Fprint(w, exportName(name))
 		} else {
-			fmt.Fprintf(w, i.ID)
+			fmt.Fprint(w, exportName(i.ID))
 		}
 
 		// print tags
 		first = true
-		fmt.Fprintf(w, "{")
+		fmt.Fprint(w, "{")
 		for k, v := range i.Tags {
-			// __name__ is not a real tag
-			if k == "__name__" {
+			// __name__ and other "__" prefixed tags are not real tags
+			if strings.HasPrefix(k, "__") {
 				continue
 			}
 
 			if first {
-				fmt.Fprintf(w, "%s=\"%s\"", k, v)
+				fmt.Fprintf(w, "%s=\"%s\"", exportLabelName(k), exportLabelValue(v))
 				first = false
 			} else {
-				fmt.Fprintf(w, ",%s=\"%s\"", k, v)
+				fmt.Fprintf(w, ",%s=\"%s\"", exportLabelName(k), exportLabelValue(v))
 			}
 		}
-		fmt.Fprintf(w, "} ")
+		fmt.Fprint(w, "} ")
 
 		// print value (if we are here i.LastValues[0] should exist)
 		fmt.Fprintf(w, "%f\n", i.LastValues[0].Value)
@@ -229,7 +247,7 @@ func (h APIHhandler) GetExports(w http.ResponseWriter, r *http.Request, argv map
 func (h APIHhandler) GetData(w http.ResponseWriter, r *http.Request, argv map[string]string) error {
 	// use the id from the argv list
 	id := argv["id"]
-	if !validStr(id) {
+	if !validID(id) {
 		return errBadMetricID
 	}
 
@@ -259,18 +277,23 @@ func (h APIHhandler) GetData(w http.ResponseWriter, r *http.Request, argv map[st
 		order = secondaryOrder
 	}
 
+	percentiles, err := parsePercentiles(r.Form.Get("percentiles"))
+	if err != nil {
+		return err
+	}
+
 	if h.Verbose {
-		log.Printf("ID: %s@%s, End: %d, Start: %d, Limit: %d, Order: %s, bucketDuration: %ds", tenant, id, end, start, limit, order, bucketDuration)
+		log.Printf("ID: %s@%s, End: %d, Start: %d, Limit: %d, Order: %s, bucketDuration: %ds, Percentiles: %v", tenant, id, end, start, limit, order, bucketDuration, percentiles)
 	}
 	// call storage for data
-	return h.getData(w, tenant, id, end, start, limit, order, bucketDuration)
+	return h.getData(w, tenant, id, end, start, limit, order, bucketDuration, percentiles)
 }
 
 // DeleteData delete a list of metrics raw  data
 func (h APIHhandler) DeleteData(w http.ResponseWriter, r *http.Request, argv map[string]string) error {
 	// use the id from the argv list
 	id := argv["id"]
-	if !validStr(id) {
+	if !validID(id) {
 		return errBadMetricID
 	}
 
@@ -298,7 +321,7 @@ func (h APIHhandler) DeleteData(w http.ResponseWriter, r *http.Request, argv map
 
 		// output to client
 		if err == nil {
-			fmt.Fprintf(w, "{\"message\":\"Deleted %s@%s [%d-%d]\"}", tenant, id, end, start)
+			fmt.Fprintf(w, "{\"message\":%s}", jsonString(fmt.Sprintf("Deleted %s@%s [%d-%d]", tenant, id, end, start)))
 		}
 
 		return err
@@ -310,7 +333,7 @@ func (h APIHhandler) DeleteData(w http.ResponseWriter, r *http.Request, argv map
 // PostMQuery query data from storage + gauges
 func (h APIHhandler) PostMQuery(w http.ResponseWriter, r *http.Request, argv map[string]string) error {
 	// parse query args
-	tenant, ids, end, start, limit, order, bucketDuration, err := h.parseQueryArgs(w, r, argv)
+	tenant, ids, end, start, limit, order, bucketDuration, percentiles, err := h.parseQueryArgs(w, r, argv)
 	if err != nil {
 		return err
 	}
@@ -320,10 +343,10 @@ func (h APIHhandler) PostMQuery(w http.ResponseWriter, r *http.Request, argv map
 
 	for i, id := range ids {
 		// write data
-		fmt.Fprintf(w, "\"%s\":", id)
+		fmt.Fprintf(w, "%s:", jsonString(id))
 
 		// call storage for data, and send it to writer
-		if err = h.getData(w, tenant, id, end, start, limit, order, bucketDuration); err != nil {
+		if err = h.getItemData(w, tenant, id, end, start, limit, order, bucketDuration, percentiles); err != nil {
 			return err
 		}
 
@@ -339,7 +362,7 @@ func (h APIHhandler) PostMQuery(w http.ResponseWriter, r *http.Request, argv map
 // PostQuery query data from storage
 func (h APIHhandler) PostQuery(w http.ResponseWriter, r *http.Request, argv map[string]string) error {
 	// parse query args
-	tenant, ids, end, start, limit, order, bucketDuration, err := h.parseQueryArgs(w, r, argv)
+	tenant, ids, end, start, limit, order, bucketDuration, percentiles, err := h.parseQueryArgs(w, r, argv)
 	if err != nil {
 		return err
 	}
@@ -349,10 +372,10 @@ func (h APIHhandler) PostQuery(w http.ResponseWriter, r *http.Request, argv map[
 
 	for i, id := range ids {
 		// write data
-		fmt.Fprintf(w, "{\"id\": \"%s\", \"data\":", id)
+		fmt.Fprintf(w, "{\"id\": %s, \"data\":", jsonString(id))
 
 		// call storage for data, and send it to writer
-		if err := h.getData(w, tenant, id, end, start, limit, order, bucketDuration); err != nil {
+		if err := h.getItemData(w, tenant, id, end, start, limit, order, bucketDuration, percentiles); err != nil {
 			return err
 		}
 
@@ -375,7 +398,7 @@ func (h APIHhandler) PostData(w http.ResponseWriter, r *http.Request, argv map[s
 	}
 
 	for _, item := range u {
-		if !validStr(item.ID) {
+		if !validID(item.ID) {
 			return errBadMetricID
 		}
 	}
@@ -383,21 +406,28 @@ func (h APIHhandler) PostData(w http.ResponseWriter, r *http.Request, argv map[s
 	// get tenant
 	tenant := h.parseTenant(r)
 
+	// collect all data points into one batch
+	batch := make([]storage.BatchItem, 0, len(u))
 	for _, item := range u {
 		id := item.ID
+		data := make([]storage.DataItem, 0, len(item.Data))
 
-		for _, data := range item.Data {
-			timestamp, _ := data.Timestamp.Int64()
-			value, _ := data.Value.Float64()
+		for _, d := range item.Data {
+			timestamp, _ := d.Timestamp.Int64()
+			value, _ := d.Value.Float64()
 
 			if h.Verbose {
 				log.Printf("Tenant: %s, ID: %+v {timestamp: %+v, value: %+v}\n", tenant, id, timestamp, value)
 			}
 
-			if err := h.Storage.PostRawData(tenant, id, timestamp, value); err != nil {
-				return err
-			}
+			data = append(data, storage.DataItem{Timestamp: timestamp, Value: value})
 		}
+
+		batch = append(batch, storage.BatchItem{ID: id, Data: data})
+	}
+
+	if err := h.Storage.PostBatchData(tenant, batch); err != nil {
+		return err
 	}
 
 	fmt.Fprintf(w, "{\"message\":\"Received %d data items\"}", len(u))
@@ -413,7 +443,7 @@ func (h APIHhandler) PutTags(w http.ResponseWriter, r *http.Request, argv map[st
 
 	// use the id from the argv list
 	id := argv["id"]
-	if !validStr(id) || !validTags(tags) {
+	if !validID(id) || !validTags(tags) {
 		return errBadMetricID
 	}
 
@@ -428,7 +458,7 @@ func (h APIHhandler) PutTags(w http.ResponseWriter, r *http.Request, argv map[st
 		return err
 	}
 
-	fmt.Fprintf(w, "{\"message\":\"Updated tags for %s@%s\"}", tenant, id)
+	fmt.Fprintf(w, "{\"message\":%s}", jsonString(fmt.Sprintf("Updated tags for %s@%s", tenant, id)))
 	return nil
 }
 
@@ -440,7 +470,7 @@ func (h APIHhandler) PutMultiTags(w http.ResponseWriter, r *http.Request, argv m
 	}
 
 	for _, item := range u {
-		if !validStr(item.ID) {
+		if !validID(item.ID) {
 			return errBadMetricID
 		}
 	}
@@ -469,7 +499,7 @@ func (h APIHhandler) DeleteTags(w http.ResponseWriter, r *http.Request, argv map
 	// use the id from the argv list
 	id := argv["id"]
 	tagsStr := argv["tags"]
-	if !validStr(id) || !validStr(tagsStr) {
+	if !validID(id) || !validStr(tagsStr) {
 		return errBadMetricID
 	}
 	tags := strings.Split(tagsStr, ",")
@@ -481,7 +511,7 @@ func (h APIHhandler) DeleteTags(w http.ResponseWriter, r *http.Request, argv map
 		return err
 	}
 
-	fmt.Fprintf(w, "{\"message\":\"Deleted tags for %s@%s\"}", tenant, id)
+	fmt.Fprintf(w, "{\"message\":%s}", jsonString(fmt.Sprintf("Deleted tags for %s@%s", tenant, id)))
 	return nil
 }
 
@@ -499,7 +529,7 @@ func (h APIHhandler) decodeRequestBody(r *http.Request) (tenant string, u dataQu
 
 	// get ids from explicit ids list
 	for _, id := range u.IDs {
-		if !validStr(id) {
+		if !validID(id) {
 			return tenant, u, errBadMetricID
 		}
 	}
@@ -516,15 +546,16 @@ func (h APIHhandler) decodeRequestBody(r *http.Request) (tenant string, u dataQu
 }
 
 // parseQueryArgs parse query request body args
-func (h APIHhandler) parseQueryArgs(w http.ResponseWriter, r *http.Request, argv map[string]string) (tenant string, ids []string, end int64, start int64, limit int64, order string, bucketDuration int64, err error) {
+func (h APIHhandler) parseQueryArgs(w http.ResponseWriter, r *http.Request, argv map[string]string) (tenant string, ids []string, end int64, start int64, limit int64, order string, bucketDuration int64, percentiles []float64, err error) {
 	var endStr string
 	var startStr string
 	var bucketDurationStr string
+	var percentilesStr string
 
 	// get tenant
 	tenant, u, err := h.decodeRequestBody(r)
 	if err != nil {
-		return tenant, []string{}, 0, 0, 0, "", 0, err
+		return tenant, []string{}, 0, 0, 0, "", 0, nil, err
 	}
 
 	// get start time string
@@ -557,6 +588,25 @@ func (h APIHhandler) parseQueryArgs(w http.ResponseWriter, r *http.Request, argv
 		bucketDurationStr = fmt.Sprintf("%+v", v)
 	}
 
+	// get percentiles string, a comma separated string or a list of numbers
+	switch v := u.Percentiles.(type) {
+	case string:
+		percentilesStr = v
+	case nil:
+		percentilesStr = ""
+	case []interface{}:
+		l := make([]string, 0, len(v))
+		for _, p := range v {
+			l = append(l, fmt.Sprintf("%+v", p))
+		}
+		percentilesStr = strings.Join(l, ",")
+	default:
+		percentilesStr = fmt.Sprintf("%+v", v)
+	}
+	if percentiles, err = parsePercentiles(percentilesStr); err != nil {
+		return tenant, []string{}, 0, 0, 0, "", 0, nil, err
+	}
+
 	// get query items limit
 	if limit, err = u.Limit.Int64(); err != nil || limit < 1 {
 		// using default value, remove error
@@ -575,33 +625,47 @@ func (h APIHhandler) parseQueryArgs(w http.ResponseWriter, r *http.Request, argv
 
 	if h.Verbose {
 		log.Printf("Tenant: %s, IDs: %+v", tenant, u.IDs)
-		log.Printf("End: %d(%s), Start: %d(%s), Limit: %d, Order: %s, bucketDuration: %ds", end, endStr, start, startStr, limit, order, bucketDuration)
+		log.Printf("End: %d(%s), Start: %d(%s), Limit: %d, Order: %s, bucketDuration: %ds, Percentiles: %v", end, endStr, start, startStr, limit, order, bucketDuration, percentiles)
 	}
 
-	return tenant, u.IDs, end, start, limit, order, bucketDuration, err
+	return tenant, u.IDs, end, start, limit, order, bucketDuration, percentiles, err
 }
 
-// getData querys data from the storage, and send it to writer
-func (h APIHhandler) getData(w http.ResponseWriter, tenant string, id string, end int64, start int64, limit int64, order string, bucketDuration int64) error {
-	var resJSON []byte
+// getData querys data from the storage, and send it to writer,
+// nothing is written if the query fails
+func (h APIHhandler) getData(w http.ResponseWriter, tenant string, id string, end int64, start int64, limit int64, order string, bucketDuration int64, percentiles []float64) error {
+	var res interface{}
 	var err error
 
 	// call storage for data
 	if bucketDuration == 0 {
-		if res, errQuery := h.Storage.GetRawData(tenant, id, end, start, limit, order); errQuery == nil {
-			resJSON, err = json.Marshal(res)
-		}
+		res, err = h.Storage.GetRawData(tenant, id, end, start, limit, order)
 	} else {
-		if res, errQuery := h.Storage.GetStatData(tenant, id, end, start, limit, order, bucketDuration); errQuery == nil {
-			resJSON, err = json.Marshal(res)
-		}
+		res, err = h.Storage.GetStatData(tenant, id, end, start, limit, order, bucketDuration, percentiles)
 	}
+	if err != nil {
+		return err
+	}
+
+	resJSON, err := json.Marshal(res)
 	if err == nil {
 		fmt.Fprintf(w, string(resJSON))
 	}
 	return err
 }
 
+// getItemData querys data of one item in a multi item query, and send it to writer,
+// a missing item has no data
+func (h APIHhandler) getItemData(w http.ResponseWriter, tenant string, id string, end int64, start int64, limit int64, order string, bucketDuration int64, percentiles []float64) error {
+	err := h.getData(w, tenant, id, end, start, limit, order, bucketDuration, percentiles)
+	if storage.IsNotFound(err) {
+		fmt.Fprintf(w, "[]")
+		return nil
+	}
+
+	return err
+}
+
 // ParseTenant return the tenant header value or the default Tenant
 func (h APIHhandler) parseTenant(r *http.Request) string {
 	tenant := r.Header.Get("Hawkular-Tenant")
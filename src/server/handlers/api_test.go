@@ -0,0 +1,124 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package handler http server handler functions
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MohawkTSDB/mohawk/src/server/router"
+	"github.com/MohawkTSDB/mohawk/src/storage/memory"
+)
+
+func newTestRouter() *router.Router {
+	db := &memory.Storage{}
+	db.Open(url.Values{"granularity": {"1s"}, "retention": {"1h"}})
+	db.PostRawData("_ops", "free_memory", (time.Now().UTC().Unix()-10)*1000, 42)
+
+	h := APIHhandler{
+		Storage:          db,
+		DefaultTenant:    "_ops",
+		DefaultStartTime: "-8h",
+	}
+
+	r := &router.Router{Prefix: "/hawkular/metrics/gauges/"}
+	r.Add("GET", ":id/raw", h.GetData)
+	r.Add("GET", ":id/stats", h.GetData)
+	r.Add("POST", "raw/query", h.PostQuery)
+
+	return r
+}
+
+func TestGetDataNotFound(t *testing.T) {
+	r := newTestRouter()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/hawkular/metrics/gauges/free_memory/raw", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"value":42`) {
+		t.Errorf("unexpected response for a known id: %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/hawkular/metrics/gauges/no_such_id/raw", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 for an unknown id, got %d %s", w.Code, w.Body.String())
+	}
+
+	// a multi id query returns no data for unknown ids
+	w = httptest.NewRecorder()
+	body := strings.NewReader(`{"ids": ["no_such_id", "free_memory"]}`)
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/hawkular/metrics/gauges/raw/query", body))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"id": "no_such_id", "data":[]`) {
+		t.Errorf("unexpected response for a multi id query: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestGetStatsPercentiles(t *testing.T) {
+	r := newTestRouter()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/hawkular/metrics/gauges/free_memory/stats?bucketDuration=1h&percentiles=50,99.9", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"percentiles":[{"quantile":50,"value":42},{"quantile":99.9,"value":42}]`) {
+		t.Errorf("unexpected response for a percentiles query: %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	body := strings.NewReader(`{"ids": ["free_memory"], "bucketDuration": "1h", "percentiles": [90]}`)
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/hawkular/metrics/gauges/raw/query", body))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"percentiles":[{"quantile":90,"value":42}]`) {
+		t.Errorf("unexpected response for a percentiles body query: %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/hawkular/metrics/gauges/free_memory/stats?bucketDuration=1h&percentiles=101", nil))
+	if w.Code == http.StatusOK {
+		t.Errorf("expected an error for a bad percentile, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestGetDataBadID(t *testing.T) {
+	r := newTestRouter()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/hawkular/metrics/gauges/%ff/raw", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for a bad id, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestGetExports(t *testing.T) {
+	db := &memory.Storage{}
+	db.Open(url.Values{"granularity": {"1s"}, "retention": {"1h"}})
+	db.PostRawData("_ops", "cpu%d.1", (time.Now().UTC().Unix()-10)*1000, 42)
+	db.PutTags("_ops", "cpu%d.1", map[string]string{"host-name": "a\"b\\c\nd"})
+
+	h := APIHhandler{Storage: db, DefaultTenant: "_ops", DefaultStartTime: "-8h"}
+	r := &router.Router{Prefix: "/hawkular/metrics/"}
+	r.Add("GET", "exports", h.GetExports)
+
+	// ids and tags are escaped in the prometheus text format
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/hawkular/metrics/exports", nil))
+	expected := `cpu_d_1{host_name="a\"b\\c\nd"} 42.000000` + "\n"
+	if w.Code != http.StatusOK || w.Body.String() != expected {
+		t.Errorf("unexpected exports: %d %q", w.Code, w.Body.String())
+	}
+}
@@ -24,10 +24,12 @@ import (
 	"net/http"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 )
 
-// validRegex regexp for validating sql variables
+// validRegex regexp for validating tag keys and values
 var validRegex = regexp.MustCompile(`^[ A-Za-z0-9_@,|:/\[\]\(\)\.\+\*-]*$`)
 
 // json struct used to query data by the POST http request
@@ -39,6 +41,7 @@ type dataQuery struct {
 	BucketDuration interface{} `json:"bucketDuration"`
 	Limit          json.Number `json:"limit"`
 	Order          string      `json:"order"`
+	Percentiles    interface{} `json:"percentiles"`
 }
 
 // json struct used to parse post data http request
@@ -65,6 +68,16 @@ func validStr(s string) bool {
 	return valid
 }
 
+// validID check that a metric id is a non empty UTF-8 string,
+// storage plugins never use ids as sql identifiers or regexp patterns
+func validID(s string) bool {
+	valid := s != "" && utf8.ValidString(s)
+	if !valid {
+		log.Printf("Valid id fail: %q\n", s)
+	}
+	return valid
+}
+
 func validTags(tags map[string]string) bool {
 	for k, v := range tags {
 		if !validStr(k) || !validStr(v) {
@@ -75,6 +88,56 @@ func validTags(tags map[string]string) bool {
 	return true
 }
 
+// jsonString return a string as an escaped JSON string
+func jsonString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// exportValueReplacer escape a label value in the prometheus text format
+var exportValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// exportName return a metric id as a prometheus metric name, characters
+// not allowed in a metric name are replaced by "_"
+func exportName(s string) string {
+	return exportIdentifier(s, true)
+}
+
+// exportLabelName return a tag key as a prometheus label name, characters
+// not allowed in a label name are replaced by "_"
+func exportLabelName(s string) string {
+	return exportIdentifier(s, false)
+}
+
+// exportLabelValue return a tag value as an escaped prometheus label value
+func exportLabelValue(s string) string {
+	return exportValueReplacer.Replace(s)
+}
+
+// exportIdentifier replace characters not allowed in a prometheus metric
+// or label name by "_", metric names may also include ":"
+func exportIdentifier(s string, colon bool) string {
+	if s == "" {
+		return "_"
+	}
+
+	b := make([]byte, 0, len(s))
+	for i, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+			b = append(b, byte(c))
+		case c >= '0' && c <= '9' && i > 0:
+			b = append(b, byte(c))
+		case c == ':' && colon:
+			b = append(b, byte(c))
+		default:
+			b = append(b, '_')
+		}
+	}
+
+	return string(b)
+}
+
 func badID(w http.ResponseWriter, v bool) {
 	w.WriteHeader(504)
 	fmt.Fprintf(w, "{\"error\":\"504\",\"message\":\"Bad metrics IDe - 504\"}")
@@ -122,6 +185,24 @@ func parseTimespanStrings(e string, s string, b string, defaultStartTime string)
 	return end, start, bucketDuration, nil
 }
 
+// parsePercentiles parse a comma separated list of percentiles, e.g. "90,95,99.9"
+func parsePercentiles(s string) ([]float64, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	percentiles := make([]float64, 0)
+	for _, p := range strings.Split(s, ",") {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil || f < 0 || f > 100 {
+			return nil, fmt.Errorf("Bad percentile %s", p)
+		}
+		percentiles = append(percentiles, f)
+	}
+
+	return percentiles, nil
+}
+
 func parseTimespan(r *http.Request, defaultStartTime string) (int64, int64, int64, error) {
 	var e string
 	var s string
@@ -0,0 +1,30 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package server API REST server
+package server
+
+// built in storage plugins, each plugin registers itself in its init
+// function, a wrapper main package can add plugins by importing them
+import (
+	_ "github.com/MohawkTSDB/mohawk/src/storage/example"
+	_ "github.com/MohawkTSDB/mohawk/src/storage/file"
+	_ "github.com/MohawkTSDB/mohawk/src/storage/memory"
+	_ "github.com/MohawkTSDB/mohawk/src/storage/mongo"
+	_ "github.com/MohawkTSDB/mohawk/src/storage/replicate"
+	_ "github.com/MohawkTSDB/mohawk/src/storage/sharded"
+	_ "github.com/MohawkTSDB/mohawk/src/storage/sqlite"
+	_ "github.com/MohawkTSDB/mohawk/src/storage/tiered"
+)
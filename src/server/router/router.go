@@ -17,11 +17,14 @@
 package router
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
 	"strings"
+
+	"github.com/MohawkTSDB/mohawk/src/storage"
 )
 
 type route struct {
@@ -52,9 +55,20 @@ func (r Router) handleError(e error, w http.ResponseWriter) {
 		log.Printf(msg)
 	}
 
-	// All errors we catch are 500 - internal error
-	w.WriteHeader(500)
-	w.Write([]byte(fmt.Sprintf(`{"code":500,"message":"%s"}`, msg)))
+	// missing tenants and ids are 404 - not found, bad ids are 400 - bad
+	// request, all other errors we catch are 500 - internal error
+	code := 500
+	if storage.IsNotFound(e) {
+		code = 404
+	} else if storage.IsBadID(e) {
+		code = 400
+	}
+
+	// the message may include user input, e.g. a metric id
+	msgJSON, _ := json.Marshal(msg)
+
+	w.WriteHeader(code)
+	w.Write([]byte(fmt.Sprintf(`{"code":%d,"message":%s}`, code, msgJSON)))
 }
 
 // match match a request to a route, and parse the arguments embedded in the route path
@@ -73,7 +87,7 @@ func (r Router) match(route route, method string, segments []string) (bool, map[
 	for i, segment := range route.segments {
 		if segment[0] == ':' {
 			// if this is an argument segments, parse it
-			value, _ := url.QueryUnescape(segments[i])
+			value, _ := url.PathUnescape(segments[i])
 			argv[segment[1:]] = value
 		} else if segments[i] != segment {
 			// if this segment does not match the route exit
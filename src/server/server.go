@@ -19,10 +19,14 @@ package server
 import (
 	"encoding/base64"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
 	"regexp"
+	"syscall"
 	"time"
 
 	"github.com/spf13/viper"
@@ -32,10 +36,6 @@ import (
 	"github.com/MohawkTSDB/mohawk/src/server/middleware"
 	"github.com/MohawkTSDB/mohawk/src/server/router"
 	"github.com/MohawkTSDB/mohawk/src/storage"
-	"github.com/MohawkTSDB/mohawk/src/storage/example"
-	"github.com/MohawkTSDB/mohawk/src/storage/memory"
-	"github.com/MohawkTSDB/mohawk/src/storage/mongo"
-	"github.com/MohawkTSDB/mohawk/src/storage/sqlite"
 )
 
 // VER the server version
@@ -66,14 +66,15 @@ func OptionsResponse(w http.ResponseWriter, r *http.Request, argv map[string]str
 
 func printOptionsHelp() {
 	fmt.Println("Storage options:")
-	fmt.Println(sqlite.Storage{}.Help())
-	fmt.Println(memory.Storage{}.Help())
-	fmt.Println(mongo.Storage{}.Help())
+	for _, name := range storage.Names() {
+		if db, err := storage.New(name); err == nil {
+			fmt.Println(db.Help())
+		}
+	}
 }
 
 // Serve run the REST API server
 func Serve() error {
-	var db storage.Storage
 	var alertRules *alerts.AlertRules
 	var routers http.HandlerFunc
 	var authorizationKey string
@@ -100,22 +101,16 @@ func Serve() error {
 	}
 
 	// Create and init the storage
-	switch backendQuery {
-	case "sqlite":
-		db = &sqlite.Storage{}
-	case "memory":
-		db = &memory.Storage{}
-	case "mongo":
-		db = &mongo.Storage{}
-	case "example":
-		db = &example.Storage{}
-	default:
-		log.Fatal("Can't find storage:", backendQuery)
+	db, err := storage.New(backendQuery)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	// parse options
 	if options, err := url.ParseQuery(optionsQuery); err == nil {
-		db.Open(options)
+		if err = db.Open(options); err != nil {
+			log.Fatal("Can't open storage:", err)
+		}
 	} else {
 		log.Fatal("Can't parse opetions:", optionsQuery)
 	}
@@ -123,6 +118,9 @@ func Serve() error {
 	// set global variables
 	BackendName = db.Name()
 
+	// close the storage on shutdown
+	go closeOnSignal(db)
+
 	// Create alerts runner
 	if configAlerts {
 		// parse alert list from config yaml
@@ -165,6 +163,7 @@ func Serve() error {
 	rRoot.Add("GET", "tenants", h.GetTenants)
 	rRoot.Add("GET", "metrics", h.GetMetrics)
 	rRoot.Add("GET", "exports", h.GetExports)
+	rRoot.Add("GET", "storage/stats", h.GetStorageStats)
 
 	// M (Global Metrics) Routing tables
 	rM := router.Router{
@@ -293,6 +292,23 @@ func Serve() error {
 	return RunServer(core)
 }
 
+// closeOnSignal close a storage that implements io.Closer when the
+// server is interrupted or terminated, and exit
+func closeOnSignal(db storage.Storage) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	sig := <-c
+
+	log.Printf("Got signal %v, shutting down", sig)
+	if closer, ok := db.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Printf("Can't close storage: %v", err)
+		}
+	}
+
+	os.Exit(0)
+}
+
 // RunServer run the http/s server
 func RunServer(core http.HandlerFunc) error {
 	var port = viper.GetInt("port")
@@ -27,6 +27,10 @@ import (
 type Storage struct {
 }
 
+func init() {
+	storage.Register("example", func() storage.Storage { return &Storage{} })
+}
+
 // Storage functions
 // Required by storage interface
 
@@ -42,8 +46,9 @@ func (r Storage) Help() string {
 }
 
 // Open storage
-func (r *Storage) Open(options url.Values) {
+func (r *Storage) Open(options url.Values) error {
 	// open db connection
+	return nil
 }
 
 func (r Storage) GetTenants() ([]storage.Tenant, error) {
@@ -106,7 +111,7 @@ func (r Storage) GetRawData(tenant string, id string, end int64, start int64, li
 	return res, nil
 }
 
-func (r Storage) GetStatData(tenant string, id string, end int64, start int64, limit int64, order string, bucketDuration int64) ([]storage.StatItem, error) {
+func (r Storage) GetStatData(tenant string, id string, end int64, start int64, limit int64, order string, bucketDuration int64, percentiles []float64) ([]storage.StatItem, error) {
 	res := make([]storage.StatItem, 0)
 	var l int64
 	var i int64
@@ -143,6 +148,11 @@ func (r Storage) PostRawData(tenant string, id string, t int64, v float64) error
 	return nil
 }
 
+// PostBatchData handle posting a batch of data points to db
+func (r Storage) PostBatchData(tenant string, items []storage.BatchItem) error {
+	return storage.PostBatchDataLoop(&r, tenant, items)
+}
+
 // PutTags handle posting tags to db
 func (r Storage) PutTags(tenant string, id string, tags map[string]string) error {
 	return nil
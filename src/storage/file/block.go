@@ -0,0 +1,395 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package file interface for file metric data storage
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/MohawkTSDB/mohawk/src/storage"
+)
+
+// blockMagic the first and last bytes of a block file
+const blockMagic = "MHWKBLK1"
+
+// blockSuffix the suffix of block file names
+const blockSuffix = ".blk"
+
+// blockFooterSize index offset, index crc32 and magic
+const blockFooterSize = 8 + 4 + len(blockMagic)
+
+// errBadBlock a new error with bad block message
+var errBadBlock = errors.New("file: Bad block file")
+
+// chunkRef the location of the points of one series in a block file
+type chunkRef struct {
+	offset int64
+	length int64
+	count  int64
+	minT   int64
+	maxT   int64
+}
+
+// block an immutable block file, holding the points of one time partition,
+// newer blocks of the same partition override the points of older blocks
+//
+// the block file is written as:
+// 	magic, series chunks, series index, uint64 index offset, uint32 index crc32, magic
+// a series chunk is a column of timestamps and a column of values:
+// 	uvarint count, varint first timestamp, uvarint timestamp deltas, float64 values, uint32 crc32
+type block struct {
+	path      string
+	partition int64
+	seq       int64
+	file      *os.File
+	series    map[string]chunkRef
+}
+
+// blockFileName return the file name of a block
+func blockFileName(partition int64, seq int64) string {
+	return fmt.Sprintf("%d-%016d%s", partition, seq, blockSuffix)
+}
+
+// parseBlockFileName return the partition and sequence number of a block file name
+func parseBlockFileName(name string) (int64, int64, bool) {
+	var partition int64
+	var seq int64
+
+	if filepath.Ext(name) != blockSuffix {
+		return 0, 0, false
+	}
+	if n, err := fmt.Sscanf(name, "%d-%d"+blockSuffix, &partition, &seq); err != nil || n != 2 {
+		return 0, 0, false
+	}
+
+	return partition, seq, true
+}
+
+// openBlock open a block file and read its series index
+func openBlock(path string) (*block, error) {
+	partition, seq, ok := parseBlockFileName(filepath.Base(path))
+	if !ok {
+		return nil, errBadBlock
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &block{path: path, partition: partition, seq: seq, file: f}
+	if err = b.readIndex(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("file: block %s: %s", path, err)
+	}
+
+	return b, nil
+}
+
+// readIndex read the series index of a block file
+func (b *block) readIndex() error {
+	info, err := b.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < int64(len(blockMagic)+blockFooterSize) {
+		return errBadBlock
+	}
+
+	footer := make([]byte, blockFooterSize)
+	if _, err = b.file.ReadAt(footer, info.Size()-int64(blockFooterSize)); err != nil {
+		return err
+	}
+	if string(footer[12:]) != blockMagic {
+		return errBadBlock
+	}
+
+	indexOffset := int64(binary.LittleEndian.Uint64(footer[0:8]))
+	indexLength := info.Size() - int64(blockFooterSize) - indexOffset
+	if indexOffset < int64(len(blockMagic)) || indexLength < 0 {
+		return errBadBlock
+	}
+
+	index := make([]byte, indexLength)
+	if _, err = b.file.ReadAt(index, indexOffset); err != nil {
+		return err
+	}
+	if crc32.ChecksumIEEE(index) != binary.LittleEndian.Uint32(footer[8:12]) {
+		return errBadBlock
+	}
+
+	r := bytes.NewReader(index)
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return errBadBlock
+	}
+
+	b.series = make(map[string]chunkRef, n)
+	for i := uint64(0); i < n; i++ {
+		var ref chunkRef
+
+		id, err := readString(r)
+		if err != nil {
+			return errBadBlock
+		}
+		fields := []*int64{&ref.offset, &ref.length, &ref.count, &ref.minT, &ref.maxT}
+		for _, f := range fields {
+			if *f, err = binary.ReadVarint(r); err != nil {
+				return errBadBlock
+			}
+		}
+		if ref.offset < int64(len(blockMagic)) || ref.offset+ref.length > indexOffset {
+			return errBadBlock
+		}
+		b.series[id] = ref
+	}
+
+	return nil
+}
+
+// close close the block file
+func (b *block) close() error {
+	return b.file.Close()
+}
+
+// remove close and delete the block file
+func (b *block) remove() error {
+	b.close()
+	return os.Remove(b.path)
+}
+
+// overlaps check if the block holds points of a series in [start, end)
+func (b *block) overlaps(id string, end int64, start int64) bool {
+	ref, ok := b.series[id]
+	return ok && ref.minT < end && ref.maxT >= start
+}
+
+// points read the points of a series in [start, end)
+func (b *block) points(id string, end int64, start int64) ([]storage.DataItem, error) {
+	if !b.overlaps(id, end, start) {
+		return nil, nil
+	}
+
+	ref := b.series[id]
+	buf := make([]byte, ref.length)
+	if _, err := b.file.ReadAt(buf, ref.offset); err != nil {
+		return nil, err
+	}
+
+	points, err := decodeChunk(buf)
+	if err != nil {
+		return nil, fmt.Errorf("file: block %s: series %s: %s", b.path, id, err)
+	}
+
+	// points are sorted by timestamp
+	i := sort.Search(len(points), func(i int) bool { return points[i].Timestamp >= start })
+	j := sort.Search(len(points), func(i int) bool { return points[i].Timestamp >= end })
+
+	return points[i:j], nil
+}
+
+// content read the points of all the series in a block
+func (b *block) content() (map[string][]storage.DataItem, error) {
+	res := make(map[string][]storage.DataItem, len(b.series))
+
+	for id := range b.series {
+		points, err := b.points(id, math.MaxInt64, math.MinInt64)
+		if err != nil {
+			return nil, err
+		}
+		res[id] = points
+	}
+
+	return res, nil
+}
+
+// writeBlock write a new block file, series points must be sorted by
+// timestamp, the file is written to a temporary file and renamed, so a
+// crash while writing never leaves a partial block
+func writeBlock(dir string, partition int64, seq int64, series map[string][]storage.DataItem) (*block, error) {
+	path := filepath.Join(dir, blockFileName(partition, seq))
+	tmpPath := path + ".tmp"
+
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+
+	err = encodeBlock(f, series)
+	if err == nil {
+		err = f.Sync()
+	}
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+
+	return openBlock(path)
+}
+
+// encodeBlock write the block chunks and index
+func encodeBlock(f io.Writer, series map[string][]storage.DataItem) error {
+	var index bytes.Buffer
+	var footer [blockFooterSize]byte
+
+	w := bufio.NewWriter(f)
+	offset := int64(len(blockMagic))
+	w.WriteString(blockMagic)
+
+	// write the series in id order, so equal content gives equal files
+	ids := make([]string, 0, len(series))
+	for id, points := range series {
+		if len(points) > 0 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	putUvarint(&index, uint64(len(ids)))
+	for _, id := range ids {
+		points := series[id]
+		chunk := encodeChunk(points)
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+
+		putString(&index, id)
+		for _, v := range []int64{offset, int64(len(chunk)), int64(len(points)), points[0].Timestamp, points[len(points)-1].Timestamp} {
+			putVarint(&index, v)
+		}
+		offset += int64(len(chunk))
+	}
+
+	binary.LittleEndian.PutUint64(footer[0:8], uint64(offset))
+	binary.LittleEndian.PutUint32(footer[8:12], crc32.ChecksumIEEE(index.Bytes()))
+	copy(footer[12:], blockMagic)
+
+	w.Write(index.Bytes())
+	w.Write(footer[:])
+
+	return w.Flush()
+}
+
+// encodeChunk encode the points of one series, timestamps column first
+func encodeChunk(points []storage.DataItem) []byte {
+	var b bytes.Buffer
+	var buf [8]byte
+
+	putUvarint(&b, uint64(len(points)))
+	putVarint(&b, points[0].Timestamp)
+	for i := 1; i < len(points); i++ {
+		putUvarint(&b, uint64(points[i].Timestamp-points[i-1].Timestamp))
+	}
+	for _, d := range points {
+		binary.LittleEndian.PutUint64(buf[:], math.Float64bits(d.Value))
+		b.Write(buf[:])
+	}
+
+	binary.LittleEndian.PutUint32(buf[:4], crc32.ChecksumIEEE(b.Bytes()))
+	b.Write(buf[:4])
+
+	return b.Bytes()
+}
+
+// decodeChunk decode the points of one series
+func decodeChunk(buf []byte) ([]storage.DataItem, error) {
+	if len(buf) < 4 {
+		return nil, errBadBlock
+	}
+
+	data := buf[:len(buf)-4]
+	if crc32.ChecksumIEEE(data) != binary.LittleEndian.Uint32(buf[len(buf)-4:]) {
+		return nil, errBadBlock
+	}
+
+	r := bytes.NewReader(data)
+	n, err := binary.ReadUvarint(r)
+	if err != nil || n == 0 || n > uint64(r.Len()/8) {
+		return nil, errBadBlock
+	}
+
+	points := make([]storage.DataItem, n)
+	t, err := binary.ReadVarint(r)
+	if err != nil {
+		return nil, errBadBlock
+	}
+	points[0].Timestamp = t
+	for i := uint64(1); i < n; i++ {
+		delta, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, errBadBlock
+		}
+		t += int64(delta)
+		points[i].Timestamp = t
+	}
+
+	values := data[len(data)-r.Len():]
+	if uint64(len(values)) != n*8 {
+		return nil, errBadBlock
+	}
+	for i := range points {
+		points[i].Value = math.Float64frombits(binary.LittleEndian.Uint64(values[i*8:]))
+	}
+
+	return points, nil
+}
+
+// putUvarint write an unsigned varint
+func putUvarint(b *bytes.Buffer, v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	b.Write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+// putVarint write a signed varint
+func putVarint(b *bytes.Buffer, v int64) {
+	var buf [binary.MaxVarintLen64]byte
+	b.Write(buf[:binary.PutVarint(buf[:], v)])
+}
+
+// putString write a length prefixed string
+func putString(b *bytes.Buffer, s string) {
+	putUvarint(b, uint64(len(s)))
+	b.WriteString(s)
+}
+
+// readString read a length prefixed string
+func readString(r *bytes.Reader) (string, error) {
+	l, err := binary.ReadUvarint(r)
+	if err != nil || l > uint64(r.Len()) {
+		return "", errBadBlock
+	}
+
+	s := make([]byte, l)
+	_, err = io.ReadFull(r, s)
+
+	return string(s), err
+}
@@ -0,0 +1,248 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package file interface for file metric data storage
+package file
+
+import (
+	"math"
+	"path/filepath"
+	"sort"
+
+	"github.com/MohawkTSDB/mohawk/src/storage"
+)
+
+// compactStats what one compaction run did to a tenant
+type compactStats struct {
+	merged        int
+	expired       int
+	expiredSeries int
+	expiredPoints int
+}
+
+// flush write the head points into new block files, one block per time
+// partition, and start a new write ahead log segment
+//
+// while the blocks are written, the flushed points are kept in a frozen head
+// that is still read, and new points are posted to a new head.
+func (t *tenant) flush(partitionMili int64) (int, error) {
+	t.flushMutex.Lock()
+	defer t.flushMutex.Unlock()
+
+	t.mutex.Lock()
+	if !t.changed {
+		t.mutex.Unlock()
+		return 0, nil
+	}
+
+	walSeq, err := t.wal.Rotate()
+	if err != nil {
+		t.mutex.Unlock()
+		return 0, err
+	}
+
+	t.frozen = make(map[string][]storage.DataItem)
+	for id, s := range t.series {
+		if len(s.head) > 0 {
+			t.frozen[id] = s.head
+			s.head = nil
+		}
+	}
+	meta := t.seriesMeta(walSeq)
+	seq := t.nextSeq
+	t.nextSeq++
+	t.changed = false
+	t.mutex.Unlock()
+
+	// split the head points into time partitions
+	partitions := make(map[int64]map[string][]storage.DataItem)
+	for id, points := range t.frozen {
+		for len(points) > 0 {
+			p := partition(points[0].Timestamp, partitionMili)
+			i := sort.Search(len(points), func(i int) bool { return points[i].Timestamp >= p+partitionMili })
+
+			if partitions[p] == nil {
+				partitions[p] = make(map[string][]storage.DataItem)
+			}
+			partitions[p][id] = points[:i]
+			points = points[i:]
+		}
+	}
+
+	blocks := make([]*block, 0, len(partitions))
+	for p, content := range partitions {
+		b, err := writeBlock(filepath.Join(t.dir, blocksDirName), p, seq, content)
+		if err != nil {
+			t.unfreeze(blocks)
+			return 0, err
+		}
+		blocks = append(blocks, b)
+	}
+
+	// the series file marks the flushed records as obsolete
+	if err = t.writeSeriesFile(meta); err != nil {
+		t.unfreeze(blocks)
+		return 0, err
+	}
+
+	t.mutex.Lock()
+	t.blocks = append(t.blocks, blocks...)
+	t.sortBlocks()
+	t.frozen = nil
+	t.mutex.Unlock()
+
+	return len(blocks), t.wal.RemoveBefore(walSeq)
+}
+
+// unfreeze return the frozen head points to the head after a failed flush,
+// points posted during the flush override frozen points
+func (t *tenant) unfreeze(blocks []*block) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, b := range blocks {
+		b.remove()
+	}
+	for id, points := range t.frozen {
+		s := t.series[id]
+		s.head = mergePoints([][]storage.DataItem{points, s.head})
+	}
+	t.frozen = nil
+	t.changed = true
+}
+
+// compact remove blocks of partitions older than the retention, and merge
+// the blocks of each past partition into one block, series whose last point
+// is older than the retention and older head points are removed
+func (t *tenant) compact(partitionMili int64, validTimeStamp int64, nowMili int64) (compactStats, error) {
+	var stats compactStats
+
+	t.flushMutex.Lock()
+	defer t.flushMutex.Unlock()
+
+	// blocks do not change while we hold the flush lock
+	t.mutex.RLock()
+	partitions := make(map[int64][]*block)
+	for _, b := range t.blocks {
+		partitions[b.partition] = append(partitions[b.partition], b)
+	}
+	t.mutex.RUnlock()
+
+	for p, blocks := range partitions {
+		// expired partitions
+		if p+partitionMili <= validTimeStamp {
+			t.replaceBlocks(blocks, nil)
+			stats.expired += len(blocks)
+			continue
+		}
+
+		// the current partition may still get new blocks
+		if len(blocks) < 2 || p+partitionMili > nowMili {
+			continue
+		}
+
+		b, err := mergeBlocks(blocks)
+		if err != nil {
+			return stats, err
+		}
+		t.replaceBlocks(blocks, b)
+		stats.merged += len(blocks)
+	}
+
+	t.mutex.Lock()
+	for id, s := range t.series {
+		if len(s.last) > 0 && s.last[0].Timestamp < validTimeStamp {
+			delete(t.series, id)
+			stats.expiredSeries++
+			continue
+		}
+
+		n := len(s.head)
+		s.head = removePoints(s.head, validTimeStamp, math.MinInt64)
+		stats.expiredPoints += n - len(s.head)
+	}
+	if stats.expiredSeries > 0 || stats.expiredPoints > 0 {
+		t.changed = true
+	}
+	t.mutex.Unlock()
+
+	return stats, nil
+}
+
+// mergeBlocks write one block holding the points of blocks of one partition,
+// blocks are sorted by sequence number, the merged block replaces the newest
+// block file, so a crash before older blocks are removed leaves it the newest
+func mergeBlocks(blocks []*block) (*block, error) {
+	runs := make(map[string][][]storage.DataItem)
+	for _, b := range blocks {
+		content, err := b.content()
+		if err != nil {
+			return nil, err
+		}
+		for id, points := range content {
+			runs[id] = append(runs[id], points)
+		}
+	}
+
+	content := make(map[string][]storage.DataItem, len(runs))
+	for id, r := range runs {
+		content[id] = mergePoints(r)
+	}
+
+	newest := blocks[len(blocks)-1]
+	return writeBlock(filepath.Dir(newest.path), newest.partition, newest.seq, content)
+}
+
+// replaceBlocks replace blocks by a merged block, or remove them if the merged block is nil
+func (t *tenant) replaceBlocks(old []*block, merged *block) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	remove := make(map[*block]bool, len(old))
+	for _, b := range old {
+		remove[b] = true
+	}
+
+	blocks := make([]*block, 0, len(t.blocks))
+	for _, b := range t.blocks {
+		if !remove[b] {
+			blocks = append(blocks, b)
+			continue
+		}
+
+		// the merged block file replaced the file of the newest block
+		if merged != nil && b.path == merged.path {
+			b.close()
+		} else {
+			b.remove()
+		}
+	}
+	if merged != nil {
+		blocks = append(blocks, merged)
+	}
+
+	t.blocks = blocks
+	t.sortBlocks()
+}
+
+// partition return the start of the time partition holding a timestamp
+func partition(timestamp int64, partitionMili int64) int64 {
+	p := timestamp - timestamp%partitionMili
+	if timestamp < 0 && p != timestamp {
+		p -= partitionMili
+	}
+
+	return p
+}
@@ -0,0 +1,527 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package file interface for file metric data storage
+package file
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MohawkTSDB/mohawk/src/storage"
+	"github.com/MohawkTSDB/mohawk/src/storage/wal"
+)
+
+// errBadTenant a new error with bad tenant name message
+var errBadTenant = errors.New("file: Bad tenant name")
+
+// errClosed a new error with closed storage message
+var errClosed = errors.New("file: Storage is closed")
+
+// Storage an append-only file storage, each tenant is a directory of
+// immutable block files, posted points are written to a write ahead log
+// and kept in an in-memory head block until they are flushed to a block
+type Storage struct {
+	dbDirName        string
+	timeRetentionSec int64
+	blockDurationSec int64
+	flushIntervalSec int64
+	syncInterval     time.Duration
+	mutex            sync.RWMutex
+	tenants          map[string]*tenant
+	closed           bool
+	done             chan struct{}
+	workers          sync.WaitGroup
+	closeOnce        sync.Once
+}
+
+func init() {
+	storage.Register("file", func() storage.Storage { return &Storage{} })
+}
+
+// Storage functions
+// Required by storage interface
+
+// Name return a human readable storage name
+func (r *Storage) Name() string {
+	return "Storage-File"
+}
+
+// Help return a human readable storage help message
+func (r *Storage) Help() string {
+	return `File storage [file]:
+	db-dirname     - a directory for tenant data directories.
+	retention      - (optional) samples max retention, samples are kept forever if not set.
+	block-duration - (optional) time partition of one block file (default "2h").
+	flush-interval - (optional) time between flushes of posted data into block files (default "10mn").
+	sync-interval  - (optional) max time posted data waits before it is synced to disk,
+	                 "0s" syncs every post (default "1s").
+	Examples:
+		--options=db-dirname=/data
+		--options=db-dirname=/data&retention=30d&block-duration=6h`
+}
+
+// Open storage
+func (r *Storage) Open(options url.Values) error {
+	var err error
+
+	// get storage options
+	r.dbDirName = options.Get("db-dirname")
+	if r.dbDirName == "" {
+		r.dbDirName = "."
+	}
+
+	if retentionStr := options.Get("retention"); retentionStr != "" {
+		if r.timeRetentionSec, err = storage.ParseDuration(retentionStr); err != nil || r.timeRetentionSec < 0 {
+			return fmt.Errorf("file: Bad retention %s", retentionStr)
+		}
+	}
+
+	r.blockDurationSec = int64(2 * 60 * 60)
+	if durationStr := options.Get("block-duration"); durationStr != "" {
+		if r.blockDurationSec, err = storage.ParseDuration(durationStr); err != nil || r.blockDurationSec < 1 {
+			return fmt.Errorf("file: Bad block duration %s", durationStr)
+		}
+	}
+
+	r.flushIntervalSec = int64(10 * 60)
+	if intervalStr := options.Get("flush-interval"); intervalStr != "" {
+		if r.flushIntervalSec, err = storage.ParseDuration(intervalStr); err != nil || r.flushIntervalSec < 1 {
+			return fmt.Errorf("file: Bad flush interval %s", intervalStr)
+		}
+	}
+
+	r.syncInterval = time.Second
+	if intervalStr := options.Get("sync-interval"); intervalStr != "" {
+		if r.syncInterval, err = time.ParseDuration(intervalStr); err != nil || r.syncInterval < 0 {
+			return fmt.Errorf("file: Bad sync interval %s", intervalStr)
+		}
+	}
+
+	// open all tenants, so data written before a restart is listed
+	r.tenants = make(map[string]*tenant)
+	if err = os.MkdirAll(r.dbDirName, 0755); err != nil {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(r.dbDirName)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		name, err := url.PathUnescape(f.Name())
+		if err != nil || !isTenantDir(filepath.Join(r.dbDirName, f.Name())) {
+			continue
+		}
+
+		t, err := openTenant(filepath.Join(r.dbDirName, f.Name()), r.syncInterval == 0)
+		if err != nil {
+			r.closeTenants()
+			return err
+		}
+		r.tenants[name] = t
+	}
+
+	// log init arguments
+	log.Printf("Start file storage:")
+	log.Printf("  db dirname: %+v", r.dbDirName)
+	log.Printf("  tenants: %d", len(r.tenants))
+	log.Printf("  retention: %ds", r.timeRetentionSec)
+	log.Printf("  block duration: %ds", r.blockDurationSec)
+	log.Printf("  flush interval: %ds", r.flushIntervalSec)
+	log.Printf("  sync interval: %v", r.syncInterval)
+
+	// start a maintenance worker that will flush and compact the blocks periodically
+	r.done = make(chan struct{})
+	r.workers.Add(1)
+	go r.maintenance()
+
+	// start a worker that will sync the write ahead logs periodically
+	if r.syncInterval > 0 {
+		r.workers.Add(1)
+		go r.syncs()
+	}
+
+	return nil
+}
+
+// Close stop the workers, flush all posted data into block files and close
+// all tenants
+func (r *Storage) Close() error {
+	var err error
+
+	// a storage that failed to open has nothing to flush
+	if r.done == nil {
+		return nil
+	}
+
+	r.closeOnce.Do(func() {
+		close(r.done)
+		r.workers.Wait()
+
+		r.mutex.Lock()
+		r.closed = true
+		r.mutex.Unlock()
+
+		r.flush()
+		err = r.closeTenants()
+	})
+
+	return err
+}
+
+func (r *Storage) GetTenants() ([]storage.Tenant, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	res := make([]storage.Tenant, 0, len(r.tenants))
+
+	// return a list of tenants
+	for key := range r.tenants {
+		res = append(res, storage.Tenant{ID: key})
+	}
+
+	return res, nil
+}
+
+func (r *Storage) GetItemList(tenant string, tags map[string]string) ([]storage.Item, error) {
+	res := make([]storage.Item, 0)
+
+	// an unknown tenant has no items, reads do not create it
+	t, err := r.getTenant(tenant, false)
+	if t == nil {
+		return res, err
+	}
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	for key, s := range t.series {
+		if hasMatchingTag(tags, s.tags) {
+			// copy the tags, the series tags may change after we return
+			itemTags := make(map[string]string, len(s.tags))
+			for k, v := range s.tags {
+				itemTags[k] = v
+			}
+
+			res = append(res, storage.Item{
+				ID:         key,
+				Type:       "gauge",
+				Tags:       itemTags,
+				LastValues: append([]storage.DataItem{}, s.last...),
+			})
+		}
+	}
+
+	return res, nil
+}
+
+func (r *Storage) GetRawData(tenant string, id string, end int64, start int64, limit int64, order string) ([]storage.DataItem, error) {
+	res := make([]storage.DataItem, 0)
+
+	points, err := r.getPoints(tenant, id, end, start)
+	if err != nil {
+		return res, err
+	}
+
+	// walk the points backwards for DESC order, so the limit keeps the newest points
+	for n := 0; int64(len(res)) < limit && n < len(points); n++ {
+		i := n
+		if order == "DESC" {
+			i = len(points) - n - 1
+		}
+		res = append(res, points[i])
+	}
+
+	return res, nil
+}
+
+func (r *Storage) GetStatData(tenant string, id string, end int64, start int64, limit int64, order string, bucketDuration int64, percentiles []float64) ([]storage.StatItem, error) {
+	var quantiles storage.Quantiles
+
+	res := make([]storage.StatItem, 0)
+
+	points, err := r.getPoints(tenant, id, end, start)
+	if err != nil {
+		return res, err
+	}
+
+	// points are sorted, each bucket is a continuous range of points,
+	// buckets are aligned to multiples of the bucket duration
+	bucketMili := bucketDuration * 1000
+	for i := 0; i < len(points); {
+		bucketStart := points[i].Timestamp - points[i].Timestamp%bucketMili
+		bucketEnd := bucketStart + bucketMili
+
+		j := i
+		for j < len(points) && points[j].Timestamp < bucketEnd {
+			j++
+		}
+		bucket := points[i:j]
+		i = j
+
+		var sum float64
+		var sumSq float64
+		min := bucket[0].Value
+		max := bucket[0].Value
+		values := make([]float64, 0, len(bucket))
+		quantiles.Reset()
+
+		for _, d := range bucket {
+			min = math.Min(min, d.Value)
+			max = math.Max(max, d.Value)
+			sum += d.Value
+			sumSq += d.Value * d.Value
+			values = append(values, d.Value)
+			if len(percentiles) > 0 {
+				quantiles.Add(d.Value)
+			}
+		}
+
+		avg := sum / float64(len(bucket))
+		res = append(res, storage.StatItem{
+			Start:       bucketStart,
+			End:         bucketEnd,
+			Empty:       false,
+			Samples:     int64(len(bucket)),
+			First:       bucket[0].Value,
+			Last:        bucket[len(bucket)-1].Value,
+			Min:         min,
+			Max:         max,
+			Avg:         avg,
+			Median:      storage.Median(values),
+			Std:         math.Sqrt(math.Max(sumSq/float64(len(bucket))-avg*avg, 0)),
+			Sum:         sum,
+			Percentiles: quantiles.Percentiles(percentiles),
+		})
+	}
+
+	// order and limit, DESC order keeps the newest buckets
+	if order == "DESC" {
+		for i := 0; i < len(res)/2; i++ {
+			j := len(res) - i - 1
+			res[i], res[j] = res[j], res[i]
+		}
+	}
+	if int64(len(res)) > limit {
+		res = res[:limit]
+	}
+
+	return res, nil
+}
+
+// PostRawData handle posting data to db
+func (r *Storage) PostRawData(tenant string, id string, t int64, v float64) error {
+	return r.PostBatchData(tenant, []storage.BatchItem{{ID: id, Data: []storage.DataItem{{Timestamp: t, Value: v}}}})
+}
+
+// PostBatchData handle posting a batch of data points to db
+func (r *Storage) PostBatchData(tenant string, items []storage.BatchItem) error {
+	t, err := r.getTenant(tenant, true)
+	if err != nil {
+		return err
+	}
+
+	recs := make([]*wal.Record, 0, len(items))
+	for _, item := range items {
+		recs = append(recs, &wal.Record{
+			Type: wal.RecordData,
+			ID:   item.ID,
+			Data: item.Data,
+		})
+	}
+
+	return t.commit(recs...)
+}
+
+// PutTags handle posting tags to db
+func (r *Storage) PutTags(tenant string, id string, tags map[string]string) error {
+	t, err := r.getTenant(tenant, true)
+	if err != nil {
+		return err
+	}
+
+	return t.commit(&wal.Record{
+		Type: wal.RecordTags,
+		ID:   id,
+		Tags: tags,
+	})
+}
+
+// DeleteData handle delete data fron db
+func (r *Storage) DeleteData(tenant string, id string, end int64, start int64) error {
+	t, err := r.lookupSeries(tenant, id)
+	if err != nil {
+		return err
+	}
+
+	// deleting rewrites block files, blocks must not change while we rewrite them
+	t.flushMutex.Lock()
+	defer t.flushMutex.Unlock()
+
+	return t.commit(&wal.Record{
+		Type:  wal.RecordDeleteData,
+		ID:    id,
+		End:   end,
+		Start: start,
+	})
+}
+
+// DeleteTags handle delete tags fron db
+func (r *Storage) DeleteTags(tenant string, id string, tags []string) error {
+	t, err := r.lookupSeries(tenant, id)
+	if err != nil {
+		return err
+	}
+
+	return t.commit(&wal.Record{
+		Type: wal.RecordDeleteTags,
+		ID:   id,
+		Keys: tags,
+	})
+}
+
+// Helper functions
+// Not required by storage interface
+
+// getTenant return an open tenant, a missing tenant is created if create
+// is set, otherwise nil is returned
+func (r *Storage) getTenant(name string, create bool) (*tenant, error) {
+	r.mutex.RLock()
+	t, ok := r.tenants[name]
+	closed := r.closed
+	r.mutex.RUnlock()
+
+	if closed {
+		return nil, errClosed
+	}
+	if ok || !create {
+		return t, nil
+	}
+	if name == "" {
+		return nil, errBadTenant
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// another request may have created the tenant
+	if t, ok = r.tenants[name]; ok {
+		return t, nil
+	}
+
+	t, err := openTenant(filepath.Join(r.dbDirName, tenantDirName(name)), r.syncInterval == 0)
+	if err != nil {
+		return nil, err
+	}
+	r.tenants[name] = t
+
+	return t, nil
+}
+
+// lookupSeries return the tenant of an existing series, or a not found error
+func (r *Storage) lookupSeries(tenant string, id string) (*tenant, error) {
+	t, err := r.getTenant(tenant, false)
+	if err != nil {
+		return nil, err
+	}
+	if t == nil {
+		return nil, storage.NotFoundError{Tenant: tenant, ID: id}
+	}
+
+	t.mutex.RLock()
+	_, ok := t.series[id]
+	t.mutex.RUnlock()
+
+	if !ok {
+		return nil, storage.NotFoundError{Tenant: tenant, ID: id}
+	}
+
+	return t, nil
+}
+
+// getPoints return the points of a series in [start, end), sorted by timestamp
+func (r *Storage) getPoints(tenant string, id string, end int64, start int64) ([]storage.DataItem, error) {
+	t, err := r.lookupSeries(tenant, id)
+	if err != nil {
+		return nil, err
+	}
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	return t.points(id, end, start)
+}
+
+// closeTenants close all open tenants
+func (r *Storage) closeTenants() error {
+	var err error
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for name, t := range r.tenants {
+		if errClose := t.close(); errClose != nil {
+			log.Printf("file: close tenant %s: %s\n", name, errClose)
+			err = errClose
+		}
+	}
+
+	return err
+}
+
+// tenantDirName return the directory name of a tenant, tenant names are
+// escaped, so any name is a valid file name
+func tenantDirName(name string) string {
+	return strings.Replace(url.PathEscape(name), ".", "%2E", -1)
+}
+
+// isTenantDir check if a directory is a tenant directory
+func isTenantDir(dir string) bool {
+	info, err := os.Stat(filepath.Join(dir, walDirName))
+	return err == nil && info.IsDir()
+}
+
+func hasMatchingTag(tags map[string]string, itemTags map[string]string) bool {
+	out := true
+
+	// if no tags, all items match
+	if len(tags) == 0 {
+		return true
+	}
+
+	// if item has no tags, item is invalid
+	if len(itemTags) == 0 {
+		return false
+	}
+
+	// loop on all the tags, we need _all_ query tags to match tags on item
+	for key, value := range tags {
+		r, _ := regexp.Compile("^" + value + "$")
+		out = out && r != nil && r.MatchString(itemTags[key])
+	}
+
+	return out
+}
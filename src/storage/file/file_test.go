@@ -0,0 +1,283 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package file interface for file metric data storage
+package file
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/MohawkTSDB/mohawk/src/storage"
+	"github.com/MohawkTSDB/mohawk/src/storage/storagetest"
+)
+
+// hourMili one hour in ms
+const hourMili = int64(60 * 60 * 1000)
+
+// openStorage open a file storage in a directory
+func openStorage(t *testing.T, dir string, options url.Values) *Storage {
+	options.Set("db-dirname", dir)
+
+	r := &Storage{}
+	if err := r.Open(options); err != nil {
+		t.Fatal(err)
+	}
+
+	return r
+}
+
+// rawData return all the points of a series
+func rawData(t *testing.T, r *Storage, tenant string, id string) []storage.DataItem {
+	res, err := r.GetRawData(tenant, id, 100*hourMili, 0, 1000, "ASC")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res
+}
+
+func TestStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mohawk-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := openStorage(t, dir, url.Values{})
+	defer r.Close()
+
+	storagetest.Run(t, r)
+}
+
+func TestStorageFlushed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mohawk-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// flush the head on every write, so reads and deletes use block files
+	r := openStorage(t, dir, url.Values{"block-duration": {"10mn"}})
+	defer r.Close()
+
+	storagetest.Run(t, flushingStorage{r})
+}
+
+// flushingStorage a file storage that flushes the head after every write
+type flushingStorage struct {
+	*Storage
+}
+
+func (r flushingStorage) PostRawData(tenant string, id string, t int64, v float64) error {
+	defer r.flush()
+	return r.Storage.PostRawData(tenant, id, t, v)
+}
+
+func (r flushingStorage) PostBatchData(tenant string, items []storage.BatchItem) error {
+	defer r.flush()
+	return r.Storage.PostBatchData(tenant, items)
+}
+
+func TestReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mohawk-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := openStorage(t, dir, url.Values{"block-duration": {"1h"}})
+	for i := int64(0); i < 4; i++ {
+		if err = r.PostRawData("a/tenant", "cpu", i*hourMili, float64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = r.PutTags("a/tenant", "cpu", map[string]string{"host": "a"}); err != nil {
+		t.Fatal(err)
+	}
+	r.flush()
+
+	// points posted after the flush are only in the write ahead log,
+	// a newer point overrides a flushed point with the same timestamp
+	if err = r.PostRawData("a/tenant", "cpu", 4*hourMili, 4); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.PostRawData("a/tenant", "cpu", 0, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.DeleteData("a/tenant", "cpu", 2*hourMili, hourMili); err != nil {
+		t.Fatal(err)
+	}
+
+	// close without flushing, like a crash
+	r.closeTenants()
+	close(r.done)
+
+	r = openStorage(t, dir, url.Values{"block-duration": {"1h"}})
+	defer r.Close()
+
+	expected := []storage.DataItem{{Timestamp: 0, Value: 10}, {Timestamp: 2 * hourMili, Value: 2}, {Timestamp: 3 * hourMili, Value: 3}, {Timestamp: 4 * hourMili, Value: 4}}
+	res := rawData(t, r, "a/tenant", "cpu")
+	if len(res) != len(expected) {
+		t.Fatalf("expected %+v, got %+v", expected, res)
+	}
+	for i, d := range expected {
+		if res[i] != d {
+			t.Errorf("expected %+v, got %+v", d, res[i])
+		}
+	}
+
+	items, err := r.GetItemList("a/tenant", map[string]string{"host": "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || len(items[0].LastValues) != 1 || items[0].LastValues[0].Value != 4 {
+		t.Errorf("unexpected items: %+v", items)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mohawk-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := openStorage(t, dir, url.Values{"block-duration": {"1h"}, "retention": {"2h"}})
+	defer r.Close()
+
+	// three flushes into an old partition, and one into a partition inside the retention
+	now := time.Now().Unix() * 1000
+	now -= now % hourMili
+	for i := int64(0); i < 3; i++ {
+		if err = r.PostRawData("tenant", "cpu", 10*hourMili+i, float64(i)); err != nil {
+			t.Fatal(err)
+		}
+		if err = r.PostRawData("tenant", "cpu", now-hourMili+i, float64(i)); err != nil {
+			t.Fatal(err)
+		}
+		r.flush()
+	}
+	if err = r.PostRawData("tenant", "cpu", now-hourMili, 10); err != nil {
+		t.Fatal(err)
+	}
+	r.flush()
+
+	// head points older than the retention, and a series with only old points
+	if err = r.PostRawData("tenant", "cpu", 11*hourMili, 20); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.PostRawData("tenant", "old", 11*hourMili, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	tn, _ := r.getTenant("tenant", false)
+	if len(tn.blocks) != 7 {
+		t.Fatalf("expected 7 blocks, got %d", len(tn.blocks))
+	}
+
+	r.compact()
+	if len(tn.blocks) != 1 {
+		t.Fatalf("expected 1 block after compaction, got %d", len(tn.blocks))
+	}
+
+	// the merged block keeps the newest value of a point
+	res, err := r.GetRawData("tenant", "cpu", now, 0, 100, "ASC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 3 || res[0].Value != 10 || res[2].Value != 2 {
+		t.Errorf("unexpected points after compaction: %+v", res)
+	}
+
+	// a series with only expired points is removed
+	if _, err = r.GetRawData("tenant", "old", now, 0, 100, "ASC"); !storage.IsNotFound(err) {
+		t.Errorf("expected an expired series to be removed, got %v", err)
+	}
+}
+
+func TestBlockEncoding(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mohawk-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := map[string][]storage.DataItem{
+		"a":     {{Timestamp: -5, Value: 1.5}, {Timestamp: 7, Value: -2}, {Timestamp: 1 << 40, Value: 0}},
+		"b 😀":   {{Timestamp: 3, Value: 3}},
+		"empty": {},
+	}
+
+	b, err := writeBlock(dir, 0, 1, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.close()
+
+	got, err := b.content()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Errorf("expected 2 series, got %d", len(got))
+	}
+	for _, id := range []string{"a", "b 😀"} {
+		if len(got[id]) != len(content[id]) {
+			t.Errorf("series %s: expected %+v, got %+v", id, content[id], got[id])
+			continue
+		}
+		for i, d := range content[id] {
+			if got[id][i] != d {
+				t.Errorf("series %s: expected %+v, got %+v", id, d, got[id][i])
+			}
+		}
+	}
+
+	// points in a range
+	if res, err := b.points("a", 8, 0); err != nil || len(res) != 1 || res[0].Timestamp != 7 {
+		t.Errorf("unexpected points in range: %+v, %v", res, err)
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mohawk-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, options := range []url.Values{
+		{"retention": {"30x"}},
+		{"block-duration": {"0"}},
+		{"flush-interval": {"10"}},
+		{"sync-interval": {"-1s"}},
+	} {
+		options.Set("db-dirname", dir)
+
+		r := &Storage{}
+		if err := r.Open(options); err == nil {
+			t.Errorf("%v: expected an error", options)
+		}
+
+		// a storage that failed to open has nothing to close
+		if err := r.Close(); err != nil {
+			t.Errorf("%v: unexpected close error %v", options, err)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package file interface for file metric data storage
+package file
+
+import (
+	"log"
+	"math"
+	"time"
+)
+
+func (r *Storage) maintenance() {
+	defer r.workers.Done()
+
+	c := time.NewTicker(time.Duration(r.flushIntervalSec) * time.Second)
+	defer c.Stop()
+
+	// once a tick flush and compact, until the storage is closed
+	for {
+		select {
+		case <-c.C:
+			r.flush()
+			r.compact()
+		case <-r.done:
+			return
+		}
+	}
+}
+
+func (r *Storage) syncs() {
+	defer r.workers.Done()
+
+	c := time.NewTicker(r.syncInterval)
+	defer c.Stop()
+
+	for {
+		select {
+		case <-c.C:
+			for name, t := range r.openTenants() {
+				if err := t.wal.Sync(); err != nil {
+					log.Printf("file: tenant %s: %s\n", name, err)
+				}
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// openTenants return a copy of the open tenants map
+func (r *Storage) openTenants() map[string]*tenant {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	res := make(map[string]*tenant, len(r.tenants))
+	for name, t := range r.tenants {
+		res[name] = t
+	}
+
+	return res
+}
+
+// flush flush the head blocks of all tenants
+func (r *Storage) flush() {
+	for name, t := range r.openTenants() {
+		n, err := t.flush(r.blockDurationSec * 1000)
+		if err != nil {
+			log.Printf("file: tenant %s: flush: %s\n", name, err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("file: tenant %s: flushed %d blocks\n", name, n)
+		}
+	}
+}
+
+// compact merge past blocks and remove expired blocks of all tenants
+func (r *Storage) compact() {
+	validTimeStamp := int64(math.MinInt64)
+	if r.timeRetentionSec > 0 {
+		validTimeStamp = (time.Now().Unix() - r.timeRetentionSec) * 1000
+	}
+
+	for name, t := range r.openTenants() {
+		stats, err := t.compact(r.blockDurationSec*1000, validTimeStamp, time.Now().Unix()*1000)
+		if err != nil {
+			log.Printf("file: tenant %s: compact: %s\n", name, err)
+			continue
+		}
+		if stats.merged > 0 || stats.expired > 0 {
+			log.Printf("file: tenant %s: merged %d blocks, removed %d expired blocks\n", name, stats.merged, stats.expired)
+		}
+		if stats.expiredSeries > 0 || stats.expiredPoints > 0 {
+			log.Printf("file: tenant %s: removed %d expired series, %d expired head points\n", name, stats.expiredSeries, stats.expiredPoints)
+		}
+	}
+}
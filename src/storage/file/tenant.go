@@ -0,0 +1,442 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package file interface for file metric data storage
+package file
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/MohawkTSDB/mohawk/src/storage"
+	"github.com/MohawkTSDB/mohawk/src/storage/wal"
+)
+
+// file and directory names in a tenant directory
+const (
+	seriesFileName = "series"
+	blocksDirName  = "blocks"
+	walDirName     = "wal"
+)
+
+// seriesFileVersion the version of the series file format
+const seriesFileVersion = 1
+
+// series the tags, last value and head points of one metric
+type series struct {
+	tags map[string]string
+	last []storage.DataItem
+	head []storage.DataItem
+}
+
+// seriesMeta the series file entry of one metric
+type seriesMeta struct {
+	ID   string
+	Tags map[string]string
+	Last []storage.DataItem
+}
+
+// seriesFile the series file, the metrics of a tenant, and the first write
+// ahead log segment holding records not included in the blocks and the
+// series file
+type seriesFile struct {
+	Version int
+	WALSeq  int64
+	Series  []seriesMeta
+}
+
+// tenant the metrics of one tenant, points are kept in an in-memory head
+// block until they are flushed into immutable block files
+type tenant struct {
+	mutex      sync.RWMutex
+	flushMutex sync.Mutex
+	dir        string
+	series     map[string]*series
+	frozen     map[string][]storage.DataItem
+	blocks     []*block
+	nextSeq    int64
+	changed    bool
+	wal        *wal.Log
+}
+
+// openTenant open a tenant directory, load its blocks and series file, and
+// replay its write ahead log into the head block
+func openTenant(dir string, fsync bool) (*tenant, error) {
+	var meta seriesFile
+
+	t := &tenant{dir: dir, series: make(map[string]*series), nextSeq: 1}
+
+	if err := os.MkdirAll(filepath.Join(dir, blocksDirName), 0755); err != nil {
+		return nil, err
+	}
+
+	// restore the series
+	f, err := os.Open(filepath.Join(dir, seriesFileName))
+	if err == nil {
+		err = gob.NewDecoder(bufio.NewReader(f)).Decode(&meta)
+		f.Close()
+		if err == nil && meta.Version != seriesFileVersion {
+			err = fmt.Errorf("unknown series file version %d", meta.Version)
+		}
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("file: tenant %s: %s", dir, err)
+	}
+	for _, m := range meta.Series {
+		t.series[m.ID] = &series{tags: m.Tags, last: m.Last}
+	}
+
+	if err = t.loadBlocks(); err != nil {
+		t.closeBlocks()
+		return nil, err
+	}
+
+	// replay the records written after the last flush
+	syncPolicy := wal.SyncInterval
+	if fsync {
+		syncPolicy = wal.SyncAlways
+	}
+	if t.wal, err = wal.Open(filepath.Join(dir, walDirName), syncPolicy); err != nil {
+		t.closeBlocks()
+		return nil, err
+	}
+	_, err = t.wal.Replay(meta.WALSeq, func(rec *wal.Record) {
+		if err := t.apply(rec); err != nil {
+			log.Printf("file: tenant %s: replay: %s\n", dir, err)
+		}
+	})
+	if err != nil {
+		t.close()
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// loadBlocks open the tenant block files
+func (t *tenant) loadBlocks() error {
+	dir := filepath.Join(t.dir, blocksDirName)
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		path := filepath.Join(dir, f.Name())
+
+		// a temporary file left by a crash while writing a block
+		if strings.HasSuffix(f.Name(), ".tmp") {
+			os.Remove(path)
+			continue
+		}
+		if _, _, ok := parseBlockFileName(f.Name()); !ok {
+			continue
+		}
+
+		b, err := openBlock(path)
+		if err != nil {
+			return err
+		}
+		t.blocks = append(t.blocks, b)
+		if b.seq >= t.nextSeq {
+			t.nextSeq = b.seq + 1
+		}
+	}
+	t.sortBlocks()
+
+	return nil
+}
+
+// sortBlocks sort blocks by sequence number, newer blocks override older ones
+func (t *tenant) sortBlocks() {
+	sort.Slice(t.blocks, func(i, j int) bool {
+		if t.blocks[i].seq != t.blocks[j].seq {
+			return t.blocks[i].seq < t.blocks[j].seq
+		}
+		return t.blocks[i].partition < t.blocks[j].partition
+	})
+}
+
+// commit write records to the write ahead log and apply them
+func (t *tenant) commit(recs ...*wal.Record) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if err := t.wal.Append(recs...); err != nil {
+		return err
+	}
+	for _, rec := range recs {
+		if err := t.apply(rec); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// apply apply one record, caller must hold the tenant lock
+func (t *tenant) apply(rec *wal.Record) error {
+	s := t.series[rec.ID]
+	if s == nil {
+		// only posts create a series
+		if rec.Type != wal.RecordData && rec.Type != wal.RecordTags {
+			return nil
+		}
+		s = &series{tags: make(map[string]string)}
+		t.series[rec.ID] = s
+	}
+	t.changed = true
+
+	switch rec.Type {
+	case wal.RecordData:
+		for _, d := range rec.Data {
+			s.head = insertPoint(s.head, d)
+			if len(s.last) == 0 || d.Timestamp >= s.last[0].Timestamp {
+				s.last = []storage.DataItem{d}
+			}
+		}
+	case wal.RecordTags:
+		for k, v := range rec.Tags {
+			s.tags[k] = v
+		}
+	case wal.RecordDeleteData:
+		return t.deleteData(rec.ID, s, rec.End, rec.Start)
+	case wal.RecordDeleteTags:
+		for _, k := range rec.Keys {
+			delete(s.tags, k)
+		}
+	}
+
+	return nil
+}
+
+// deleteData remove points from the head and rewrite the blocks holding
+// points in [start, end), caller must hold the tenant lock and flush lock
+func (t *tenant) deleteData(id string, s *series, end int64, start int64) error {
+	s.head = removePoints(s.head, end, start)
+
+	for i, b := range t.blocks {
+		if !b.overlaps(id, end, start) {
+			continue
+		}
+
+		// a rewritten block keeps its sequence number, and replaces the old file
+		content, err := b.content()
+		if err != nil {
+			return err
+		}
+		n := len(content[id])
+		content[id] = removePoints(content[id], end, start)
+		if len(content[id]) == n {
+			continue
+		}
+
+		nb, err := writeBlock(filepath.Dir(b.path), b.partition, b.seq, content)
+		if err != nil {
+			return err
+		}
+		b.close()
+		t.blocks[i] = nb
+	}
+
+	// if the last value was deleted, find the new last value
+	if len(s.last) > 0 && s.last[0].Timestamp >= start && s.last[0].Timestamp < end {
+		points, err := t.points(id, math.MaxInt64, math.MinInt64)
+		if err != nil {
+			return err
+		}
+
+		s.last = nil
+		if len(points) > 0 {
+			s.last = []storage.DataItem{points[len(points)-1]}
+		}
+	}
+
+	return nil
+}
+
+// points return the points of a series in [start, end), sorted by
+// timestamp, caller must hold the tenant lock
+func (t *tenant) points(id string, end int64, start int64) ([]storage.DataItem, error) {
+	var runs [][]storage.DataItem
+
+	// blocks are sorted by sequence number, older points first
+	for _, b := range t.blocks {
+		points, err := b.points(id, end, start)
+		if err != nil {
+			return nil, err
+		}
+		if len(points) > 0 {
+			runs = append(runs, points)
+		}
+	}
+
+	if points := pointsInRange(t.frozen[id], end, start); len(points) > 0 {
+		runs = append(runs, points)
+	}
+	if s := t.series[id]; s != nil && len(s.head) > 0 {
+		runs = append(runs, pointsInRange(s.head, end, start))
+	}
+
+	return mergePoints(runs), nil
+}
+
+// seriesMeta return the series file content, caller must hold the tenant lock
+func (t *tenant) seriesMeta(walSeq int64) *seriesFile {
+	meta := &seriesFile{Version: seriesFileVersion, WALSeq: walSeq}
+
+	for id, s := range t.series {
+		tags := make(map[string]string, len(s.tags))
+		for k, v := range s.tags {
+			tags[k] = v
+		}
+		meta.Series = append(meta.Series, seriesMeta{ID: id, Tags: tags, Last: s.last})
+	}
+
+	return meta
+}
+
+// writeSeriesFile write the series file, the file is written to a temporary
+// file and renamed, so a crash while saving leaves the previous file intact
+func (t *tenant) writeSeriesFile(meta *seriesFile) error {
+	filename := filepath.Join(t.dir, seriesFileName)
+	tmpFilename := filename + ".tmp"
+
+	f, err := os.Create(tmpFilename)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	if err = gob.NewEncoder(w).Encode(meta); err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+
+	return os.Rename(tmpFilename, filename)
+}
+
+// closeBlocks close all block files
+func (t *tenant) closeBlocks() {
+	for _, b := range t.blocks {
+		b.close()
+	}
+	t.blocks = nil
+}
+
+// close close the write ahead log and block files, the head is not flushed
+func (t *tenant) close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.closeBlocks()
+	if t.wal != nil {
+		return t.wal.Close()
+	}
+
+	return nil
+}
+
+// insertPoint insert a point into a sorted list of points, a point with the
+// same timestamp is replaced
+func insertPoint(points []storage.DataItem, d storage.DataItem) []storage.DataItem {
+	n := len(points)
+
+	// points are usually posted in time order
+	if n == 0 || points[n-1].Timestamp < d.Timestamp {
+		return append(points, d)
+	}
+
+	i := sort.Search(n, func(i int) bool { return points[i].Timestamp >= d.Timestamp })
+	if points[i].Timestamp == d.Timestamp {
+		points[i] = d
+		return points
+	}
+
+	points = append(points, storage.DataItem{})
+	copy(points[i+1:], points[i:])
+	points[i] = d
+
+	return points
+}
+
+// pointsInRange return the points of a sorted list in [start, end)
+func pointsInRange(points []storage.DataItem, end int64, start int64) []storage.DataItem {
+	i := sort.Search(len(points), func(i int) bool { return points[i].Timestamp >= start })
+	j := sort.Search(len(points), func(i int) bool { return points[i].Timestamp >= end })
+
+	return points[i:j]
+}
+
+// removePoints remove the points of a sorted list in [start, end)
+func removePoints(points []storage.DataItem, end int64, start int64) []storage.DataItem {
+	i := sort.Search(len(points), func(i int) bool { return points[i].Timestamp >= start })
+	j := sort.Search(len(points), func(i int) bool { return points[i].Timestamp >= end })
+	if i == j {
+		return points
+	}
+
+	res := make([]storage.DataItem, 0, len(points)-(j-i))
+	res = append(res, points[:i]...)
+
+	return append(res, points[j:]...)
+}
+
+// mergePoints merge sorted runs of points, a point in a later run overrides
+// a point with the same timestamp in an earlier run
+func mergePoints(runs [][]storage.DataItem) []storage.DataItem {
+	res := make([]storage.DataItem, 0)
+	for _, run := range runs {
+		res = append(res, run...)
+	}
+	if len(runs) < 2 {
+		return res
+	}
+
+	// a stable sort keeps the later run last in a group of equal timestamps
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Timestamp < res[j].Timestamp })
+
+	n := 0
+	for i, d := range res {
+		if i+1 < len(res) && res[i+1].Timestamp == d.Timestamp {
+			continue
+		}
+		res[n] = d
+		n++
+	}
+
+	return res[:n]
+}
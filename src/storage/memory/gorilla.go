@@ -0,0 +1,355 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package memory interface for memory metric data storage
+package memory
+
+import (
+	"errors"
+	"math"
+	"math/bits"
+)
+
+// errBadChunk a new error with bad compressed chunk message
+var errBadChunk = errors.New("memory: Bad compressed chunk")
+
+// Gorilla compression, see "Gorilla: A Fast, Scalable, In-Memory Time
+// Series Database" (Pelkonen et al, VLDB 2015).
+//
+// a compressed chunk is a bit stream:
+// 	16 bits   number of points
+// 	64 bits   first timestamp
+// 	64 bits   first value
+// 	          first samples count
+// 	then for each point, a delta-of-delta encoded timestamp,
+// 	a samples count and a XOR encoded value.
+//
+// delta-of-delta (timestamps are in ms):
+// 	'0'                  dod is 0
+// 	'10'   + 7 bits      dod in [-63, 64]
+// 	'110'  + 9 bits      dod in [-255, 256]
+// 	'1110' + 12 bits     dod in [-2047, 2048]
+// 	'1111' + 64 bits     any other dod
+//
+// samples count:
+// 	'0'                  one sample
+// 	'1' + 6 bits length + bits
+//
+// XOR with previous value:
+// 	'0'                  same value
+// 	'10'   + bits        meaningful bits fit in the previous window
+// 	'11'   + 5 bits leading zeros + 6 bits length + bits
+
+// dodBuckets control bits and value bits of the delta-of-delta buckets
+var dodBuckets = []struct {
+	control     uint64
+	controlBits uint
+	valueBits   uint
+}{
+	{0x2, 2, 7},
+	{0x6, 3, 9},
+	{0xe, 4, 12},
+}
+
+// bitWriter append bits to a byte slice
+type bitWriter struct {
+	buf  []byte
+	free uint
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	if w.free == 0 {
+		w.buf = append(w.buf, 0)
+		w.free = 8
+	}
+	w.free--
+	if bit {
+		w.buf[len(w.buf)-1] |= 1 << w.free
+	}
+}
+
+func (w *bitWriter) writeBits(v uint64, n uint) {
+	for n > 0 {
+		n--
+		w.writeBit((v>>n)&1 == 1)
+	}
+}
+
+// bitReader read bits from a byte slice
+type bitReader struct {
+	buf []byte
+	pos uint
+}
+
+func (r *bitReader) readBit() (bool, error) {
+	if r.pos >= uint(len(r.buf))*8 {
+		return false, errBadChunk
+	}
+	bit := (r.buf[r.pos/8]>>(7-r.pos%8))&1 == 1
+	r.pos++
+
+	return bit, nil
+}
+
+func (r *bitReader) readBits(n uint) (uint64, error) {
+	var v uint64
+
+	for ; n > 0; n-- {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		v <<= 1
+		if bit {
+			v |= 1
+		}
+	}
+
+	return v, nil
+}
+
+// writeCount write a samples count
+func (w *bitWriter) writeCount(count int64) {
+	if count == 1 {
+		w.writeBit(false)
+		return
+	}
+
+	// a length of 64 is written as 0, and a count of 0 is written with
+	// length 1, so it does not read as a 64 bits count
+	length := uint(bits.Len64(uint64(count)))
+	if length == 0 {
+		length = 1
+	}
+	w.writeBit(true)
+	w.writeBits(uint64(length), 6)
+	w.writeBits(uint64(count), length)
+}
+
+// readCount read a samples count
+func (r *bitReader) readCount() (int64, error) {
+	bit, err := r.readBit()
+	if err != nil || !bit {
+		return 1, err
+	}
+
+	length, err := r.readBits(6)
+	if err != nil {
+		return 0, err
+	}
+	if length == 0 {
+		length = 64
+	}
+	count, err := r.readBits(uint(length))
+
+	return int64(count), err
+}
+
+// encodePoints compress a time sorted list of points
+func encodePoints(points []TimeValuePair) []byte {
+	var prevDelta int64
+	var prevLeading uint = 65
+	var prevTrailing uint
+
+	w := &bitWriter{}
+	w.writeBits(uint64(len(points)), 16)
+	if len(points) == 0 {
+		return w.buf
+	}
+
+	w.writeBits(uint64(points[0].timeStamp), 64)
+	w.writeBits(math.Float64bits(points[0].value), 64)
+	w.writeCount(points[0].count)
+
+	for i := 1; i < len(points); i++ {
+		// timestamp delta-of-delta
+		delta := points[i].timeStamp - points[i-1].timeStamp
+		dod := delta - prevDelta
+		prevDelta = delta
+
+		if dod == 0 {
+			w.writeBit(false)
+		} else {
+			written := false
+			for _, b := range dodBuckets {
+				limit := int64(1) << (b.valueBits - 1)
+				if dod >= -limit+1 && dod <= limit {
+					w.writeBits(b.control, b.controlBits)
+					w.writeBits(uint64(dod)&(1<<b.valueBits-1), b.valueBits)
+					written = true
+					break
+				}
+			}
+			if !written {
+				w.writeBits(0xf, 4)
+				w.writeBits(uint64(dod), 64)
+			}
+		}
+
+		w.writeCount(points[i].count)
+
+		// value XOR
+		xor := math.Float64bits(points[i].value) ^ math.Float64bits(points[i-1].value)
+		if xor == 0 {
+			w.writeBit(false)
+			continue
+		}
+		w.writeBit(true)
+
+		leading := uint(bits.LeadingZeros64(xor))
+		trailing := uint(bits.TrailingZeros64(xor))
+		if leading > 31 {
+			leading = 31
+		}
+
+		if prevLeading <= 64 && leading >= prevLeading && trailing >= prevTrailing {
+			// meaningful bits fit in the previous window
+			w.writeBit(false)
+			w.writeBits(xor>>prevTrailing, 64-prevLeading-prevTrailing)
+		} else {
+			// new window, a length of 64 is written as 0
+			length := 64 - leading - trailing
+			w.writeBit(true)
+			w.writeBits(uint64(leading), 5)
+			w.writeBits(uint64(length), 6)
+			w.writeBits(xor>>trailing, length)
+
+			prevLeading = leading
+			prevTrailing = trailing
+		}
+	}
+
+	return w.buf
+}
+
+// decodePoints decompress a list of points
+func decodePoints(buf []byte) ([]TimeValuePair, error) {
+	var prevDelta int64
+	var prevLeading uint
+	var prevTrailing uint
+
+	r := &bitReader{buf: buf}
+
+	n, err := r.readBits(16)
+	if err != nil {
+		return nil, err
+	}
+	points := make([]TimeValuePair, 0, n)
+	if n == 0 {
+		return points, nil
+	}
+
+	t, err := r.readBits(64)
+	if err != nil {
+		return nil, err
+	}
+	v, err := r.readBits(64)
+	if err != nil {
+		return nil, err
+	}
+	count, err := r.readCount()
+	if err != nil {
+		return nil, err
+	}
+	points = append(points, TimeValuePair{timeStamp: int64(t), value: math.Float64frombits(v), count: count})
+
+	for i := uint64(1); i < n; i++ {
+		prev := points[len(points)-1]
+
+		// timestamp delta-of-delta, count the leading '1' control bits
+		control := uint(0)
+		for control < 4 {
+			bit, err := r.readBit()
+			if err != nil {
+				return nil, err
+			}
+			if !bit {
+				break
+			}
+			control++
+		}
+
+		var dod int64
+		switch control {
+		case 0:
+			dod = 0
+		case 4:
+			u, err := r.readBits(64)
+			if err != nil {
+				return nil, err
+			}
+			dod = int64(u)
+		default:
+			valueBits := dodBuckets[control-1].valueBits
+			u, err := r.readBits(valueBits)
+			if err != nil {
+				return nil, err
+			}
+			// sign extend
+			dod = int64(u)
+			if u > 1<<(valueBits-1) {
+				dod -= 1 << valueBits
+			}
+		}
+		prevDelta += dod
+
+		count, err := r.readCount()
+		if err != nil {
+			return nil, err
+		}
+
+		// value XOR
+		xor := uint64(0)
+		bit, err := r.readBit()
+		if err != nil {
+			return nil, err
+		}
+		if bit {
+			newWindow, err := r.readBit()
+			if err != nil {
+				return nil, err
+			}
+			if newWindow {
+				leading, err := r.readBits(5)
+				if err != nil {
+					return nil, err
+				}
+				length, err := r.readBits(6)
+				if err != nil {
+					return nil, err
+				}
+				if length == 0 {
+					length = 64
+				}
+				prevLeading = uint(leading)
+				prevTrailing = 64 - prevLeading - uint(length)
+			}
+
+			u, err := r.readBits(64 - prevLeading - prevTrailing)
+			if err != nil {
+				return nil, err
+			}
+			xor = u << prevTrailing
+		}
+
+		points = append(points, TimeValuePair{
+			timeStamp: prev.timeStamp + prevDelta,
+			value:     math.Float64frombits(math.Float64bits(prev.value) ^ xor),
+			count:     count,
+		})
+	}
+
+	return points, nil
+}
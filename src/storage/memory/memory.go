@@ -17,69 +17,181 @@
 package memory
 
 import (
-	"errors"
+	"fmt"
 	"log"
+	"math"
 	"net/url"
+	"os"
 	"regexp"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/MohawkTSDB/mohawk/src/storage"
+	"github.com/MohawkTSDB/mohawk/src/storage/wal"
 )
 
+// TimeValuePair one ring slot, count is the number of samples merged into
+// the slot, see the write conflict policies
 type TimeValuePair struct {
 	timeStamp int64
 	value     float64
+	count     int64
 }
 
+// TimeSeries one metric data ring, the mutex guards tags, chunks and lastValue
+//
+// the ring is split into chunks, see chunk, chunks that have no valid
+// slots are not allocated, head is the key of the chunk holding the last
+// value, all other chunks are eventually sealed.
+//
+// rollups hold one map of aggregated buckets per rollup tier, see tier.
 type TimeSeries struct {
+	mutex     sync.RWMutex
 	tags      map[string]string
-	data      []TimeValuePair
+	chunks    map[int64]*chunk
+	head      int64
+	rollups   []map[int64]*aggregate
 	lastValue TimeValuePair
 }
 
+// memoryStats memory usage counters, see Stats
+type memoryStats struct {
+	series       int
+	chunks       int
+	sealedChunks int
+	points       int
+	sealedPoints int
+	bytes        int
+	sealedBytes  int
+	buckets      int
+}
+
+// Tenant a list of time series, the mutex guards the ts map
 type Tenant struct {
-	ts map[string]*TimeSeries
+	mutex sync.RWMutex
+	ts    map[string]*TimeSeries
 }
 
+// Storage the memory storage, the mutex guards the tenant map
+//
+// locks are always taken in storage -> tenant -> time series order,
+// a time series lock is never held while waiting for a tenant lock.
+//
+// writers hold a read lock on commitMutex while logging and applying a
+// write, snapshots hold a write lock on it while rotating the write ahead
+// log and copying the storage, so a snapshot includes all the records of
+// older segments and none of the records of newer segments.
 type Storage struct {
 	timeGranularitySec int64
 	timeRetentionSec   int64
 	timeLastSec        int64
 	arraySize          int64
+	tiers              []tier
+	policy             int
 
+	snapshotDir         string
+	snapshotIntervalSec int64
+
+	commitMutex sync.RWMutex
+	wal         *wal.Log
+
+	mutex  sync.RWMutex
 	tenant map[string]*Tenant
+
+	done      chan struct{}
+	workers   sync.WaitGroup
+	closeOnce sync.Once
+}
+
+func init() {
+	storage.Register("memory", func() storage.Storage { return &Storage{} })
 }
 
 // Storage functions
 // Required by storage interface
 
 // Name return a human readable storage name
-func (r Storage) Name() string {
+func (r *Storage) Name() string {
 	return "Storage-Memory"
 }
 
 // Help return a human readable storage help message
-func (r Storage) Help() string {
+func (r *Storage) Help() string {
 	return `Memory storage [memory]:
-	granularity - (optional) samples max granularity (default "30s").
-	retention   - (optional) samples max retention (default "1d").
+	granularity       - (optional) samples max granularity (default "30s").
+	retention         - (optional) samples max retention (default "1d").
+	tiers             - (optional) comma separated granularity:retention list, the first tier is the raw
+	                    samples and overrides granularity and retention, older data is kept in rollup
+	                    tiers of min/max/sum/count aggregates, a rollup granularity must be a multiple
+	                    of the raw granularity, stats older then the raw retention have no median and
+	                    percentiles.
+	policy            - (optional) how points in the same granularity window are merged, first, last,
+	                    min, max, sum or average (default "first"), a time series "__policy__" tag
+	                    overrides it.
+	snapshot-dir      - (optional) a directory for snapshot files, if empty snapshots are disabled.
+	snapshot-interval - (optional) time between snapshots (default "5mn").
+	wal-dir           - (optional) a directory for write ahead log files, if empty the log is disabled.
+	wal-sync          - (optional) write ahead log fsync policy, always, interval or never (default "interval").
+	wal-sync-interval - (optional) time between write ahead log fsyncs (default "1s").
 	Examples:
-		--options=retention=6h&granularity=30s`
+		--options=retention=6h&granularity=30s
+		--options=tiers=30s:1d,5mn:30d,1h:1y
+		--options=granularity=1mn&policy=average
+		--options=snapshot-dir=/data&snapshot-interval=10mn
+		--options=snapshot-dir=/data&wal-dir=/data/wal&wal-sync=always`
 }
 
 // Open storage
-func (r *Storage) Open(options url.Values) {
+func (r *Storage) Open(options url.Values) error {
 	granularity := int64(30)
 	retention := int64(24 * 60 * 60)
+	snapshotInterval := int64(5 * 60)
+	walSyncIntervalSec := int64(1)
+	walSeq := int64(0)
+
+	var err error
 
 	// check for user options
 	granularityStr := options.Get("granularity")
 	if granularityStr != "" {
-		granularity = storage.ParseSec(granularityStr)
+		if granularity, err = storage.ParseDuration(granularityStr); err != nil || granularity < 1 {
+			return fmt.Errorf("memory: Bad granularity %s", granularityStr)
+		}
 	}
 	retentionStr := options.Get("retention")
 	if retentionStr != "" {
-		retention = storage.ParseSec(retentionStr)
+		if retention, err = storage.ParseDuration(retentionStr); err != nil || retention < granularity {
+			return fmt.Errorf("memory: Bad retention %s", retentionStr)
+		}
+	}
+	snapshotIntervalStr := options.Get("snapshot-interval")
+	if snapshotIntervalStr != "" {
+		if snapshotInterval, err = storage.ParseDuration(snapshotIntervalStr); err != nil || snapshotInterval < 1 {
+			return fmt.Errorf("memory: Bad snapshot interval %s", snapshotIntervalStr)
+		}
+	}
+	walSyncIntervalStr := options.Get("wal-sync-interval")
+	if walSyncIntervalStr != "" {
+		if walSyncIntervalSec, err = storage.ParseDuration(walSyncIntervalStr); err != nil || walSyncIntervalSec < 1 {
+			return fmt.Errorf("memory: Bad wal sync interval %s", walSyncIntervalStr)
+		}
+	}
+	walSyncPolicy, err := wal.ParseSyncPolicy(options.Get("wal-sync"))
+	if err != nil {
+		return err
+	}
+	walDir := options.Get("wal-dir")
+	if r.policy, err = parsePolicy(options.Get("policy")); err != nil {
+		return err
+	}
+	tiersStr := options.Get("tiers")
+	if tiersStr != "" {
+		if r.tiers, err = parseTiers(tiersStr); err != nil {
+			return err
+		}
+		granularity = r.tiers[0].granularitySec
+		retention = r.tiers[0].retentionSec
 	}
 
 	// set last entry time
@@ -90,6 +202,9 @@ func (r *Storage) Open(options url.Values) {
 	r.timeRetentionSec = retention
 	// calculate array size
 	r.arraySize = r.timeRetentionSec / r.timeGranularitySec
+	// set snapshot directory and interval
+	r.snapshotDir = options.Get("snapshot-dir")
+	r.snapshotIntervalSec = snapshotInterval
 
 	// open db connection
 	r.tenant = make(map[string]*Tenant, 0)
@@ -98,12 +213,87 @@ func (r *Storage) Open(options url.Values) {
 	log.Printf("Start memory storage:")
 	log.Printf("  granularity: %ds", r.timeGranularitySec)
 	log.Printf("  retention: %ds", r.timeRetentionSec)
+	log.Printf("  policy: %s", policyNames[r.policy])
+	for _, t := range r.rollupTiers() {
+		log.Printf("  rollup tier: granularity %ds, retention %ds", t.granularitySec, t.retentionSec)
+	}
+
+	// restore data from last snapshot
+	if r.snapshotDir != "" {
+		log.Printf("  snapshot dir: %s", r.snapshotDir)
+		log.Printf("  snapshot interval: %ds", r.snapshotIntervalSec)
+
+		if err = os.MkdirAll(r.snapshotDir, 0755); err != nil {
+			return fmt.Errorf("memory: Can't create snapshot dir: %s", err)
+		}
+		if walSeq, err = r.loadSnapshot(); err != nil {
+			return fmt.Errorf("memory: Can't load snapshot: %s", err)
+		}
+	}
+
+	// replay the write ahead log records written after the last snapshot
+	if walDir != "" {
+		log.Printf("  wal dir: %s", walDir)
+		log.Printf("  wal sync: %s", wal.SyncPolicyNames[walSyncPolicy])
+
+		if r.wal, err = wal.Open(walDir, walSyncPolicy); err != nil {
+			return fmt.Errorf("memory: Can't open write ahead log: %s", err)
+		}
+		count, err := r.wal.Replay(walSeq, r.applyRecord)
+		if err != nil {
+			return fmt.Errorf("memory: Can't replay write ahead log: %s", err)
+		}
+		log.Printf("wal: replayed %d records\n", count)
+
+		if walSyncPolicy == wal.SyncInterval {
+			go r.wal.Syncs(time.Duration(walSyncIntervalSec) * time.Second)
+		}
+	}
+
+	// start a worker that will save snapshots periodically
+	r.done = make(chan struct{})
+	if r.snapshotDir != "" {
+		r.workers.Add(1)
+		go r.snapshots()
+	}
 
 	// start a maintenance worker that will clean the db periodically
+	r.workers.Add(1)
 	go r.maintenance()
+
+	return nil
 }
 
-func (r Storage) GetTenants() ([]storage.Tenant, error) {
+// Close stop the workers, save a last snapshot and close the write ahead log
+func (r *Storage) Close() error {
+	var err error
+
+	// a storage that failed to open has nothing to save
+	if r.done == nil {
+		return nil
+	}
+
+	r.closeOnce.Do(func() {
+		close(r.done)
+		r.workers.Wait()
+
+		if r.snapshotDir != "" {
+			err = r.saveSnapshot()
+		}
+		if r.wal != nil {
+			if errClose := r.wal.Close(); err == nil {
+				err = errClose
+			}
+		}
+	})
+
+	return err
+}
+
+func (r *Storage) GetTenants() ([]storage.Tenant, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
 	res := make([]storage.Tenant, 0, len(r.tenant))
 
 	// return a list of tenants
@@ -114,29 +304,40 @@ func (r Storage) GetTenants() ([]storage.Tenant, error) {
 	return res, nil
 }
 
-func (r Storage) GetItemList(tenant string, tags map[string]string) ([]storage.Item, error) {
+func (r *Storage) GetItemList(tenant string, tags map[string]string) ([]storage.Item, error) {
 	res := make([]storage.Item, 0)
-	t, ok := r.tenant[tenant]
+	t := r.getTenant(tenant)
 
-	// check tenant
-	if !ok {
-		return res, errors.New("memory: Can't set tenant")
+	// an unknown tenant has no items, reads do not create it
+	if t == nil {
+		return res, nil
 	}
 
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
 	for key, ts := range t.ts {
+		ts.mutex.RLock()
 		if hasMatchingTag(tags, ts.tags) {
 			lastValue := storage.DataItem{
 				Timestamp: ts.lastValue.timeStamp,
 				Value:     ts.lastValue.value,
 			}
 
+			// copy the tags, the series tags may change after we return
+			itemTags := make(map[string]string, len(ts.tags))
+			for k, v := range ts.tags {
+				itemTags[k] = v
+			}
+
 			res = append(res, storage.Item{
 				ID:         key,
 				Type:       "gauge",
-				Tags:       ts.tags,
+				Tags:       itemTags,
 				LastValues: []storage.DataItem{lastValue},
 			})
 		}
+		ts.mutex.RUnlock()
 	}
 
 	return res, nil
@@ -148,15 +349,31 @@ func (r *Storage) GetRawData(tenant string, id string, end int64, start int64, l
 	pStart := r.getPosForTimestamp(start)
 	pEnd := r.getPosForTimestamp(end)
 
-	// check if tenant and id exists, create them if necessary
-	r.checkID(tenant, id)
+	// check if tenant and id exists, reads do not create them
+	ts := r.getTimeSeries(tenant, id)
+	if ts == nil {
+		return res, storage.NotFoundError{Tenant: tenant, ID: id}
+	}
 
-	// fill data out array
+	ts.mutex.RLock()
+	defer ts.mutex.RUnlock()
+
+	// the ring does not hold positions older then one ring size
+	if pEnd-pStart >= r.arraySize {
+		pStart = pEnd - r.arraySize + 1
+	}
+
+	// fill data out array, walk the ring backwards for DESC order
+	// so the limit keeps the newest points
 	count := int64(0)
-	ts := r.tenant[tenant].ts[id]
+	slots := r.newSlotReader(ts)
 
-	for i := pStart; count < limit && i <= pEnd; i++ {
-		d := ts.data[i%r.arraySize]
+	for n := int64(0); count < limit && n <= pEnd-pStart; n++ {
+		i := pStart + n
+		if order == "DESC" {
+			i = pEnd - n
+		}
+		d := slots.get(i)
 
 		// if this is a valid point
 		if d.timeStamp < end && d.timeStamp >= start {
@@ -168,55 +385,72 @@ func (r *Storage) GetRawData(tenant string, id string, end int64, start int64, l
 		}
 	}
 
-	// order
-	if order == "DESC" {
-		for i := 0; i < len(res)/2; i++ {
-			j := len(res) - i - 1
-			res[i], res[j] = res[j], res[i]
-		}
-	}
-
 	return res, nil
 }
 
-func (r Storage) GetStatData(tenant string, id string, end int64, start int64, limit int64, order string, bucketDuration int64) ([]storage.StatItem, error) {
+func (r *Storage) GetStatData(tenant string, id string, end int64, start int64, limit int64, order string, bucketDuration int64, percentiles []float64) ([]storage.StatItem, error) {
+	var points int64
 	var samples int64
 	var bucketStart int64
 	var bucketEnd int64
 	var sum float64
+	var sumSq float64
 	var first float64
 	var last float64
 	var min float64
 	var max float64
+	var values []float64
+	var quantiles storage.Quantiles
 
 	res := make([]storage.StatItem, 0)
+	stepMili := r.timeGranularitySec * 1000
 	pEnd, pStart, pStep := r.getStatTimes(end, start, bucketDuration)
 
-	// check if tenant and id exists, create them if necessary
-	r.checkID(tenant, id)
+	// buckets are aligned to multiples of the bucket duration
+	stepSizeMili := pStep * stepMili
+	bucketStart = start - start%stepSizeMili
+	pStart = r.getPosForTimestamp(bucketStart)
+
+	// check if tenant and id exists, reads do not create them
+	ts := r.getTimeSeries(tenant, id)
+	if ts == nil {
+		return res, storage.NotFoundError{Tenant: tenant, ID: id}
+	}
+
+	ts.mutex.RLock()
+	defer ts.mutex.RUnlock()
+
+	// read from the coarsest rollup tier that fits the bucket duration, a
+	// rollup tier does not keep the bucket values, so a range still held in
+	// the raw data is read from the raw data for the median and percentiles
+	if i := r.statTier(bucketDuration); i >= 0 && start < r.rawStart() {
+		return r.getRollupStatData(ts, i, end, start, limit, order, bucketDuration), nil
+	}
 
 	// fill data out array
 	count := int64(0)
-	ts := r.tenant[tenant].ts[id]
-	stepMili := r.timeGranularitySec * 1000
-	stepSizeMili := pStep * stepMili
-	bucketStart = start
+	slots := r.newSlotReader(ts)
 
 	for b := pStart; count < limit && b <= pEnd; b = b + pStep {
+		points = 0
 		samples = 0
 		sum = 0
+		sumSq = 0
+		values = values[:0]
+		quantiles.Reset()
 
 		bucketEnd = bucketStart + stepSizeMili
 
 		// loop on all points in bucket
 		for i := b; i < (b + pStep); i++ {
-			d := ts.data[i%r.arraySize]
+			d := slots.get(i)
 
-			if d.timeStamp < bucketEnd && d.timeStamp >= bucketStart {
-				samples++
+			if d.timeStamp < bucketEnd && d.timeStamp >= bucketStart && d.timeStamp >= start && d.timeStamp < end {
+				points++
+				samples += d.count
 
 				// calculate bucket stat values
-				if samples == 1 {
+				if points == 1 {
 					// first sample
 					first = d.value
 					min = first
@@ -233,24 +467,33 @@ func (r Storage) GetStatData(tenant string, id string, end int64, start int64, l
 
 				last = d.value
 				sum = sum + d.value
+				sumSq = sumSq + d.value*d.value
+				values = append(values, d.value)
+				if len(percentiles) > 0 {
+					quantiles.Add(d.value)
+				}
 			}
 		}
 
 		// all points are valid
-		if samples > 0 {
+		if points > 0 {
 			count++
+			avg := sum / float64(points)
 
 			res = append(res, storage.StatItem{
-				Start:   bucketStart,
-				End:     bucketEnd,
-				Empty:   false,
-				Samples: samples,
-				First:   first,
-				Last:    last,
-				Min:     min,
-				Max:     max,
-				Avg:     sum / float64(samples),
-				Sum:     sum,
+				Start:       bucketStart,
+				End:         bucketEnd,
+				Empty:       false,
+				Samples:     samples,
+				First:       first,
+				Last:        last,
+				Min:         min,
+				Max:         max,
+				Avg:         avg,
+				Median:      storage.Median(values),
+				Std:         math.Sqrt(math.Max(sumSq/float64(points)-avg*avg, 0)),
+				Sum:         sum,
+				Percentiles: quantiles.Percentiles(percentiles),
 			})
 		}
 
@@ -271,60 +514,124 @@ func (r Storage) GetStatData(tenant string, id string, end int64, start int64, l
 
 // PostRawData handle posting data to db
 func (r *Storage) PostRawData(tenant string, id string, t int64, v float64) error {
-	// check if tenant and id exists, create them if necessary
-	r.checkID(tenant, id)
-
-	// update time value pair to the time serias
-	// unless slot already have valid value
-	p := r.getPosForTimestamp(t)
-	if r.tenant[tenant].ts[id].data[p%r.arraySize].timeStamp < (t - r.timeGranularitySec*1000) {
-		r.tenant[tenant].ts[id].data[p%r.arraySize] = TimeValuePair{timeStamp: t, value: v}
-	}
-
-	// update last value
-	if r.tenant[tenant].ts[id].lastValue.timeStamp < t {
-		r.tenant[tenant].ts[id].lastValue.timeStamp = t
-		r.tenant[tenant].ts[id].lastValue.value = v
-	}
+	return r.commit(&wal.Record{
+		Type:   wal.RecordData,
+		Tenant: tenant,
+		ID:     id,
+		Data:   []storage.DataItem{{Timestamp: t, Value: v}},
+	})
+}
 
-	// update last
-	tSec := t / 1000
-	if tSec > r.timeLastSec {
-		r.timeLastSec = tSec
+// PostBatchData handle posting a batch of data points to db
+func (r *Storage) PostBatchData(tenant string, items []storage.BatchItem) error {
+	recs := make([]*wal.Record, 0, len(items))
+	for _, item := range items {
+		recs = append(recs, &wal.Record{
+			Type:   wal.RecordData,
+			Tenant: tenant,
+			ID:     item.ID,
+			Data:   item.Data,
+		})
 	}
 
-	return nil
+	return r.commit(recs...)
 }
 
 // PutTags handle posting tags to db
 func (r *Storage) PutTags(tenant string, id string, tags map[string]string) error {
-	// check if tenant and id exists, create them if necessary
-	r.checkID(tenant, id)
-
-	// update time serias tags
-	if len(tags) > 0 {
-		for key, value := range tags {
-			r.tenant[tenant].ts[id].tags[key] = value
-		}
-	}
-
-	return nil
+	return r.commit(&wal.Record{
+		Type:   wal.RecordTags,
+		Tenant: tenant,
+		ID:     id,
+		Tags:   tags,
+	})
 }
 
 // DeleteData handle delete data fron db
 func (r *Storage) DeleteData(tenant string, id string, end int64, start int64) error {
-	return nil
+	// check if id exist
+	if r.getTimeSeries(tenant, id) == nil {
+		return storage.NotFoundError{Tenant: tenant, ID: id}
+	}
+
+	return r.commit(&wal.Record{
+		Type:   wal.RecordDeleteData,
+		Tenant: tenant,
+		ID:     id,
+		End:    end,
+		Start:  start,
+	})
 }
 
 // DeleteTags handle delete tags fron db
 func (r *Storage) DeleteTags(tenant string, id string, tags []string) error {
-	return nil
+	// check if id exist
+	if r.getTimeSeries(tenant, id) == nil {
+		return storage.NotFoundError{Tenant: tenant, ID: id}
+	}
+
+	return r.commit(&wal.Record{
+		Type:   wal.RecordDeleteTags,
+		Tenant: tenant,
+		ID:     id,
+		Keys:   tags,
+	})
+}
+
+// Optional storage functions
+// Not required by storage interface
+
+// Stats return memory usage statistics, bytes count the chunk data only
+func (r *Storage) Stats() map[string]float64 {
+	var s memoryStats
+
+	// take a copy of the tenant list, so writers are not blocked
+	r.mutex.RLock()
+	tenants := make([]*Tenant, 0, len(r.tenant))
+	for _, t := range r.tenant {
+		tenants = append(tenants, t)
+	}
+	r.mutex.RUnlock()
+
+	for _, t := range tenants {
+		t.mutex.RLock()
+		for _, ts := range t.ts {
+			ts.mutex.RLock()
+			s.series++
+			ts.chunkStats(&s)
+			for _, buckets := range ts.rollups {
+				s.buckets += len(buckets)
+			}
+			ts.mutex.RUnlock()
+		}
+		t.mutex.RUnlock()
+	}
+
+	res := map[string]float64{
+		"tenants":          float64(len(tenants)),
+		"series":           float64(s.series),
+		"chunks":           float64(s.chunks),
+		"sealedChunks":     float64(s.sealedChunks),
+		"points":           float64(s.points),
+		"bytes":            float64(s.bytes + s.sealedBytes),
+		"rollupBuckets":    float64(s.buckets),
+		"bytesPerPoint":    0,
+		"compressionRatio": 0,
+	}
+	if s.points > 0 {
+		res["bytesPerPoint"] = float64(s.bytes+s.sealedBytes) / float64(s.points)
+	}
+	if s.sealedBytes > 0 {
+		res["compressionRatio"] = float64(s.sealedPoints*pointSize) / float64(s.sealedBytes)
+	}
+
+	return res
 }
 
 // Helper functions
 // Not required by storage interface
 
-func (r Storage) getStatTimes(end int64, start int64, bucketDuration int64) (int64, int64, int64) {
+func (r *Storage) getStatTimes(end int64, start int64, bucketDuration int64) (int64, int64, int64) {
 	pStep := bucketDuration / r.timeGranularitySec
 	pStart := r.getPosForTimestamp(start)
 	pEnd := r.getPosForTimestamp(end)
@@ -341,19 +648,182 @@ func (r *Storage) getPosForTimestamp(timestamp int64) int64 {
 	return timestamp / 1000 / r.timeGranularitySec
 }
 
-func (r *Storage) checkID(tenant string, id string) {
-	var ok bool
+func (r *Storage) getTenant(tenant string) *Tenant {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.tenant[tenant]
+}
+
+// getTimeSeries return a time series, or nil if tenant or id does not exist
+func (r *Storage) getTimeSeries(tenant string, id string) *TimeSeries {
+	t := r.getTenant(tenant)
+	if t == nil {
+		return nil
+	}
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
 
+	return t.ts[id]
+}
+
+func (r *Storage) checkID(tenant string, id string) *TimeSeries {
 	// check for tenant
-	if _, ok = r.tenant[tenant]; !ok {
-		r.tenant[tenant] = &Tenant{ts: make(map[string]*TimeSeries)}
+	t := r.getTenant(tenant)
+	if t == nil {
+		r.mutex.Lock()
+		if t = r.tenant[tenant]; t == nil {
+			t = &Tenant{ts: make(map[string]*TimeSeries)}
+			r.tenant[tenant] = t
+		}
+		r.mutex.Unlock()
 	}
 
 	// check for TimeSeries
-	if _, ok = r.tenant[tenant].ts[id]; !ok {
-		r.tenant[tenant].ts[id] = &TimeSeries{
-			tags: make(map[string]string),
-			data: make([]TimeValuePair, r.timeRetentionSec/r.timeGranularitySec),
+	t.mutex.RLock()
+	ts := t.ts[id]
+	t.mutex.RUnlock()
+	if ts == nil {
+		t.mutex.Lock()
+		if ts = t.ts[id]; ts == nil {
+			ts = newTimeSeries()
+			t.ts[id] = ts
+		}
+		t.mutex.Unlock()
+	}
+
+	return ts
+}
+
+// commit log records to the write ahead log and apply them to the storage
+func (r *Storage) commit(recs ...*wal.Record) error {
+	r.commitMutex.RLock()
+	defer r.commitMutex.RUnlock()
+
+	if r.wal != nil {
+		if err := r.wal.Append(recs...); err != nil {
+			return err
+		}
+	}
+
+	for _, rec := range recs {
+		r.applyRecord(rec)
+	}
+
+	return nil
+}
+
+// applyRecord apply one record to the storage
+func (r *Storage) applyRecord(rec *wal.Record) {
+	var ts *TimeSeries
+
+	// deletes never create a time series, other records create it if necessary
+	if rec.Type == wal.RecordDeleteData || rec.Type == wal.RecordDeleteTags {
+		if ts = r.getTimeSeries(rec.Tenant, rec.ID); ts == nil {
+			return
+		}
+	} else {
+		ts = r.checkID(rec.Tenant, rec.ID)
+	}
+
+	// lock the time series once for all the record data
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	switch rec.Type {
+	case wal.RecordData:
+		for _, d := range rec.Data {
+			r.postRawData(ts, d.Timestamp, d.Value)
+		}
+	case wal.RecordTags:
+		// update time serias tags
+		for key, value := range rec.Tags {
+			ts.tags[key] = value
+		}
+	case wal.RecordDeleteData:
+		r.deleteData(ts, rec.End, rec.Start)
+	case wal.RecordDeleteTags:
+		for _, key := range rec.Keys {
+			delete(ts.tags, key)
+		}
+	}
+}
+
+// deleteData clear the ring slots in a time range, caller must hold the time series lock
+func (r *Storage) deleteData(ts *TimeSeries, end int64, start int64) {
+	pStart := r.getPosForTimestamp(start)
+	pEnd := r.getPosForTimestamp(end)
+
+	// a range longer then the ring covers all slots
+	if pEnd-pStart >= r.arraySize {
+		pStart = 0
+		pEnd = r.arraySize - 1
+	}
+
+	// only chunks with deleted points are unsealed
+	slots := r.newSlotReader(ts)
+	for i := pStart; i <= pEnd; i++ {
+		if d := slots.get(i); d.timeStamp < end && d.timeStamp >= start {
+			r.setSlot(ts, i, TimeValuePair{})
+		}
+	}
+
+	// if last value was deleted, find the new last value
+	if ts.lastValue.timeStamp < end && ts.lastValue.timeStamp >= start {
+		ts.lastValue = TimeValuePair{}
+		ts.eachSlot(func(d TimeValuePair) {
+			if d.timeStamp > ts.lastValue.timeStamp {
+				ts.lastValue = d
+			}
+		})
+	}
+
+	r.deleteRollups(ts, end, start)
+}
+
+// postRawData update one time series and its rollups, caller must hold the time series lock
+func (r *Storage) postRawData(ts *TimeSeries, t int64, v float64) {
+	r.updateLast(t)
+
+	p := r.getPosForTimestamp(t)
+	old := r.getSlot(ts, p)
+	d := TimeValuePair{timeStamp: t, value: v, count: 1}
+
+	switch oldP := r.getPosForTimestamp(old.timeStamp); {
+	case old.timeStamp == 0 || oldP < p:
+		// an empty slot, or a slot holding data from an older ring lap
+		r.setPoint(ts, p, d)
+		r.rollupPoint(ts, d)
+	case oldP == p:
+		// the slot already holds a point of this granularity window
+		d = mergePoint(r.seriesPolicy(ts), old, t, v)
+		r.setPoint(ts, p, d)
+		r.rollupReplace(ts, old, d)
+	default:
+		// the slot holds newer data from a later ring lap, drop the point
+	}
+}
+
+// setPoint set a ring slot and update the last value, caller must hold the time series lock
+func (r *Storage) setPoint(ts *TimeSeries, p int64, d TimeValuePair) {
+	r.setSlot(ts, p, d)
+
+	// update last value, and seal the previous head chunk
+	// when the last value moves into a new chunk
+	if ts.lastValue.timeStamp <= d.timeStamp {
+		ts.lastValue = d
+		r.moveHead(ts, p)
+	}
+}
+
+// updateLast update the time of the newest point in the storage
+func (r *Storage) updateLast(t int64) {
+	tSec := t / 1000
+	for {
+		last := atomic.LoadInt64(&r.timeLastSec)
+		if tSec <= last || atomic.CompareAndSwapInt64(&r.timeLastSec, last, tSec) {
+			break
 		}
 	}
 }
@@ -381,33 +851,93 @@ func hasMatchingTag(tags map[string]string, itemTags map[string]string) bool {
 }
 
 func (r *Storage) maintenance() {
+	defer r.workers.Done()
+
 	// clean data every 120 minutes
-	c := time.Tick(120 * time.Minute)
+	c := time.NewTicker(120 * time.Minute)
+	defer c.Stop()
 
 	// once a tick clean data
-	for range c {
-		log.Printf("maintenance: start\n")
-		r.cleanData()
+	for {
+		select {
+		case <-c.C:
+			log.Printf("maintenance: start\n")
+			r.cleanData()
+
+			// without snapshots, the write ahead log is truncated by retention
+			if r.wal != nil && r.snapshotDir == "" {
+				r.cleanWAL()
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+func (r *Storage) cleanWAL() {
+	if _, err := r.wal.Rotate(); err != nil {
+		log.Printf("maintenance: %s\n", err)
+		return
+	}
+
+	validTime := time.Now().Add(-time.Duration(r.timeRetentionSec) * time.Second)
+	if err := r.wal.RemoveOlderThan(validTime); err != nil {
+		log.Printf("maintenance: %s\n", err)
 	}
 }
 
 func (r *Storage) cleanData() {
 	var lastTimeStampSec int64
-	validTimeStamp := time.Now().Unix() - r.timeRetentionSec
+	var freed int
+	var sealed int
+	var freedBuckets int
+	nowSec := time.Now().Unix()
+	validTimeStamp := nowSec - r.timeRetentionSec
+
+	// time series are kept while any tier holds their data
+	validSeriesTimeStamp := validTimeStamp
+	for _, t := range r.rollupTiers() {
+		if nowSec-t.retentionSec < validSeriesTimeStamp {
+			validSeriesTimeStamp = nowSec - t.retentionSec
+		}
+	}
 
-	// loop on all tenants
+	// take a copy of the tenant list, so writers are not blocked
+	r.mutex.RLock()
+	tenants := make([]*Tenant, 0, len(r.tenant))
 	for _, t := range r.tenant {
+		tenants = append(tenants, t)
+	}
+	r.mutex.RUnlock()
+
+	// loop on all tenants
+	for _, t := range tenants {
+		t.mutex.Lock()
+
 		// loop on all time series in this tenant
 		for key, ts := range t.ts {
+			ts.mutex.Lock()
 			lastTimeStampSec = ts.lastValue.timeStamp / 1000
 
-			// if last value is more then time span old, remove data
-			if lastTimeStampSec <= validTimeStamp {
+			// if last value is more then time span old, remove data,
+			// o/w free the chunks that hold only expired data
+			if lastTimeStampSec <= validSeriesTimeStamp {
 				log.Printf("maintenance: delete item %s\n", key)
 				delete(t.ts, key)
+			} else {
+				freed += ts.freeExpiredChunks(validTimeStamp * 1000)
+				freedBuckets += r.freeExpiredRollups(ts)
+
+				// seal chunks unsealed by late writes and deletes
+				sealed += ts.sealChunks()
 			}
+			ts.mutex.Unlock()
 		}
 
+		t.mutex.Unlock()
+
 		// TODO: delete tenant if no time seriess
 	}
+
+	log.Printf("maintenance: freed %d expired chunks and %d rollup buckets, sealed %d chunks\n", freed, freedBuckets, sealed)
 }
@@ -0,0 +1,641 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package memory interface for memory metric data storage
+package memory
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MohawkTSDB/mohawk/src/storage"
+	"github.com/MohawkTSDB/mohawk/src/storage/storagetest"
+)
+
+const stressWorkers = 8
+const stressRounds = 200
+
+func newTestStorage() *Storage {
+	r := &Storage{}
+	r.Open(url.Values{"granularity": {"1s"}, "retention": {"1h"}})
+
+	return r
+}
+
+func TestStorage(t *testing.T) {
+	storagetest.Run(t, newTestStorage())
+}
+
+func TestStorageTiers(t *testing.T) {
+	// stats of the shared tests fit the rollup tiers, and are read from the raw data
+	r := &Storage{}
+	r.Open(url.Values{"tiers": {"1s:1h,1mn:1d,5mn:1d"}})
+
+	storagetest.Run(t, r)
+}
+
+// TestConcurrentAccess run reads, writes and cleanups in parallel,
+// use "go test -race" to check for data races.
+func TestConcurrentAccess(t *testing.T) {
+	var wg sync.WaitGroup
+
+	r := newTestStorage()
+	now := time.Now().UTC().Unix() * 1000
+
+	for w := 0; w < stressWorkers; w++ {
+		tenant := fmt.Sprintf("tenant-%d", w%2)
+		id := fmt.Sprintf("cpu-%d", w%3)
+
+		wg.Add(4)
+
+		// writers
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < stressRounds; i++ {
+				ts := now - int64(i)*1000
+				r.PostRawData(tenant, id, ts, float64(i))
+				r.PostBatchData(tenant, []storage.BatchItem{
+					{ID: id + "-batch", Data: []storage.DataItem{{Timestamp: ts, Value: float64(w)}}},
+				})
+			}
+		}(w)
+
+		// tag writers
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < stressRounds; i++ {
+				r.PutTags(tenant, id, map[string]string{"worker": fmt.Sprintf("%d", w), "round": fmt.Sprintf("%d", i)})
+			}
+		}(w)
+
+		// readers
+		go func() {
+			defer wg.Done()
+			for i := 0; i < stressRounds; i++ {
+				r.GetRawData(tenant, id, now+1000, now-3600*1000, 100, "DESC")
+				r.GetStatData(tenant, id, now+1000, now-3600*1000, 100, "ASC", 60, nil)
+				r.GetItemList(tenant, map[string]string{"worker": ".*"})
+				r.GetTenants()
+			}
+		}()
+
+		// maintenance
+		go func() {
+			defer wg.Done()
+			for i := 0; i < stressRounds/10; i++ {
+				r.cleanData()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	// all series were written in the last hour, none should be cleaned
+	items, err := r.GetItemList("tenant-0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) == 0 {
+		t.Error("expected items in tenant-0")
+	}
+}
+
+func TestPostBatchData(t *testing.T) {
+	r := newTestStorage()
+	now := time.Now().UTC().Unix() * 1000
+
+	data := make([]storage.DataItem, 0, 10)
+	for i := int64(0); i < 10; i++ {
+		data = append(data, storage.DataItem{Timestamp: now - i*1000, Value: float64(i)})
+	}
+	if err := r.PostBatchData("_ops", []storage.BatchItem{{ID: "free_memory", Data: data}}); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := r.GetRawData("_ops", "free_memory", now+1000, now-60*1000, 100, "DESC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 10 || res[0].Value != 0 || res[9].Value != 9 {
+		t.Errorf("unexpected batch data %+v", res)
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mohawk-memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	options := url.Values{"granularity": {"1s"}, "retention": {"1h"}, "snapshot-dir": {dir}}
+	now := time.Now().UTC().Unix() * 1000
+
+	// write some data and save a snapshot
+	r := &Storage{}
+	r.Open(options)
+	for i := int64(0); i < 5; i++ {
+		r.PostRawData("_ops", "free_memory", now-i*1000, float64(i))
+	}
+	r.PutTags("_ops", "free_memory", map[string]string{"units": "byte"})
+	if err = r.saveSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a new storage should load the snapshot on open
+	restored := &Storage{}
+	restored.Open(options)
+
+	res, err := restored.GetRawData("_ops", "free_memory", now+1000, now-60*1000, 100, "ASC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 5 || res[0].Value != 4 || res[4].Value != 0 {
+		t.Errorf("unexpected restored data %+v", res)
+	}
+
+	items, err := restored.GetItemList("_ops", map[string]string{"units": "byte"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].LastValues[0].Timestamp != now {
+		t.Errorf("unexpected restored items %+v", items)
+	}
+}
+
+func TestWALReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mohawk-memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	options := url.Values{
+		"granularity":  {"1s"},
+		"retention":    {"1h"},
+		"snapshot-dir": {dir},
+		"wal-dir":      {filepath.Join(dir, "wal")},
+		"wal-sync":     {"always"},
+	}
+	now := time.Now().UTC().Unix() * 1000
+
+	// write some data before and after a snapshot
+	r := &Storage{}
+	r.Open(options)
+	r.PostRawData("_ops", "free_memory", now-2000, 2)
+	if err = r.saveSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	r.PostBatchData("_ops", []storage.BatchItem{
+		{ID: "free_memory", Data: []storage.DataItem{{Timestamp: now - 1000, Value: 1}, {Timestamp: now, Value: 0}}},
+	})
+	r.PutTags("_ops", "free_memory", map[string]string{"units": "byte"})
+
+	// only segments written after the snapshot should be kept
+	segments, err := r.wal.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 1 {
+		t.Errorf("expected one wal segment, found %d", len(segments))
+	}
+
+	// a new storage should load the snapshot and replay the log on open
+	restored := &Storage{}
+	restored.Open(options)
+
+	res, err := restored.GetRawData("_ops", "free_memory", now+1000, now-60*1000, 100, "ASC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 3 || res[0].Value != 2 || res[2].Value != 0 {
+		t.Errorf("unexpected replayed data %+v", res)
+	}
+
+	items, err := restored.GetItemList("_ops", map[string]string{"units": "byte"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 {
+		t.Errorf("unexpected replayed items %+v", items)
+	}
+}
+
+func TestClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mohawk-memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	options := url.Values{
+		"granularity":  {"1s"},
+		"retention":    {"1h"},
+		"snapshot-dir": {dir},
+		"wal-dir":      {filepath.Join(dir, "wal")},
+		"wal-sync":     {"never"},
+	}
+	now := time.Now().UTC().Unix() * 1000
+
+	r := &Storage{}
+	if err = r.Open(options); err != nil {
+		t.Fatal(err)
+	}
+	r.PostRawData("_ops", "free_memory", now, 1)
+
+	// close saves a last snapshot, and leaves only the empty current segment
+	if err = r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, snapshotFileName)); err != nil {
+		t.Fatal(err)
+	}
+	segments, err := r.wal.Segments()
+	if err != nil || len(segments) != 1 {
+		t.Errorf("expected one wal segment, found %v, %v", segments, err)
+	}
+	if err = r.PostRawData("_ops", "free_memory", now-1000, 2); err == nil {
+		t.Error("expected an error when posting to a closed storage")
+	}
+	if err = r.Close(); err != nil {
+		t.Errorf("second close: %v", err)
+	}
+
+	restored := &Storage{}
+	if err = restored.Open(options); err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+
+	res, err := restored.GetRawData("_ops", "free_memory", now+1000, now-60*1000, 100, "ASC")
+	if err != nil || len(res) != 1 || res[0].Value != 1 {
+		t.Errorf("unexpected restored data %+v, %v", res, err)
+	}
+}
+
+func TestWALReplayAfterConcurrentSnapshot(t *testing.T) {
+	now := time.Now().UTC().Unix() * 1000
+	now -= now % (60 * 1000)
+
+	for round := 0; round < 3; round++ {
+		dir, err := ioutil.TempDir("", "mohawk-memory")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		options := url.Values{
+			"granularity":  {"1mn"},
+			"retention":    {"1h"},
+			"policy":       {"sum"},
+			"snapshot-dir": {dir},
+			"wal-dir":      {filepath.Join(dir, "wal")},
+			"wal-sync":     {"never"},
+		}
+
+		r := &Storage{}
+		if err = r.Open(options); err != nil {
+			t.Fatal(err)
+		}
+
+		// many series make copying the storage slow, writes run while copying
+		for i := 0; i < 5000; i++ {
+			r.PostRawData("_ops", fmt.Sprintf("free_memory_%d", i), now, 1)
+		}
+
+		// all samples are merged into one slot, while a snapshot is saved
+		var wg sync.WaitGroup
+		var mutex sync.Mutex
+		posted := 0
+		stop := make(chan struct{})
+		for w := 0; w < stressWorkers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					if err := r.PostRawData("_ops", "requests", now, 1); err == nil {
+						mutex.Lock()
+						posted++
+						mutex.Unlock()
+					}
+				}
+			}()
+		}
+		time.Sleep(10 * time.Millisecond)
+		if err = r.saveSnapshot(); err != nil {
+			t.Fatal(err)
+		}
+		close(stop)
+		wg.Wait()
+		r.wal.Sync()
+
+		// a sample in both the snapshot and the replayed log is counted twice
+		restored := &Storage{}
+		if err = restored.Open(options); err != nil {
+			t.Fatal(err)
+		}
+
+		stats, err := restored.GetStatData("_ops", "requests", now+60*1000, now, 10, "ASC", 60, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stats) != 1 || stats[0].Samples != int64(posted) || stats[0].Sum != float64(posted) {
+			t.Fatalf("expected %d samples and sum, got %+v", posted, stats)
+		}
+	}
+}
+
+func TestSparseChunks(t *testing.T) {
+	r := newTestStorage()
+	now := time.Now().UTC().Unix() * 1000
+
+	// reading an unknown id should not create it
+	r.GetRawData("_ops", "no_such_id", now, now-60*1000, 100, "ASC")
+	r.GetStatData("_ops", "no_such_id", now, now-60*1000, 100, "ASC", 10, nil)
+	if r.getTimeSeries("_ops", "no_such_id") != nil {
+		t.Error("reading an unknown id created a time series")
+	}
+
+	// one point should allocate one chunk
+	r.PostRawData("_ops", "free_memory", now, 42)
+	ts := r.getTimeSeries("_ops", "free_memory")
+	if len(ts.chunks) != 1 {
+		t.Errorf("expected one allocated chunk, found %d", len(ts.chunks))
+	}
+
+	// points in the same chunk should not allocate new chunks
+	r.PostRawData("_ops", "free_memory", now-1000, 41)
+	if len(ts.chunks) > 2 {
+		t.Errorf("expected at most two allocated chunks, found %d", len(ts.chunks))
+	}
+
+	// deleting all points should free all chunks
+	r.DeleteData("_ops", "free_memory", now+1000, now-60*1000)
+	if len(ts.chunks) != 0 {
+		t.Errorf("expected no allocated chunks, found %d", len(ts.chunks))
+	}
+}
+
+func TestGorillaEncoding(t *testing.T) {
+	base := time.Now().UTC().Unix() * 1000
+	points := make([]TimeValuePair, 0)
+
+	// regular steps, jitter, long gaps, repeated and special values
+	steps := []int64{1000, 1000, 1000, 1003, 997, 1250, 800, 3000, 1000, 86400 * 1000, 1000, 1, 5000}
+	values := []float64{42, 42, 42.5, -1, 0, 1e100, math.Inf(1), math.NaN(), 3.14, 3.15, 1e-300, 42, 42}
+
+	t0 := base
+	for i := range steps {
+		t0 += steps[i]
+		points = append(points, TimeValuePair{timeStamp: t0, value: values[i], count: 1 + int64(i%3)*int64(i)})
+	}
+	// counts of 0 must not shift the rest of the chunk
+	points[3].count = 0
+	points[4].count = 0
+
+	decoded, err := decodePoints(encodePoints(points))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(points) {
+		t.Fatalf("expected %d points, got %d", len(points), len(decoded))
+	}
+	for i := range points {
+		if decoded[i].timeStamp != points[i].timeStamp || decoded[i].count != points[i].count ||
+			math.Float64bits(decoded[i].value) != math.Float64bits(points[i].value) {
+			t.Errorf("point %d: expected %+v, got %+v", i, points[i], decoded[i])
+		}
+	}
+
+	// a truncated chunk must not decode
+	buf := encodePoints(points)
+	if _, err = decodePoints(buf[:len(buf)-4]); err == nil {
+		t.Error("no error while decoding a truncated chunk")
+	}
+}
+
+func TestSealedChunks(t *testing.T) {
+	r := newTestStorage()
+	now := time.Now().UTC().Unix() * 1000
+	now -= now % (100 * 1000)
+	start := now - 1000*1000
+
+	// 1000 points span 8 chunks, all but the head chunk are sealed
+	for i := int64(0); i < 1000; i++ {
+		r.PostRawData("_ops", "free_memory", start+i*1000, float64(i%10))
+	}
+
+	ts := r.getTimeSeries("_ops", "free_memory")
+	sealed := 0
+	for _, c := range ts.chunks {
+		if c.sealed() {
+			sealed++
+		}
+	}
+	if sealed < len(ts.chunks)-1 || sealed == 0 {
+		t.Errorf("expected all chunks but the head to be sealed, %d of %d sealed", sealed, len(ts.chunks))
+	}
+
+	res, _ := r.GetRawData("_ops", "free_memory", now, start, 2000, "ASC")
+	if len(res) != 1000 {
+		t.Fatalf("expected 1000 data points, got %d", len(res))
+	}
+	for i, d := range res {
+		if d.Timestamp != start+int64(i)*1000 || d.Value != float64(i%10) {
+			t.Fatalf("unexpected data point %d: %+v", i, d)
+		}
+	}
+
+	stats, _ := r.GetStatData("_ops", "free_memory", now, start, 100, "ASC", 100, nil)
+	if len(stats) != 10 || stats[0].Samples != 100 || stats[0].Avg != 4.5 {
+		t.Errorf("unexpected stat data: %+v", stats)
+	}
+
+	// late writes and deletes into sealed chunks
+	r.DeleteData("_ops", "free_memory", start+11*1000, start+10*1000)
+	r.PostRawData("_ops", "free_memory", start+10*1000+500, 99)
+	res, _ = r.GetRawData("_ops", "free_memory", start+11*1000, start+10*1000, 10, "ASC")
+	if len(res) != 1 || res[0].Value != 99 {
+		t.Errorf("unexpected data points after late write: %+v", res)
+	}
+
+	// maintenance reseals the chunk
+	if n := ts.sealChunks(); n != 1 {
+		t.Errorf("expected one resealed chunk, got %d", n)
+	}
+
+	s := r.Stats()
+	if s["points"] != 1000 || s["compressionRatio"] <= 1 || s["bytesPerPoint"] >= pointSize {
+		t.Errorf("unexpected storage stats: %+v", s)
+	}
+}
+
+func TestRollupTiers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mohawk-memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	options := url.Values{"tiers": {"1s:10mn,1mn:1d,10mn:1d"}, "snapshot-dir": {dir}}
+	now := time.Now().UTC().Unix() * 1000
+	now -= now % (60 * 60 * 1000)
+	start := now - 2*60*60*1000
+
+	// one point every 10s for 2h, raw data holds only the last 10mn
+	r := &Storage{}
+	r.Open(options)
+	for i := int64(0); i < 720; i++ {
+		r.PostRawData("_ops", "free_memory", start+i*10*1000, float64(i%6))
+	}
+
+	checkStats := func(r *Storage, bucketDuration int64, buckets int, samples int64) {
+		res, err := r.GetStatData("_ops", "free_memory", now, start, 1000, "ASC", bucketDuration, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != buckets {
+			t.Fatalf("bucket duration %d: expected %d buckets, got %d", bucketDuration, buckets, len(res))
+		}
+		for _, s := range res {
+			if s.Samples != samples || s.Min != 0 || s.Max != 5 || s.Avg != 2.5 {
+				t.Errorf("bucket duration %d: unexpected bucket %+v", bucketDuration, s)
+			}
+		}
+	}
+
+	// 10mn and 1h buckets read from the 10mn tier, 1mn buckets from the 1mn tier
+	checkStats(r, 600, 12, 60)
+	checkStats(r, 3600, 2, 360)
+	checkStats(r, 60, 120, 6)
+
+	// 30s buckets read from the raw data
+	res, _ := r.GetStatData("_ops", "free_memory", now, start, 1000, "ASC", 30, nil)
+	if len(res) != 20 {
+		t.Errorf("expected 20 raw buckets, got %d", len(res))
+	}
+
+	// rollups should survive a snapshot
+	if err = r.saveSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	restored := &Storage{}
+	restored.Open(options)
+	checkStats(restored, 600, 12, 60)
+	checkStats(restored, 60, 120, 6)
+
+	// deleting the first hour should delete its rollup buckets
+	r.DeleteData("_ops", "free_memory", start+60*60*1000, start)
+	checkStats(r, 600, 6, 60)
+}
+
+func TestWritePolicy(t *testing.T) {
+	r := &Storage{}
+	r.Open(url.Values{"tiers": {"1mn:1h,10mn:1d"}, "policy": {"last"}})
+
+	now := time.Now().UTC().Unix() * 1000
+	now -= now % (600 * 1000)
+
+	expected := map[string]float64{
+		"":        3, // the storage policy
+		"first":   1,
+		"last":    3,
+		"min":     1,
+		"max":     3,
+		"sum":     6,
+		"average": 2,
+	}
+
+	for policy, value := range expected {
+		id := "free_memory_" + policy
+		if policy != "" {
+			r.PutTags("_ops", id, map[string]string{policyTag: policy})
+		}
+
+		// three samples in one granularity window
+		for i := int64(0); i < 3; i++ {
+			r.PostRawData("_ops", id, now+i*10*1000, float64(i+1))
+		}
+
+		res, _ := r.GetRawData("_ops", id, now+60*1000, now, 10, "ASC")
+		if len(res) != 1 || res[0].Value != value {
+			t.Errorf("policy %s: expected value %f, got %+v", policy, value, res)
+		}
+
+		// raw and rollup stats should count all samples
+		for _, bucketDuration := range []int64{30, 600} {
+			stats, _ := r.GetStatData("_ops", id, now+600*1000, now, 10, "ASC", bucketDuration, nil)
+			if len(stats) != 1 || stats[0].Samples != 3 || stats[0].Max != value {
+				t.Errorf("policy %s: unexpected stats for bucket duration %d: %+v", policy, bucketDuration, stats)
+			}
+		}
+	}
+
+	// a point from an older window in the same slot is dropped
+	r.PostRawData("_ops", "free_memory_first", now-60*60*1000, 42)
+	res, _ := r.GetRawData("_ops", "free_memory_first", now+60*1000, now-60*60*1000, 10, "ASC")
+	if len(res) != 1 || res[0].Value != 1 {
+		t.Errorf("unexpected data after writing an old point: %+v", res)
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	for _, options := range []url.Values{
+		{"granularity": {"30x"}},
+		{"retention": {"1s"}},
+		{"wal-sync": {"sometimes"}},
+		{"policy": {"median"}},
+		{"tiers": {"1s:1h,1mn"}},
+		{"tiers": {"1mn:1h,30s:1d"}},
+		{"tiers": {"1mn:1h,90s:1d"}},
+	} {
+		r := &Storage{}
+		if err := r.Open(options); err == nil {
+			t.Errorf("%v: expected an error", options)
+		}
+	}
+}
+
+func TestFreeExpiredRollups(t *testing.T) {
+	r := &Storage{}
+	r.Open(url.Values{"tiers": {"1s:1h,1mn:1d"}})
+
+	// the last posted point is two days old, buckets inside the tier
+	// retention counted from it are kept
+	start := (time.Now().UTC().Unix() - 2*24*60*60) * 1000
+	for i := int64(0); i < 10; i++ {
+		r.PostRawData("_ops", "free_memory", start+i*60*1000, float64(i))
+	}
+
+	ts := r.getTimeSeries("_ops", "free_memory")
+	ts.mutex.Lock()
+	freed := r.freeExpiredRollups(ts)
+	ts.mutex.Unlock()
+	if freed != 0 {
+		t.Errorf("expected no expired rollup buckets, %d freed", freed)
+	}
+}
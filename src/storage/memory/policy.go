@@ -0,0 +1,102 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package memory interface for memory metric data storage
+package memory
+
+import (
+	"fmt"
+)
+
+// write conflict policies, how a point is merged into a slot that already
+// holds a point of the same granularity window
+const (
+	policyFirst = iota
+	policyLast
+	policyMin
+	policyMax
+	policySum
+	policyAverage
+)
+
+// policyNames the names of the write conflict policies
+var policyNames = []string{"first", "last", "min", "max", "sum", "average"}
+
+// policyTag a time series tag that overrides the storage write conflict policy
+const policyTag = "__policy__"
+
+// parsePolicy parse a write conflict policy name, empty string is the default policy
+func parsePolicy(s string) (int, error) {
+	if s == "" {
+		return policyFirst, nil
+	}
+
+	for i, name := range policyNames {
+		if s == name {
+			return i, nil
+		}
+	}
+
+	return 0, fmt.Errorf("memory: Unknown write conflict policy %s", s)
+}
+
+// seriesPolicy return the write conflict policy of a time series,
+// caller must hold the time series lock
+func (r *Storage) seriesPolicy(ts *TimeSeries) int {
+	if name, ok := ts.tags[policyTag]; ok {
+		if policy, err := parsePolicy(name); err == nil {
+			return policy
+		}
+	}
+
+	return r.policy
+}
+
+// mergePoint merge a new point into a slot holding a point of the same
+// granularity window, the merged slot counts all samples merged into it
+func mergePoint(policy int, old TimeValuePair, t int64, v float64) TimeValuePair {
+	d := old
+	d.count = old.count + 1
+
+	switch policy {
+	case policyLast:
+		if t >= old.timeStamp {
+			d.timeStamp = t
+			d.value = v
+		}
+	case policyMin:
+		if v < old.value {
+			d.timeStamp = t
+			d.value = v
+		}
+	case policyMax:
+		if v > old.value {
+			d.timeStamp = t
+			d.value = v
+		}
+	case policySum:
+		d.value = old.value + v
+		if t > old.timeStamp {
+			d.timeStamp = t
+		}
+	case policyAverage:
+		d.value = old.value + (v-old.value)/float64(d.count)
+		if t > old.timeStamp {
+			d.timeStamp = t
+		}
+	}
+
+	return d
+}
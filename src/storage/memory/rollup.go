@@ -0,0 +1,386 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package memory interface for memory metric data storage
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync/atomic"
+
+	"github.com/MohawkTSDB/mohawk/src/storage"
+)
+
+// errBadTiers a new error with bad tiers option message
+var errBadTiers = errors.New("memory: Bad tiers, expected a granularity:retention list")
+
+// tier one data resolution, the first tier is the raw data ring,
+// other tiers are rollups of aggregated buckets
+type tier struct {
+	granularitySec int64
+	retentionSec   int64
+}
+
+// aggregate the summary of the points in one rollup bucket, count is the
+// number of points and samples the number of samples merged into them
+type aggregate struct {
+	count     int64
+	samples   int64
+	min       float64
+	max       float64
+	sum       float64
+	sumSq     float64
+	firstTime int64
+	first     float64
+	lastTime  int64
+	last      float64
+}
+
+// parseTiers parse a comma separated granularity:retention list,
+// e.g. "30s:1d,5mn:30d,1h:1y"
+func parseTiers(s string) ([]tier, error) {
+	tiers := make([]tier, 0)
+
+	for _, t := range strings.Split(s, ",") {
+		parts := strings.Split(strings.TrimSpace(t), ":")
+		if len(parts) != 2 {
+			return nil, errBadTiers
+		}
+
+		granularity, errGranularity := storage.ParseDuration(parts[0])
+		retention, errRetention := storage.ParseDuration(parts[1])
+		if errGranularity != nil || errRetention != nil || granularity < 1 || retention < granularity {
+			return nil, errBadTiers
+		}
+
+		// rollup buckets are made of whole raw slots
+		if len(tiers) > 0 && (granularity <= tiers[0].granularitySec || granularity%tiers[0].granularitySec != 0) {
+			return nil, fmt.Errorf("memory: Bad tier %s, a rollup granularity must be a multiple of the raw granularity", strings.TrimSpace(t))
+		}
+
+		tiers = append(tiers, tier{granularitySec: granularity, retentionSec: retention})
+	}
+
+	return tiers, nil
+}
+
+// add add one point to the aggregate
+func (a *aggregate) add(d TimeValuePair) {
+	a.merge(&aggregate{
+		count:     1,
+		samples:   d.count,
+		min:       d.value,
+		max:       d.value,
+		sum:       d.value,
+		sumSq:     d.value * d.value,
+		firstTime: d.timeStamp,
+		first:     d.value,
+		lastTime:  d.timeStamp,
+		last:      d.value,
+	})
+}
+
+// replace replace one point of the aggregate with a point of the same
+// granularity window, returns false if the aggregate can not be updated
+// and must be rebuilt, e.g. when the old point was the bucket min
+func (a *aggregate) replace(old TimeValuePair, d TimeValuePair) bool {
+	if (old.value == a.min && d.value > old.value) || (old.value == a.max && d.value < old.value) {
+		return false
+	}
+	if old.timeStamp != d.timeStamp && (old.timeStamp == a.firstTime || old.timeStamp == a.lastTime) {
+		return false
+	}
+
+	a.samples += d.count - old.count
+	a.min = math.Min(a.min, d.value)
+	a.max = math.Max(a.max, d.value)
+	a.sum += d.value - old.value
+	a.sumSq += d.value*d.value - old.value*old.value
+
+	if old.timeStamp == a.firstTime {
+		a.first = d.value
+	}
+	if old.timeStamp == a.lastTime {
+		a.last = d.value
+	}
+
+	return true
+}
+
+// merge add the points of another aggregate to the aggregate
+func (a *aggregate) merge(b *aggregate) {
+	if a.count == 0 {
+		*a = *b
+		return
+	}
+
+	a.count += b.count
+	a.samples += b.samples
+	a.min = math.Min(a.min, b.min)
+	a.max = math.Max(a.max, b.max)
+	a.sum += b.sum
+	a.sumSq += b.sumSq
+
+	if b.firstTime < a.firstTime {
+		a.firstTime = b.firstTime
+		a.first = b.first
+	}
+	if b.lastTime > a.lastTime {
+		a.lastTime = b.lastTime
+		a.last = b.last
+	}
+}
+
+// statItem return the aggregate as a stat item, an aggregate does not keep
+// the bucket values, so the median and percentiles are not set
+func (a *aggregate) statItem(start int64, end int64) storage.StatItem {
+	avg := a.sum / float64(a.count)
+
+	return storage.StatItem{
+		Start:   start,
+		End:     end,
+		Empty:   false,
+		Samples: a.samples,
+		First:   a.first,
+		Last:    a.last,
+		Min:     a.min,
+		Max:     a.max,
+		Avg:     avg,
+		Std:     math.Sqrt(math.Max(a.sumSq/float64(a.count)-avg*avg, 0)),
+		Sum:     a.sum,
+	}
+}
+
+// rollupTiers return the rollup tiers, all tiers except the raw data tier
+func (r *Storage) rollupTiers() []tier {
+	if len(r.tiers) == 0 {
+		return nil
+	}
+
+	return r.tiers[1:]
+}
+
+// rawStart return the oldest timestamp held in the raw data tier
+func (r *Storage) rawStart() int64 {
+	return (atomic.LoadInt64(&r.timeLastSec) - r.timeRetentionSec) * 1000
+}
+
+// statTier return the index of the coarsest rollup tier with a granularity
+// that divides bucketDuration, or -1 if stats should be read from the raw data
+func (r *Storage) statTier(bucketDuration int64) int {
+	i := -1
+	tiers := r.rollupTiers()
+
+	for j, t := range tiers {
+		if bucketDuration%t.granularitySec == 0 && (i == -1 || t.granularitySec > tiers[i].granularitySec) {
+			i = j
+		}
+	}
+
+	return i
+}
+
+// rollupPoint add one point to all rollup tiers, caller must hold the time series lock
+func (r *Storage) rollupPoint(ts *TimeSeries, d TimeValuePair) {
+	for i := range r.rollupTiers() {
+		r.rollupTierPoint(ts, i, d)
+	}
+}
+
+// rollupReplace replace one point in all rollup tiers with a merged point of
+// the same granularity window, caller must hold the time series lock and call it
+// after the point was replaced in the raw data
+func (r *Storage) rollupReplace(ts *TimeSeries, old TimeValuePair, d TimeValuePair) {
+	for i, tr := range r.rollupTiers() {
+		if ts.rollups == nil || ts.rollups[i] == nil {
+			continue
+		}
+
+		// a tier granularity that is not a multiple of the raw granularity
+		// may split a window between two buckets, rebuild both
+		key := d.timeStamp / 1000 / tr.granularitySec
+		oldKey := old.timeStamp / 1000 / tr.granularitySec
+		if oldKey != key {
+			delete(ts.rollups[i], oldKey)
+			r.rebuildRollup(ts, i, oldKey)
+			delete(ts.rollups[i], key)
+			r.rebuildRollup(ts, i, key)
+			continue
+		}
+
+		if a, ok := ts.rollups[i][key]; ok && !a.replace(old, d) {
+			delete(ts.rollups[i], key)
+			r.rebuildRollup(ts, i, key)
+		}
+	}
+}
+
+// rollupTierPoint add one point to one rollup tier, caller must hold the time series lock
+func (r *Storage) rollupTierPoint(ts *TimeSeries, i int, d TimeValuePair) {
+	if ts.rollups == nil {
+		ts.rollups = make([]map[int64]*aggregate, len(r.rollupTiers()))
+	}
+	if ts.rollups[i] == nil {
+		ts.rollups[i] = make(map[int64]*aggregate)
+	}
+
+	key := d.timeStamp / 1000 / r.rollupTiers()[i].granularitySec
+	a, ok := ts.rollups[i][key]
+	if !ok {
+		a = &aggregate{}
+		ts.rollups[i][key] = a
+	}
+	a.add(d)
+}
+
+// deleteRollups remove a time range from all rollup tiers, caller must hold
+// the time series lock and call it after the range was removed from the raw data
+//
+// buckets inside the range are deleted, buckets partially inside the range are
+// rebuilt from the raw data still in the ring, so data older then the raw
+// retention in such buckets is lost.
+func (r *Storage) deleteRollups(ts *TimeSeries, end int64, start int64) {
+	for i, tr := range r.rollupTiers() {
+		if ts.rollups == nil || ts.rollups[i] == nil {
+			continue
+		}
+
+		stepMili := tr.granularitySec * 1000
+		for key := range ts.rollups[i] {
+			bucketStart := key * stepMili
+			bucketEnd := bucketStart + stepMili
+
+			if bucketEnd <= start || bucketStart >= end {
+				continue
+			}
+
+			delete(ts.rollups[i], key)
+			if bucketStart < start || bucketEnd > end {
+				r.rebuildRollup(ts, i, key)
+			}
+		}
+	}
+}
+
+// rebuildRollup rebuild one rollup bucket from the raw data,
+// caller must hold the time series lock
+func (r *Storage) rebuildRollup(ts *TimeSeries, i int, key int64) {
+	a := &aggregate{}
+	stepMili := r.rollupTiers()[i].granularitySec * 1000
+	bucketStart := key * stepMili
+	bucketEnd := bucketStart + stepMili
+
+	pStart := r.getPosForTimestamp(bucketStart)
+	pEnd := r.getPosForTimestamp(bucketEnd - 1)
+	if pEnd-pStart >= r.arraySize {
+		pStart = pEnd - r.arraySize + 1
+	}
+
+	slots := r.newSlotReader(ts)
+	for p := pStart; p <= pEnd; p++ {
+		if d := slots.get(p); d.timeStamp >= bucketStart && d.timeStamp < bucketEnd {
+			a.add(d)
+		}
+	}
+
+	if a.count > 0 {
+		ts.rollups[i][key] = a
+	}
+}
+
+// getRollupStatData return stat buckets read from one rollup tier,
+// caller must hold the time series lock
+//
+// a rollup bucket is counted in the stat bucket that holds its start time,
+// stat buckets are aligned to multiples of the bucket duration.
+func (r *Storage) getRollupStatData(ts *TimeSeries, i int, end int64, start int64, limit int64, order string, bucketDuration int64) []storage.StatItem {
+	res := make([]storage.StatItem, 0)
+	if ts.rollups == nil || ts.rollups[i] == nil {
+		return res
+	}
+
+	buckets := ts.rollups[i]
+	stepMili := r.rollupTiers()[i].granularitySec * 1000
+	bucketSizeMili := bucketDuration * 1000
+
+	// the tier does not hold buckets older then its retention
+	validStart := (atomic.LoadInt64(&r.timeLastSec) - r.rollupTiers()[i].retentionSec) * 1000
+	if start < validStart {
+		start += (validStart - start) / bucketSizeMili * bucketSizeMili
+	}
+
+	count := int64(0)
+	for bucketStart := start - start%bucketSizeMili; count < limit && bucketStart < end; bucketStart += bucketSizeMili {
+		var a aggregate
+		bucketEnd := bucketStart + bucketSizeMili
+
+		// first rollup bucket starting inside this stat bucket and the
+		// requested range
+		from := bucketStart
+		if from < start {
+			from = start
+		}
+		key := from / stepMili
+		if key*stepMili < from {
+			key++
+		}
+		for ; key*stepMili < bucketEnd && key*stepMili < end; key++ {
+			if b, ok := buckets[key]; ok {
+				a.merge(b)
+			}
+		}
+
+		if a.count > 0 {
+			count++
+			res = append(res, a.statItem(bucketStart, bucketEnd))
+		}
+	}
+
+	// order
+	if order == "DESC" {
+		for i := 0; i < len(res)/2; i++ {
+			j := len(res) - i - 1
+			res[i], res[j] = res[j], res[i]
+		}
+	}
+
+	return res
+}
+
+// freeExpiredRollups delete rollup buckets older then their tier retention,
+// like reads, retention is counted back from the last posted timestamp,
+// caller must hold the time series lock
+func (r *Storage) freeExpiredRollups(ts *TimeSeries) int {
+	freed := 0
+	if ts.rollups == nil {
+		return freed
+	}
+
+	lastSec := atomic.LoadInt64(&r.timeLastSec)
+	for i, tr := range r.rollupTiers() {
+		validKey := (lastSec - tr.retentionSec) / tr.granularitySec
+		for key := range ts.rollups[i] {
+			if key < validKey {
+				delete(ts.rollups[i], key)
+				freed++
+			}
+		}
+	}
+
+	return freed
+}
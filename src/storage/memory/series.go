@@ -0,0 +1,282 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package memory interface for memory metric data storage
+package memory
+
+import (
+	"log"
+	"sort"
+)
+
+// chunkSize number of ring slots in one data chunk
+const chunkSize = 128
+
+// pointSize bytes used by one uncompressed slot, a timestamp and a value
+const pointSize = 16
+
+// chunk a block of ring slots
+//
+// a time series ring is split into chunks, a chunk is allocated when the
+// first point is written into it and freed when its last point is deleted
+// or expires, so sparse series only use memory for the slots they need.
+//
+// chunks that are no longer written to are sealed, their slots are
+// compressed into packed (see gorilla.go) and the slots array is freed,
+// a write or delete into a sealed chunk unpacks it again.
+type chunk struct {
+	count        int
+	slots        *[chunkSize]TimeValuePair
+	packed       []byte
+	maxTimeStamp int64
+}
+
+// newTimeSeries create an empty time series, no chunks are allocated
+func newTimeSeries() *TimeSeries {
+	return &TimeSeries{
+		tags:   make(map[string]string),
+		chunks: make(map[int64]*chunk),
+		head:   -1,
+	}
+}
+
+// sealed return true if the chunk slots are compressed
+func (c *chunk) sealed() bool {
+	return c.slots == nil
+}
+
+// points return the valid points of a chunk sorted by time
+func (c *chunk) points() []TimeValuePair {
+	if c.sealed() {
+		points, err := decodePoints(c.packed)
+		if err != nil {
+			log.Printf("memory: %s\n", err)
+		}
+		return points
+	}
+
+	points := make([]TimeValuePair, 0, c.count)
+	for _, d := range c.slots {
+		if d.timeStamp != 0 {
+			points = append(points, d)
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].timeStamp < points[j].timeStamp })
+
+	return points
+}
+
+// seal compress the chunk slots and free the slots array
+func (c *chunk) seal() {
+	if c.sealed() {
+		return
+	}
+
+	points := c.points()
+	c.packed = encodePoints(points)
+	c.maxTimeStamp = points[len(points)-1].timeStamp
+	c.slots = nil
+}
+
+// unpackSlots decompress a sealed chunk into a new slots array
+func (r *Storage) unpackSlots(c *chunk) *[chunkSize]TimeValuePair {
+	slots := &[chunkSize]TimeValuePair{}
+
+	for _, d := range c.points() {
+		slots[(r.getPosForTimestamp(d.timeStamp)%r.arraySize)%chunkSize] = d
+	}
+
+	return slots
+}
+
+// unseal decompress a sealed chunk so it can be modified
+func (r *Storage) unseal(c *chunk) {
+	if !c.sealed() {
+		return
+	}
+
+	c.slots = r.unpackSlots(c)
+	c.packed = nil
+	c.maxTimeStamp = 0
+}
+
+// getSlot return the slot of a ring position, a sealed chunk is unsealed,
+// caller must hold the time series write lock
+func (r *Storage) getSlot(ts *TimeSeries, p int64) TimeValuePair {
+	i := p % r.arraySize
+
+	if c, ok := ts.chunks[i/chunkSize]; ok {
+		r.unseal(c)
+		return c.slots[i%chunkSize]
+	}
+
+	return TimeValuePair{}
+}
+
+// setSlot set the slot of a ring position, caller must hold the time series write lock
+//
+// setting a slot in a missing chunk allocates the chunk, clearing the last
+// valid slot of a chunk frees the chunk.
+func (r *Storage) setSlot(ts *TimeSeries, p int64, d TimeValuePair) {
+	i := p % r.arraySize
+	key := i / chunkSize
+
+	c, ok := ts.chunks[key]
+	if !ok {
+		// nothing to clear
+		if d.timeStamp == 0 {
+			return
+		}
+
+		c = &chunk{slots: &[chunkSize]TimeValuePair{}}
+		ts.chunks[key] = c
+	}
+	r.unseal(c)
+
+	// keep count of valid slots
+	old := c.slots[i%chunkSize]
+	if old.timeStamp == 0 && d.timeStamp != 0 {
+		c.count++
+	} else if old.timeStamp != 0 && d.timeStamp == 0 {
+		c.count--
+	}
+	c.slots[i%chunkSize] = d
+
+	if c.count == 0 {
+		delete(ts.chunks, key)
+	}
+}
+
+// moveHead set the chunk of the newest point, the previous head chunk
+// will not be written to again and is sealed,
+// caller must hold the time series write lock
+func (r *Storage) moveHead(ts *TimeSeries, p int64) {
+	key := (p % r.arraySize) / chunkSize
+	if key == ts.head {
+		return
+	}
+
+	if c, ok := ts.chunks[ts.head]; ok {
+		c.seal()
+	}
+	ts.head = key
+}
+
+// sealChunks seal all chunks except the head chunk, returns the number of
+// chunks sealed, caller must hold the time series write lock
+func (ts *TimeSeries) sealChunks() int {
+	sealed := 0
+
+	for key, c := range ts.chunks {
+		if key != ts.head && !c.sealed() {
+			c.seal()
+			sealed++
+		}
+	}
+
+	return sealed
+}
+
+// slotReader read ring slots of one time series without modifying it,
+// each sealed chunk is decompressed once per reader,
+// caller must hold the time series read lock while using the reader
+type slotReader struct {
+	r     *Storage
+	ts    *TimeSeries
+	key   int64
+	slots *[chunkSize]TimeValuePair
+}
+
+// newSlotReader create a slot reader for a time series
+func (r *Storage) newSlotReader(ts *TimeSeries) *slotReader {
+	return &slotReader{r: r, ts: ts, key: -1}
+}
+
+// get return the slot of a ring position
+func (sr *slotReader) get(p int64) TimeValuePair {
+	i := p % sr.r.arraySize
+
+	if key := i / chunkSize; key != sr.key {
+		sr.key = key
+		sr.slots = nil
+
+		if c, ok := sr.ts.chunks[key]; ok {
+			if c.sealed() {
+				sr.slots = sr.r.unpackSlots(c)
+			} else {
+				sr.slots = c.slots
+			}
+		}
+	}
+
+	if sr.slots == nil {
+		return TimeValuePair{}
+	}
+
+	return sr.slots[i%chunkSize]
+}
+
+// eachSlot call f for every valid slot, caller must hold the time series lock
+func (ts *TimeSeries) eachSlot(f func(d TimeValuePair)) {
+	for _, c := range ts.chunks {
+		for _, d := range c.points() {
+			f(d)
+		}
+	}
+}
+
+// freeExpiredChunks free chunks with no points newer then validTimeStamp,
+// caller must hold the time series write lock
+func (ts *TimeSeries) freeExpiredChunks(validTimeStamp int64) int {
+	freed := 0
+
+	for key, c := range ts.chunks {
+		expired := true
+		if c.sealed() {
+			expired = c.maxTimeStamp <= validTimeStamp
+		} else {
+			for _, d := range c.slots {
+				if d.timeStamp > validTimeStamp {
+					expired = false
+					break
+				}
+			}
+		}
+
+		if expired {
+			delete(ts.chunks, key)
+			freed++
+		}
+	}
+
+	return freed
+}
+
+// chunkStats memory usage of the chunks of one time series,
+// caller must hold the time series lock
+func (ts *TimeSeries) chunkStats(s *memoryStats) {
+	for _, c := range ts.chunks {
+		s.chunks++
+		s.points += c.count
+
+		if c.sealed() {
+			s.sealedChunks++
+			s.sealedPoints += c.count
+			s.sealedBytes += len(c.packed)
+		} else {
+			s.bytes += chunkSize * pointSize
+		}
+	}
+}
@@ -0,0 +1,358 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package memory interface for memory metric data storage
+package memory
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/MohawkTSDB/mohawk/src/storage"
+)
+
+// snapshotFileName the name of the snapshot file inside the snapshot directory
+const snapshotFileName = "memory.snapshot"
+
+// snapshotVersion the version of the snapshot file format,
+// version 2 adds rollups, version 3 adds samples counts,
+// older files are still readable
+const snapshotVersion = 3
+
+// snapshotAggregate one rollup bucket as written to the snapshot file
+type snapshotAggregate struct {
+	Key       int64
+	Count     int64
+	Samples   int64
+	Min       float64
+	Max       float64
+	Sum       float64
+	SumSq     float64
+	FirstTime int64
+	First     float64
+	LastTime  int64
+	Last      float64
+}
+
+// snapshotRollup the buckets of one rollup tier as written to the snapshot file
+type snapshotRollup struct {
+	GranularitySec int64
+	Buckets        []snapshotAggregate
+}
+
+// snapshotSeries one time series as written to the snapshot file,
+// Counts holds the samples count of each data point
+type snapshotSeries struct {
+	Tags      map[string]string
+	Data      []storage.DataItem
+	Counts    []int64
+	LastValue storage.DataItem
+	Rollups   []snapshotRollup
+}
+
+// snapshot the content of the snapshot file,
+// WALSeq is the first write ahead log segment not included in the snapshot
+type snapshot struct {
+	Version int
+	WALSeq  int64
+	Tenants map[string]map[string]snapshotSeries
+}
+
+// snapshots save a snapshot of the storage periodically
+func (r *Storage) snapshots() {
+	defer r.workers.Done()
+
+	c := time.NewTicker(time.Duration(r.snapshotIntervalSec) * time.Second)
+	defer c.Stop()
+
+	// once a tick save a snapshot, Close saves the last one
+	for {
+		select {
+		case <-c.C:
+			if err := r.saveSnapshot(); err != nil {
+				log.Printf("snapshot: %s\n", err)
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// saveSnapshot write all tenants, time series and tags to the snapshot file
+//
+// the snapshot is written to a temporary file and renamed, so a crash while
+// saving leaves the previous snapshot intact.
+func (r *Storage) saveSnapshot() error {
+	var walSeq int64
+	var err error
+
+	// start a new write ahead log segment and copy the storage with no
+	// commit in between, the copy includes exactly the records of older
+	// segments, so no record is applied twice on replay
+	r.commitMutex.Lock()
+	if r.wal != nil {
+		if walSeq, err = r.wal.Rotate(); err != nil {
+			r.commitMutex.Unlock()
+			return err
+		}
+	}
+	s := r.takeSnapshot()
+	r.commitMutex.Unlock()
+
+	s.WALSeq = walSeq
+	filename := filepath.Join(r.snapshotDir, snapshotFileName)
+	tmpFilename := filename + ".tmp"
+
+	f, err := os.Create(tmpFilename)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	if err = gob.NewEncoder(w).Encode(s); err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+
+	if err = os.Rename(tmpFilename, filename); err != nil {
+		return err
+	}
+
+	log.Printf("snapshot: saved %d tenants to %s\n", len(s.Tenants), filename)
+
+	// segments older than the snapshot are obsolete
+	if r.wal != nil {
+		return r.wal.RemoveBefore(walSeq)
+	}
+
+	return nil
+}
+
+// loadSnapshot restore tenants, time series and tags from the snapshot file,
+// returns the first write ahead log segment not included in the snapshot
+func (r *Storage) loadSnapshot() (int64, error) {
+	var s snapshot
+
+	filename := filepath.Join(r.snapshotDir, snapshotFileName)
+
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		// no snapshot yet, nothing to restore
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if err = gob.NewDecoder(bufio.NewReader(f)).Decode(&s); err != nil {
+		return 0, err
+	}
+	if s.Version < 1 || s.Version > snapshotVersion {
+		return 0, fmt.Errorf("unknown snapshot version %d", s.Version)
+	}
+
+	r.restoreSnapshot(&s)
+
+	log.Printf("snapshot: loaded %d tenants from %s\n", len(s.Tenants), filename)
+	return s.WALSeq, nil
+}
+
+// takeSnapshot copy the storage content into a snapshot struct
+func (r *Storage) takeSnapshot() *snapshot {
+	s := &snapshot{
+		Version: snapshotVersion,
+		Tenants: make(map[string]map[string]snapshotSeries),
+	}
+
+	// take a copy of the tenant list, so writers are not blocked
+	r.mutex.RLock()
+	tenants := make(map[string]*Tenant, len(r.tenant))
+	for name, t := range r.tenant {
+		tenants[name] = t
+	}
+	r.mutex.RUnlock()
+
+	for name, t := range tenants {
+		series := make(map[string]snapshotSeries)
+
+		t.mutex.RLock()
+		for id, ts := range t.ts {
+			ts.mutex.RLock()
+			series[id] = r.takeSeriesSnapshot(ts)
+			ts.mutex.RUnlock()
+		}
+		t.mutex.RUnlock()
+
+		s.Tenants[name] = series
+	}
+
+	return s
+}
+
+// takeSeriesSnapshot copy one time series, caller must hold the time series lock
+func (r *Storage) takeSeriesSnapshot(ts *TimeSeries) snapshotSeries {
+	tags := make(map[string]string, len(ts.tags))
+	for k, v := range ts.tags {
+		tags[k] = v
+	}
+
+	points := make([]TimeValuePair, 0)
+	ts.eachSlot(func(d TimeValuePair) {
+		points = append(points, d)
+	})
+
+	// keep data sorted by time, the ring is not
+	sort.Slice(points, func(i, j int) bool { return points[i].timeStamp < points[j].timeStamp })
+
+	data := make([]storage.DataItem, 0, len(points))
+	counts := make([]int64, 0, len(points))
+	for _, d := range points {
+		data = append(data, storage.DataItem{Timestamp: d.timeStamp, Value: d.value})
+		counts = append(counts, d.count)
+	}
+
+	rollups := make([]snapshotRollup, 0, len(ts.rollups))
+	for i, buckets := range ts.rollups {
+		rollup := snapshotRollup{
+			GranularitySec: r.rollupTiers()[i].granularitySec,
+			Buckets:        make([]snapshotAggregate, 0, len(buckets)),
+		}
+		for key, a := range buckets {
+			rollup.Buckets = append(rollup.Buckets, snapshotAggregate{
+				Key:       key,
+				Count:     a.count,
+				Samples:   a.samples,
+				Min:       a.min,
+				Max:       a.max,
+				Sum:       a.sum,
+				SumSq:     a.sumSq,
+				FirstTime: a.firstTime,
+				First:     a.first,
+				LastTime:  a.lastTime,
+				Last:      a.last,
+			})
+		}
+		rollups = append(rollups, rollup)
+	}
+
+	return snapshotSeries{
+		Tags:   tags,
+		Data:   data,
+		Counts: counts,
+		LastValue: storage.DataItem{
+			Timestamp: ts.lastValue.timeStamp,
+			Value:     ts.lastValue.value,
+		},
+		Rollups: rollups,
+	}
+}
+
+// restoreSnapshot copy a snapshot struct into the storage
+//
+// rollup tiers missing from the snapshot, e.g. after adding a tier, are
+// rebuilt from the raw data.
+func (r *Storage) restoreSnapshot(s *snapshot) {
+	for tenant, series := range s.Tenants {
+		for id, ss := range series {
+			ts := r.checkID(tenant, id)
+
+			ts.mutex.Lock()
+			for k, v := range ss.Tags {
+				ts.tags[k] = v
+			}
+			for j, d := range ss.Data {
+				// snapshots older then version 3 have no samples counts
+				count := int64(1)
+				if j < len(ss.Counts) {
+					count = ss.Counts[j]
+				}
+
+				r.updateLast(d.Timestamp)
+				r.setPoint(ts, r.getPosForTimestamp(d.Timestamp), TimeValuePair{timeStamp: d.Timestamp, value: d.Value, count: count})
+			}
+			if ts.lastValue.timeStamp < ss.LastValue.Timestamp {
+				ts.lastValue = TimeValuePair{timeStamp: ss.LastValue.Timestamp, value: ss.LastValue.Value, count: 1}
+			}
+			r.restoreRollups(ts, ss)
+			ts.mutex.Unlock()
+		}
+	}
+}
+
+// restoreRollups copy the rollups of one time series from a snapshot,
+// caller must hold the time series lock
+func (r *Storage) restoreRollups(ts *TimeSeries, ss snapshotSeries) {
+	tiers := r.rollupTiers()
+	if len(tiers) == 0 {
+		return
+	}
+	ts.rollups = make([]map[int64]*aggregate, len(tiers))
+
+	for i, t := range tiers {
+		ts.rollups[i] = make(map[int64]*aggregate)
+
+		found := false
+		for _, rollup := range ss.Rollups {
+			if rollup.GranularitySec != t.granularitySec {
+				continue
+			}
+
+			found = true
+			for _, b := range rollup.Buckets {
+				ts.rollups[i][b.Key] = &aggregate{
+					count:     b.Count,
+					samples:   b.Samples,
+					min:       b.Min,
+					max:       b.Max,
+					sum:       b.Sum,
+					sumSq:     b.SumSq,
+					firstTime: b.FirstTime,
+					first:     b.First,
+					lastTime:  b.LastTime,
+					last:      b.Last,
+				}
+
+				// snapshots older then version 3 have no samples counts
+				if b.Samples == 0 {
+					ts.rollups[i][b.Key].samples = b.Count
+				}
+			}
+			break
+		}
+
+		// rebuild a missing tier from the raw data
+		if !found {
+			ts.eachSlot(func(d TimeValuePair) {
+				r.rollupTierPoint(ts, i, d)
+			})
+		}
+	}
+}
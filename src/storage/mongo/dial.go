@@ -0,0 +1,242 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mongo interface for mongo metric data storage
+package mongo
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+// uriPrefix the prefix of a mongo connection string
+const uriPrefix = "mongodb://"
+
+// first and max wait time between connection retries
+const (
+	retryBackoff    = 500 * time.Millisecond
+	maxRetryBackoff = 30 * time.Second
+)
+
+// errBadCAFile a new error with bad CA file message
+var errBadCAFile = errors.New("mongo: No certificates found in CA file")
+
+// connection the mongo server connection settings
+type connection struct {
+	info          *mgo.DialInfo
+	mode          mgo.Mode
+	tls           bool
+	caFile        string
+	dialTimeout   time.Duration
+	socketTimeout time.Duration
+	retries       int
+}
+
+// parseConnection parse the connection settings, db-url is a comma separated
+// list of servers or a mongo connection string, storage options override
+// the connection string options
+func parseConnection(options url.Values) (connection, error) {
+	var err error
+	c := connection{mode: mgo.Monotonic, dialTimeout: 10 * time.Second, retries: 5}
+
+	dbURL := options.Get("db-url")
+	if dbURL == "" {
+		dbURL = "127.0.0.1"
+	}
+
+	if strings.HasPrefix(dbURL, uriPrefix) {
+		if err = c.parseURI(dbURL); err != nil {
+			return c, err
+		}
+	} else {
+		c.info = &mgo.DialInfo{Addrs: strings.Split(dbURL, ",")}
+	}
+
+	// storage options
+	if v := options.Get("username"); v != "" {
+		c.info.Username = v
+	}
+	if v := options.Get("password"); v != "" {
+		c.info.Password = v
+	}
+	if v := options.Get("auth-db"); v != "" {
+		c.info.Source = v
+	}
+	if v := options.Get("read-preference"); v != "" {
+		if c.mode, err = parseReadPreference(v); err != nil {
+			return c, err
+		}
+	}
+	if v := options.Get("tls"); v != "" {
+		if c.tls, err = strconv.ParseBool(v); err != nil {
+			return c, fmt.Errorf("mongo: Bad tls %s", v)
+		}
+	}
+	if v := options.Get("tls-ca-file"); v != "" {
+		c.caFile = v
+		c.tls = true
+	}
+	if v := options.Get("timeout"); v != "" {
+		if c.dialTimeout, err = time.ParseDuration(v); err != nil || c.dialTimeout <= 0 {
+			return c, fmt.Errorf("mongo: Bad timeout %s", v)
+		}
+	}
+	if v := options.Get("connect-retries"); v != "" {
+		if c.retries, err = strconv.Atoi(v); err != nil || c.retries < 0 {
+			return c, fmt.Errorf("mongo: Bad connect retries %s", v)
+		}
+	}
+	c.info.Timeout = c.dialTimeout
+
+	return c, nil
+}
+
+// parseURI parse a mongo connection string, options not supported by the
+// mgo driver are removed from the string and kept in the connection
+func (c *connection) parseURI(uri string) error {
+	base := uri
+	query := url.Values{}
+
+	if i := strings.Index(uri, "?"); i >= 0 {
+		var err error
+		base = uri[:i]
+		if query, err = url.ParseQuery(uri[i+1:]); err != nil {
+			return fmt.Errorf("mongo: Bad connection string options %s", uri[i+1:])
+		}
+	}
+
+	for k := range query {
+		v := query.Get(k)
+
+		switch k {
+		case "ssl", "tls":
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("mongo: Bad %s %s", k, v)
+			}
+			c.tls = b
+		case "tlsCAFile", "sslCAFile":
+			c.caFile = v
+			c.tls = true
+		case "readPreference":
+			mode, err := parseReadPreference(v)
+			if err != nil {
+				return err
+			}
+			c.mode = mode
+		case "connectTimeoutMS", "socketTimeoutMS":
+			ms, err := strconv.Atoi(v)
+			if err != nil || ms < 0 {
+				return fmt.Errorf("mongo: Bad %s %s", k, v)
+			}
+			if k == "connectTimeoutMS" {
+				c.dialTimeout = time.Duration(ms) * time.Millisecond
+			} else {
+				c.socketTimeout = time.Duration(ms) * time.Millisecond
+			}
+		default:
+			// left for the mgo driver
+			continue
+		}
+		query.Del(k)
+	}
+
+	if len(query) > 0 {
+		base += "?" + query.Encode()
+	}
+
+	info, err := mgo.ParseURL(base)
+	if err != nil {
+		return fmt.Errorf("mongo: %s", err)
+	}
+	c.info = info
+
+	return nil
+}
+
+// parseReadPreference parse a mongo read preference name
+func parseReadPreference(s string) (mgo.Mode, error) {
+	switch s {
+	case "primary":
+		return mgo.Primary, nil
+	case "primaryPreferred":
+		return mgo.PrimaryPreferred, nil
+	case "secondary":
+		return mgo.Secondary, nil
+	case "secondaryPreferred":
+		return mgo.SecondaryPreferred, nil
+	case "nearest":
+		return mgo.Nearest, nil
+	}
+
+	return mgo.Monotonic, fmt.Errorf("mongo: Unknown read preference %s", s)
+}
+
+// dial connect to the mongo servers, failed connections are retried with
+// an exponential back-off
+func (c connection) dial() (*mgo.Session, error) {
+	if c.tls {
+		config := &tls.Config{}
+
+		if c.caFile != "" {
+			pem, err := ioutil.ReadFile(c.caFile)
+			if err != nil {
+				return nil, err
+			}
+			config.RootCAs = x509.NewCertPool()
+			if !config.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, errBadCAFile
+			}
+		}
+
+		dialer := &net.Dialer{Timeout: c.info.Timeout}
+		c.info.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+			return tls.DialWithDialer(dialer, "tcp", addr.String(), config)
+		}
+	}
+
+	backoff := retryBackoff
+	for i := 0; ; i++ {
+		session, err := mgo.DialWithInfo(c.info)
+		if err == nil {
+			session.SetMode(c.mode, true)
+			if c.socketTimeout > 0 {
+				session.SetSocketTimeout(c.socketTimeout)
+			}
+			return session, nil
+		}
+
+		if i >= c.retries {
+			return nil, fmt.Errorf("mongo: Can't connect to %v: %s", c.info.Addrs, err)
+		}
+
+		log.Printf("mongo: connect to %v: %s, retry in %v\n", c.info.Addrs, err, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
@@ -0,0 +1,268 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mongo interface for mongo metric data storage
+package mongo
+
+import (
+	"fmt"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/MohawkTSDB/mohawk/src/storage"
+)
+
+// document layouts of the points of a series, a series collection holds
+// one document per point, or one document per hour holding the hour points
+const (
+	layoutPoint  = "point"
+	layoutBucket = "bucket"
+)
+
+// bucketMili the time span of a bucket document in ms
+const bucketMili = int64(60 * 60 * 1000)
+
+// retentionIndex the name of the TTL index of series collections
+const retentionIndex = "retention"
+
+// indexOptionsConflict the mongo error code of an index that exists with
+// other options
+const indexOptionsConflict = 85
+
+// pointDoc a point document, time is the point time used by the TTL index
+type pointDoc struct {
+	Timestamp int64     `bson:"timestamp"`
+	Value     float64   `bson:"value"`
+	Time      time.Time `bson:"time"`
+}
+
+// parseLayout parse a document layout name, empty string is the point layout
+func parseLayout(s string) (string, error) {
+	switch s {
+	case "", layoutPoint:
+		return layoutPoint, nil
+	case layoutBucket:
+		return layoutBucket, nil
+	}
+
+	return "", fmt.Errorf("mongo: Unknown layout %s", s)
+}
+
+// docLayout return the layout of a series document, or an empty string if
+// the document is not a point or bucket document
+func docLayout(doc bson.M) string {
+	if _, ok := doc["points"]; ok {
+		return layoutBucket
+	}
+	if _, ok := doc["timestamp"]; ok {
+		return layoutPoint
+	}
+
+	return ""
+}
+
+// storedLayout return the layout of the stored points, the layout of the
+// first series document found, or an empty string if no points are stored
+func storedLayout(s *mgo.Session) (string, error) {
+	names, err := s.DatabaseNames()
+	if err != nil {
+		return "", err
+	}
+
+	for _, name := range names {
+		if name == "admin" || name == "local" || name == "config" {
+			continue
+		}
+
+		var items []storage.Item
+		db := s.DB(name)
+		if err = db.C("ids").Find(nil).Select(bson.M{"_id": 1}).All(&items); err != nil {
+			return "", err
+		}
+		for _, item := range items {
+			var doc bson.M
+			err = db.C(item.ID).Find(nil).One(&doc)
+			if err == mgo.ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return "", err
+			}
+			if layout := docLayout(doc); layout != "" {
+				return layout, nil
+			}
+		}
+	}
+
+	return "", nil
+}
+
+// ensureRetention create the TTL index of a series collection, or update its
+// expiry if the retention changed, mgo caches created indexes so this is
+// cheap to call on every write
+//
+// point documents expire by the point time, bucket documents expire by the
+// bucket end time, documents written before the time field was added have
+// no time field and never expire.
+func (r Storage) ensureRetention(c *mgo.Collection) error {
+	if r.timeRetentionSec == 0 {
+		return nil
+	}
+
+	expireAfter := time.Duration(r.timeRetentionSec) * time.Second
+	err := c.EnsureIndex(mgo.Index{Key: []string{"time"}, Name: retentionIndex, ExpireAfter: expireAfter})
+	if !isIndexOptionsConflict(err) {
+		return err
+	}
+
+	// an index with an older retention exists
+	return c.Database.Run(bson.D{
+		{Name: "collMod", Value: c.Name},
+		{Name: "index", Value: bson.M{"name": retentionIndex, "expireAfterSeconds": r.timeRetentionSec}},
+	}, nil)
+}
+
+// isIndexOptionsConflict return true if err is the error of creating an
+// index that exists with other options
+func isIndexOptionsConflict(err error) bool {
+	switch e := err.(type) {
+	case *mgo.QueryError:
+		return e.Code == indexOptionsConflict
+	case *mgo.LastError:
+		return e.Code == indexOptionsConflict
+	}
+
+	return false
+}
+
+// insertPoints insert data points into a series collection
+func (r Storage) insertPoints(c *mgo.Collection, data []storage.DataItem) error {
+	if err := r.ensureRetention(c); err != nil {
+		return err
+	}
+
+	bulk := c.Bulk()
+	bulk.Unordered()
+
+	if r.layout == layoutPoint {
+		for _, d := range data {
+			bulk.Insert(&pointDoc{Timestamp: d.Timestamp, Value: d.Value, Time: msTime(d.Timestamp)})
+		}
+	} else {
+		// one upsert per bucket, pushing all the bucket points
+		for key, points := range groupBuckets(data) {
+			bulk.Upsert(bson.M{"_id": key}, bucketUpdate(key, points))
+		}
+	}
+
+	_, err := bulk.Run()
+	return err
+}
+
+// groupBuckets group data points by the key of their bucket document
+func groupBuckets(data []storage.DataItem) map[int64][]storage.DataItem {
+	buckets := make(map[int64][]storage.DataItem)
+	for _, d := range data {
+		key := bucketKey(d.Timestamp)
+		buckets[key] = append(buckets[key], d)
+	}
+
+	return buckets
+}
+
+// bucketUpdate return the upsert of points into a bucket document, the
+// bucket time is its end time, used by the TTL index
+func bucketUpdate(key int64, points []storage.DataItem) bson.M {
+	return bson.M{
+		"$push":        bson.M{"points": bson.M{"$each": points}},
+		"$setOnInsert": bson.M{"time": msTime(key + bucketMili)},
+	}
+}
+
+// pointStages return aggregation stages that output the points of a series
+// collection matching a timestamp condition, as {timestamp, value} documents
+func (r Storage) pointStages(start int64, end int64, timestamp bson.M) []bson.M {
+	if r.layout == layoutPoint {
+		return []bson.M{
+			{"$match": bson.M{"timestamp": timestamp}},
+		}
+	}
+
+	return []bson.M{
+		{"$match": bson.M{"_id": bson.M{"$gte": bucketKey(start), "$lte": end}}},
+		{"$unwind": "$points"},
+		{"$replaceRoot": bson.M{"newRoot": "$points"}},
+		{"$match": bson.M{"timestamp": timestamp}},
+	}
+}
+
+// deletePoints remove a time range from a series collection
+func (r Storage) deletePoints(c *mgo.Collection, end int64, start int64) error {
+	timestamp := bson.M{"$gte": start, "$lt": end}
+
+	if r.layout == layoutPoint {
+		_, err := c.RemoveAll(bson.M{"timestamp": timestamp})
+		return err
+	}
+
+	_, err := c.UpdateAll(
+		bson.M{"_id": bson.M{"$gte": bucketKey(start), "$lt": end}},
+		bson.M{"$pull": bson.M{"points": bson.M{"timestamp": timestamp}}})
+	if err != nil {
+		return err
+	}
+
+	// remove buckets with no points left
+	_, err = c.RemoveAll(bson.M{"points": bson.M{"$size": 0}})
+	return err
+}
+
+// lastPoint return the newest point of a series collection, or false if
+// the collection has no points
+func (r Storage) lastPoint(c *mgo.Collection) (storage.DataItem, bool, error) {
+	var d storage.DataItem
+	var err error
+
+	if r.layout == layoutPoint {
+		err = c.Find(nil).Sort("-timestamp").One(&d)
+	} else {
+		err = c.Pipe([]bson.M{
+			{"$sort": bson.M{"_id": -1}},
+			{"$limit": 1},
+			{"$unwind": "$points"},
+			{"$replaceRoot": bson.M{"newRoot": "$points"}},
+			{"$sort": bson.M{"timestamp": -1}},
+			{"$limit": 1},
+		}).One(&d)
+	}
+
+	if err == mgo.ErrNotFound {
+		return d, false, nil
+	}
+
+	return d, err == nil, err
+}
+
+// bucketKey return the key of the bucket document holding a timestamp
+func bucketKey(t int64) int64 {
+	return t - t%bucketMili
+}
+
+// msTime return the time of a timestamp in ms
+func msTime(t int64) time.Time {
+	return time.Unix(0, t*int64(time.Millisecond))
+}
@@ -17,21 +17,30 @@
 package mongo
 
 import (
+	"fmt"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 	"log"
 	"net/url"
 	"strings"
-	"time"
 
 	"github.com/MohawkTSDB/mohawk/src/storage"
 )
 
 type Storage struct {
-	dbURL        string
-	dbUsername   string
-	dbPassword   string
-	mongoSession *mgo.Session
+	timeRetentionSec int64
+	layout           string
+	mongoSession     *mgo.Session
+}
+
+// bucketValue a value of a stat bucket
+type bucketValue struct {
+	Start int64   `bson:"start"`
+	Value float64 `bson:"value"`
+}
+
+func init() {
+	storage.Register("mongo", func() storage.Storage { return &Storage{} })
 }
 
 // Storage functions
@@ -45,45 +54,73 @@ func (r Storage) Name() string {
 // Help return a human readable storage help message
 func (r Storage) Help() string {
 	return `Mongo storage [mongo]:
-	db-url   - comma separeted list of mongo servers.
+	db-url   - comma separeted list of mongo servers, or a mongo connection
+	           string [e.g. mongodb://host1,host2/?replicaSet=rs0&tls=true].
 	username - (optional) username for db access.
 	password - (optional) password for db access.
+	auth-db  - (optional) database holding the user credentials.
+	read-preference - (optional) primary, primaryPreferred, secondary,
+	           secondaryPreferred or nearest.
+	tls      - (optional) connect using TLS [default: false].
+	tls-ca-file - (optional) CA certificates file used to verify the servers,
+	           implies tls.
+	timeout  - (optional) connection timeout [default: 10s].
+	connect-retries - (optional) connection retries, the wait between
+	           retries doubles every retry [default: 5].
+	retention - (optional) max time to keep data points, points are removed
+	           by a mongo TTL index, points written by versions without
+	           retention support never expire [e.g. 3h, 7d].
+	layout   - (optional) document layout of data points, "point" one document
+	           per data point or "bucket" one document per series hour, the
+	           layout can not be changed for existing data, open fails if it
+	           does not match the stored points [default: point].
 	Examples:
-		--options=db-url=42.153.3.25,42.153.3.26,42.153.3.27`
+		--options=db-url=42.153.3.25,42.153.3.26,42.153.3.27
+		--options=db-url=127.0.0.1&retention=7d&layout=bucket
+		--options=db-url=mongodb://host1,host2/?replicaSet=rs0&auth-db=admin&tls-ca-file=/etc/ca.pem`
 }
 
 // Open storage
-func (r *Storage) Open(options url.Values) {
-	var err error
-
+func (r *Storage) Open(options url.Values) error {
 	// get storage options
-	r.dbURL = options.Get("db-url")
-	if r.dbURL == "" {
-		r.dbURL = "127.0.0.1"
+	conn, err := parseConnection(options)
+	if err != nil {
+		return err
 	}
-	r.dbUsername = options.Get("username")
-	r.dbPassword = options.Get("password")
-
-	// We need this object to establish a session to our MongoDB.
-	mongoDBDialInfo := &mgo.DialInfo{
-		Addrs:    strings.Split(r.dbURL, ","),
-		Timeout:  10 * time.Second,
-		Username: r.dbUsername,
-		Password: r.dbPassword,
+	if retentionStr := options.Get("retention"); retentionStr != "" {
+		if r.timeRetentionSec, err = storage.ParseDuration(retentionStr); err != nil || r.timeRetentionSec < 0 {
+			return fmt.Errorf("mongo: Bad retention %s", retentionStr)
+		}
+	}
+	if r.layout, err = parseLayout(options.Get("layout")); err != nil {
+		return err
 	}
 
 	// Create a session which maintains a pool of socket connections
 	// to our MongoDB.
-	r.mongoSession, err = mgo.DialWithInfo(mongoDBDialInfo)
-	if err != nil {
-		panic(err)
+	if r.mongoSession, err = conn.dial(); err != nil {
+		return err
 	}
 
-	r.mongoSession.SetMode(mgo.Monotonic, true)
+	// reads of one layout do not find points stored in the other
+	layout, err := storedLayout(r.mongoSession)
+	if err == nil && layout != "" && layout != r.layout {
+		err = fmt.Errorf("mongo: Stored points use the %s layout, not %s", layout, r.layout)
+	}
+	if err != nil {
+		r.mongoSession.Close()
+		return err
+	}
 
 	// log init arguments
 	log.Printf("Start mongo storage:")
-	log.Printf("  addrs: %+v", strings.Split(r.dbURL, ","))
+	log.Printf("  addrs: %+v", conn.info.Addrs)
+	log.Printf("  replica set: %s", conn.info.ReplicaSetName)
+	log.Printf("  tls: %v", conn.tls)
+	log.Printf("  retention: %ds", r.timeRetentionSec)
+	log.Printf("  layout: %s", r.layout)
+
+	return nil
 }
 
 func (r Storage) GetTenants() ([]storage.Tenant, error) {
@@ -132,7 +169,7 @@ func (r Storage) GetItemList(tenant string, tags map[string]string) ([]storage.I
 }
 
 func (r Storage) GetRawData(tenant string, id string, end int64, start int64, limit int64, order string) ([]storage.DataItem, error) {
-	var sort string
+	var sort int
 	res := make([]storage.DataItem, 0)
 
 	// copy storage session
@@ -141,20 +178,30 @@ func (r Storage) GetRawData(tenant string, id string, end int64, start int64, li
 
 	// order to sort
 	if order == "DESC" {
-		sort = "-timestamp"
+		sort = -1
 	} else {
-		sort = "timestamp"
+		sort = 1
+	}
+
+	// check if id exist, reads do not create it
+	if !r.IDExist(tenant, id) {
+		return res, storage.NotFoundError{Tenant: tenant, ID: id}
 	}
 
 	c := sessionCopy.DB(tenant).C(id)
 
 	// Query
-	err := c.Find(bson.M{"timestamp": bson.M{"$gte": start, "$lt": end}}).Sort(sort).Limit(int(limit)).All(&res)
+	stages := r.pointStages(start, end, bson.M{"$gte": start, "$lt": end})
+	stages = append(stages,
+		bson.M{"$sort": bson.M{"timestamp": sort}},
+		bson.M{"$limit": int(limit)},
+	)
+	err := c.Pipe(stages).All(&res)
 
 	return res, err
 }
 
-func (r Storage) GetStatData(tenant string, id string, end int64, start int64, limit int64, order string, bucketDuration int64) ([]storage.StatItem, error) {
+func (r Storage) GetStatData(tenant string, id string, end int64, start int64, limit int64, order string, bucketDuration int64, percentiles []float64) ([]storage.StatItem, error) {
 	var sort int
 	res := make([]storage.StatItem, 0)
 
@@ -169,58 +216,35 @@ func (r Storage) GetStatData(tenant string, id string, end int64, start int64, l
 		sort = 1
 	}
 
+	// check if id exist, reads do not create it
+	if !r.IDExist(tenant, id) {
+		return res, storage.NotFoundError{Tenant: tenant, ID: id}
+	}
+
 	c := sessionCopy.DB(tenant).C(id)
 
-	// Query
-	err := c.Pipe(
-		[]bson.M{
-			{
-				"$match": bson.M{"timestamp": bson.M{"$gte": start, "$lte": end}},
-			},
-			{
-				"$group": bson.M{
-					"_id": bson.M{
-						"$trunc": bson.M{"$divide": []interface{}{"$timestamp", bucketDuration * 1000}},
-					},
-					"start": bson.M{"$first": bson.M{"$multiply": []interface{}{
-						bson.M{"$trunc": bson.M{"$divide": []interface{}{
-							"$timestamp",
-							bucketDuration * 1000,
-						}}},
-						bucketDuration * 1000,
-					}}},
-					"end": bson.M{"$first": bson.M{"$multiply": []interface{}{
-						bson.M{"$ceil": bson.M{"$divide": []interface{}{
-							"$timestamp",
-							bucketDuration * 1000,
-						}}},
-						bucketDuration * 1000,
-					}}},
-					"first":   bson.M{"$first": "$value"},
-					"last":    bson.M{"$last": "$value"},
-					"sum":     bson.M{"$sum": "$value"},
-					"avg":     bson.M{"$avg": "$value"},
-					"min":     bson.M{"$min": "$value"},
-					"max":     bson.M{"$max": "$value"},
-					"samples": bson.M{"$sum": 1},
-				},
-			},
-			{
-				"$sort": bson.M{"start": sort},
-			},
-			{
-				"$limit": int(limit),
-			},
-		},
-	).All(&res)
+	// Query, points are sorted by time for the first and last values, the
+	// median and percentiles are computed from a second query
+	bucketMili := bucketDuration * 1000
+	err := c.Pipe(r.statStages(end, start, bucketMili, sort, limit)).AllowDiskUse().All(&res)
+	if err != nil || len(res) == 0 {
+		return res, err
+	}
+
+	for i := range res {
+		res[i].End = res[i].Start + bucketMili
+	}
+	err = r.setQuantiles(c, res, percentiles, end, start, bucketMili)
 
 	return res, err
 }
 
-// unimplemented requests should fail silently
-
 // PostRawData handle posting data to db
 func (r Storage) PostRawData(tenant string, id string, t int64, v float64) error {
+	if err := validID(tenant, id); err != nil {
+		return err
+	}
+
 	// check if id exist
 	if !r.IDExist(tenant, id) {
 		if err := r.createID(tenant, id); err != nil {
@@ -232,8 +256,34 @@ func (r Storage) PostRawData(tenant string, id string, t int64, v float64) error
 	return err
 }
 
+// PostBatchData handle posting a batch of data points to db
+func (r Storage) PostBatchData(tenant string, items []storage.BatchItem) error {
+	for _, item := range items {
+		if err := validID(tenant, item.ID); err != nil {
+			return err
+		}
+
+		// check if id exist
+		if !r.IDExist(tenant, item.ID) {
+			if err := r.createID(tenant, item.ID); err != nil {
+				return err
+			}
+		}
+
+		if err := r.insertBatchData(tenant, item.ID, item.Data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // PutTags handle posting tags to db
 func (r Storage) PutTags(tenant string, id string, tags map[string]string) error {
+	if err := validID(tenant, id); err != nil {
+		return err
+	}
+
 	// check if id exist
 	if !r.IDExist(tenant, id) {
 		if err := r.createID(tenant, id); err != nil {
@@ -252,17 +302,175 @@ func (r Storage) PutTags(tenant string, id string, tags map[string]string) error
 
 // DeleteData handle delete data from db
 func (r Storage) DeleteData(tenant string, id string, end int64, start int64) error {
-	return nil
+	// check if id exist
+	if !r.IDExist(tenant, id) {
+		return storage.NotFoundError{Tenant: tenant, ID: id}
+	}
+
+	return r.deleteData(tenant, id, end, start)
 }
 
 // DeleteTags handle delete tags from db
 func (r Storage) DeleteTags(tenant string, id string, tags []string) error {
-	return nil
+	// check if id exist
+	if !r.IDExist(tenant, id) {
+		return storage.NotFoundError{Tenant: tenant, ID: id}
+	}
+
+	return r.deleteTags(tenant, id, tags)
 }
 
 // Helper functions
 // Not required by storage interface
 
+// bucketStart return an expression of the start of the stat bucket of a point
+func bucketStart(bucketMili int64) bson.M {
+	return bson.M{"$multiply": []interface{}{
+		bson.M{"$trunc": bson.M{"$divide": []interface{}{"$timestamp", bucketMili}}},
+		bucketMili,
+	}}
+}
+
+// statStages return aggregation stages that output the stat buckets of the
+// points of a series collection, buckets are aligned to multiples of
+// bucketMili
+func (r Storage) statStages(end int64, start int64, bucketMili int64, sort int, limit int64) []bson.M {
+	stages := r.pointStages(start, end, bson.M{"$gte": start, "$lt": end})
+
+	return append(stages,
+		bson.M{"$sort": bson.M{"timestamp": 1}},
+		bson.M{"$group": bson.M{
+			"_id":     bucketStart(bucketMili),
+			"start":   bson.M{"$first": bucketStart(bucketMili)},
+			"first":   bson.M{"$first": "$value"},
+			"last":    bson.M{"$last": "$value"},
+			"sum":     bson.M{"$sum": "$value"},
+			"avg":     bson.M{"$avg": "$value"},
+			"std":     bson.M{"$stdDevPop": "$value"},
+			"min":     bson.M{"$min": "$value"},
+			"max":     bson.M{"$max": "$value"},
+			"samples": bson.M{"$sum": 1},
+		}},
+		bson.M{"$sort": bson.M{"start": sort}},
+		bson.M{"$limit": int(limit)},
+	)
+}
+
+// valueStages return aggregation stages that output the values of the
+// points of a series collection, sorted by stat bucket and value
+func (r Storage) valueStages(end int64, start int64, bucketMili int64) []bson.M {
+	stages := r.pointStages(start, end, bson.M{"$gte": start, "$lt": end})
+
+	return append(stages,
+		bson.M{"$project": bson.M{"_id": 0, "start": bucketStart(bucketMili), "value": 1}},
+		bson.M{"$sort": bson.D{{Name: "start", Value: 1}, {Name: "value", Value: 1}}},
+	)
+}
+
+// setQuantiles set the median and percentiles of stat buckets, the values
+// of the buckets are streamed from the db sorted by bucket and value
+func (r Storage) setQuantiles(c *mgo.Collection, res []storage.StatItem, percentiles []float64, end int64, start int64, bucketMili int64) error {
+	var quantiles storage.Quantiles
+	var v bucketValue
+
+	// read only the values of the returned buckets
+	buckets := make(map[int64]int, len(res))
+	for i, item := range res {
+		buckets[item.Start] = i
+	}
+	first, last := res[0].Start, res[len(res)-1].Start
+	if first > last {
+		first, last = last, first
+	}
+	start = maxInt64(start, first)
+	end = minInt64(end, last+bucketMili)
+
+	iter := c.Pipe(r.valueStages(end, start, bucketMili)).AllowDiskUse().Iter()
+
+	var i int
+	var ok, started bool
+	var current, rank int64
+	var median float64
+	flush := func() {
+		if ok {
+			res[i].Median = median / 2
+			res[i].Percentiles = quantiles.Percentiles(percentiles)
+		}
+		quantiles.Reset()
+	}
+	for iter.Next(&v) {
+		if !started || v.Start != current {
+			flush()
+			started, current = true, v.Start
+			i, ok = buckets[current]
+			rank, median = 0, 0
+		}
+		if !ok {
+			continue
+		}
+
+		// the median is the mean of the two middle values, or the middle value
+		// counted twice
+		rank++
+		n := res[i].Samples
+		if rank == (n+1)/2 {
+			median += v.Value
+		}
+		if rank == (n+2)/2 {
+			median += v.Value
+		}
+		if len(percentiles) > 0 {
+			quantiles.Add(v.Value)
+		}
+	}
+	flush()
+
+	return iter.Close()
+}
+
+// maxInt64 return the larger of two numbers
+func maxInt64(a int64, b int64) int64 {
+	if a > b {
+		return a
+	}
+
+	return b
+}
+
+// minInt64 return the smaller of two numbers
+func minInt64(a int64, b int64) int64 {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+// maxNamespace the max length of a mongo namespace, "<tenant>.<id>"
+const maxNamespace = 120
+
+// validID return a BadIDError if a metric id can not be a collection name
+func validID(tenant string, id string) error {
+	reason := ""
+
+	switch {
+	case id == "":
+		reason = "empty id"
+	case strings.ContainsAny(id, "$\x00"):
+		reason = "id includes \"$\" or a null character"
+	case strings.HasPrefix(id, "system."):
+		reason = "id starts with \"system.\""
+	case id == "ids":
+		reason = "id is the name of the ids collection"
+	case len(tenant)+1+len(id) > maxNamespace:
+		reason = fmt.Sprintf("tenant and id are longer then %d bytes", maxNamespace)
+	default:
+		return nil
+	}
+
+	return storage.BadIDError{ID: id, Reason: reason}
+}
+
 func (r Storage) IDExist(tenant string, id string) bool {
 	result := storage.Item{}
 
@@ -322,7 +530,102 @@ func (r Storage) insertData(tenant string, id string, t int64, v float64) error
 	defer sessionCopy.Close()
 
 	c := sessionCopy.DB(tenant).C(id)
-	err := c.Insert(&storage.DataItem{Timestamp: t, Value: v})
+	d := storage.DataItem{Timestamp: t, Value: v}
+	if err := r.insertPoints(c, []storage.DataItem{d}); err != nil {
+		return err
+	}
+
+	return updateLast(sessionCopy, tenant, id, d)
+}
+
+func (r Storage) insertBatchData(tenant string, id string, data []storage.DataItem) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	// copy storage session
+	sessionCopy := r.mongoSession.Copy()
+	defer sessionCopy.Close()
+
+	c := sessionCopy.DB(tenant).C(id)
+
+	// insert all data points in one bulk operation
+	if err := r.insertPoints(c, data); err != nil {
+		return err
+	}
+
+	last := data[0]
+	for _, d := range data {
+		if d.Timestamp >= last.Timestamp {
+			last = d
+		}
+	}
+
+	return updateLast(sessionCopy, tenant, id, last)
+}
+
+// updateLast set the last value of an item if the point is newer then the
+// item last value, the condition and the update are one atomic operation
+func updateLast(s *mgo.Session, tenant string, id string, d storage.DataItem) error {
+	c := s.DB(tenant).C("ids")
+
+	err := c.Update(bson.M{"_id": id, "$or": []bson.M{
+		{"data.0.timestamp": bson.M{"$lte": d.Timestamp}},
+		{"data.0": bson.M{"$exists": false}},
+	}}, bson.M{"$set": bson.M{"data": []storage.DataItem{d}}})
+	if err == mgo.ErrNotFound {
+		// the item has a newer last value
+		return nil
+	}
 
 	return err
 }
+
+func (r Storage) deleteData(tenant string, id string, end int64, start int64) error {
+	// copy storage session
+	sessionCopy := r.mongoSession.Copy()
+	defer sessionCopy.Close()
+
+	c := sessionCopy.DB(tenant).C(id)
+	if err := r.deletePoints(c, end, start); err != nil {
+		return err
+	}
+
+	// if the last value was deleted, find the new last value
+	ids := sessionCopy.DB(tenant).C("ids")
+	n, err := ids.Find(bson.M{"_id": id, "data.0.timestamp": bson.M{"$gte": start, "$lt": end}}).Count()
+	if err != nil || n == 0 {
+		return err
+	}
+
+	last := []storage.DataItem{}
+	d, ok, err := r.lastPoint(c)
+	if err != nil {
+		return err
+	}
+	if ok {
+		last = append(last, d)
+	}
+
+	return ids.Update(bson.M{"_id": id}, bson.M{"$set": bson.M{"data": last}})
+}
+
+func (r Storage) deleteTags(tenant string, id string, tags []string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+
+	// copy storage session
+	sessionCopy := r.mongoSession.Copy()
+	defer sessionCopy.Close()
+
+	c := sessionCopy.DB(tenant).C("ids")
+
+	// Update
+	unset := bson.M{}
+	for _, k := range tags {
+		unset["tags."+k] = ""
+	}
+
+	return c.Update(bson.M{"_id": id}, bson.M{"$unset": unset})
+}
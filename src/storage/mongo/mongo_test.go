@@ -0,0 +1,275 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mongo interface for mongo metric data storage
+package mongo
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/MohawkTSDB/mohawk/src/storage"
+	"github.com/MohawkTSDB/mohawk/src/storage/storagetest"
+)
+
+// testMongoURL return the url of a mongo server for tests, the server at
+// MOHAWK_TEST_MONGO_URL, or a mongod started in a temporary directory, the
+// test is skipped if neither is available, the caller must call stop
+func testMongoURL(t *testing.T) (string, func()) {
+	if dbURL := os.Getenv("MOHAWK_TEST_MONGO_URL"); dbURL != "" {
+		return dbURL, func() {}
+	}
+
+	mongod, err := exec.LookPath("mongod")
+	if err != nil {
+		t.Skip("MOHAWK_TEST_MONGO_URL is not set, and mongod is not in PATH")
+	}
+
+	dir, err := ioutil.TempDir("", "mohawk-mongo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// find a free port
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	l.Close()
+
+	cmd := exec.Command(mongod, "--dbpath", dir, "--bind_ip", "127.0.0.1", "--port", port, "--nounixsocket", "--quiet")
+	if err = cmd.Start(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	stop := func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		os.RemoveAll(dir)
+	}
+
+	// wait for the server to listen
+	for i := 0; ; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err == nil {
+			c.Close()
+			break
+		}
+		if i == 300 {
+			stop()
+			t.Fatalf("mongod did not start: %s", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return addr, stop
+}
+
+// TestStorage run the shared storage tests, on the server at
+// MOHAWK_TEST_MONGO_URL, or on a local mongod
+func TestStorage(t *testing.T) {
+	dbURL, stop := testMongoURL(t)
+	defer stop()
+
+	r := &Storage{}
+	if err := r.Open(url.Values{"db-url": {dbURL}}); err != nil {
+		t.Fatal(err)
+	}
+
+	storagetest.Run(t, r)
+}
+
+func TestParseConnection(t *testing.T) {
+	c, err := parseConnection(url.Values{
+		"db-url":  {"mongodb://user:pass@h1:27017,h2/metrics?replicaSet=rs0&authSource=metrics&readPreference=secondaryPreferred&tls=true&connectTimeoutMS=2000"},
+		"auth-db": {"admin"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.info.Addrs) != 2 || c.info.Addrs[0] != "h1:27017" || c.info.Addrs[1] != "h2" {
+		t.Errorf("addrs = %v", c.info.Addrs)
+	}
+	if c.info.ReplicaSetName != "rs0" || c.info.Username != "user" || c.info.Password != "pass" {
+		t.Errorf("dial info = %+v", c.info)
+	}
+	if c.info.Source != "admin" {
+		t.Errorf("auth db = %s, the auth-db option should override the connection string", c.info.Source)
+	}
+	if c.mode != mgo.SecondaryPreferred || !c.tls || c.info.Timeout != 2*time.Second {
+		t.Errorf("connection = %+v", c)
+	}
+
+	bad := []url.Values{
+		{"db-url": {"mongodb://h1/?readPreference=any"}},
+		{"db-url": {"mongodb://h1/?unknownOption=1"}},
+		{"read-preference": {"any"}},
+		{"timeout": {"10"}},
+		{"connect-retries": {"-1"}},
+	}
+	for _, options := range bad {
+		if _, err := parseConnection(options); err == nil {
+			t.Errorf("parseConnection(%v) should fail", options)
+		}
+	}
+}
+
+func TestOpenError(t *testing.T) {
+	r := &Storage{}
+	err := r.Open(url.Values{"db-url": {"127.0.0.1:1"}, "timeout": {"100ms"}, "connect-retries": {"1"}})
+	if err == nil {
+		t.Fatal("Open should fail when no server is listening")
+	}
+
+	if err = r.Open(url.Values{"retention": {"1x"}}); err == nil {
+		t.Error("Open should fail on a bad retention")
+	}
+}
+
+func TestValidID(t *testing.T) {
+	for _, id := range []string{"cpu", "free_memory.host-1", "system"} {
+		if err := validID("tenant", id); err != nil {
+			t.Errorf("%q: unexpected error %v", id, err)
+		}
+	}
+
+	for _, id := range []string{"", "a$b", "a\x00b", "system.users", "ids", strings.Repeat("a", 120)} {
+		if err := validID("tenant", id); !storage.IsBadID(err) {
+			t.Errorf("%q: expected a bad id error, got %v", id, err)
+		}
+	}
+}
+
+func TestIsIndexOptionsConflict(t *testing.T) {
+	if !isIndexOptionsConflict(&mgo.QueryError{Code: indexOptionsConflict}) {
+		t.Error("expected an index options conflict")
+	}
+	for _, err := range []error{nil, errors.New("no reachable servers"), &mgo.QueryError{Code: 13}} {
+		if isIndexOptionsConflict(err) {
+			t.Errorf("%v: unexpected index options conflict", err)
+		}
+	}
+}
+
+func TestDocLayout(t *testing.T) {
+	for _, c := range []struct {
+		doc    bson.M
+		layout string
+	}{
+		{bson.M{"timestamp": int64(1000), "value": 1.0}, layoutPoint},
+		{bson.M{"_id": int64(0), "points": []bson.M{{"timestamp": int64(1000), "value": 1.0}}}, layoutBucket},
+		{bson.M{"_id": "cpu"}, ""},
+	} {
+		if layout := docLayout(c.doc); layout != c.layout {
+			t.Errorf("%v: expected layout %q, got %q", c.doc, c.layout, layout)
+		}
+	}
+}
+
+func TestPointStages(t *testing.T) {
+	timestamp := bson.M{"$gte": int64(5000), "$lt": int64(9000)}
+
+	r := Storage{layout: layoutPoint}
+	stages := r.pointStages(5000, 9000, timestamp)
+	if len(stages) != 1 || stages[0]["$match"].(bson.M)["timestamp"].(bson.M)["$gte"] != int64(5000) {
+		t.Errorf("point layout: unexpected stages %v", stages)
+	}
+
+	r = Storage{layout: layoutBucket}
+	stages = r.pointStages(bucketMili+5000, bucketMili+9000, timestamp)
+	if len(stages) != 4 {
+		t.Fatalf("bucket layout: expected 4 stages, got %v", stages)
+	}
+	if id := stages[0]["$match"].(bson.M)["_id"].(bson.M); id["$gte"] != bucketMili {
+		t.Errorf("bucket layout: expected the first bucket key %d, got %v", bucketMili, id)
+	}
+	if stages[1]["$unwind"] != "$points" || stages[3]["$match"].(bson.M)["timestamp"].(bson.M)["$lt"] != int64(9000) {
+		t.Errorf("bucket layout: unexpected stages %v", stages)
+	}
+}
+
+func TestStatStages(t *testing.T) {
+	r := Storage{layout: layoutPoint}
+
+	stages := r.statStages(9000, 5000, 2000, -1, 10)
+	if len(stages) != 5 {
+		t.Fatalf("expected 5 stages, got %v", stages)
+	}
+	if stages[0]["$match"].(bson.M)["timestamp"].(bson.M)["$lt"] != int64(9000) {
+		t.Errorf("expected an end exclusive match, got %v", stages[0])
+	}
+	group := stages[2]["$group"].(bson.M)
+	for _, key := range []string{"_id", "start", "first", "last", "sum", "avg", "std", "min", "max", "samples"} {
+		if _, ok := group[key]; !ok {
+			t.Errorf("missing %q in group stage %v", key, group)
+		}
+	}
+	if stages[3]["$sort"].(bson.M)["start"] != -1 || stages[4]["$limit"] != 10 {
+		t.Errorf("unexpected sort and limit stages %v %v", stages[3], stages[4])
+	}
+
+	stages = r.valueStages(9000, 5000, 2000)
+	if len(stages) != 3 || stages[1]["$project"].(bson.M)["value"] != 1 {
+		t.Errorf("unexpected value stages %v", stages)
+	}
+}
+
+func TestBucketStart(t *testing.T) {
+	expr := bucketStart(2000)["$multiply"].([]interface{})
+	if expr[1] != int64(2000) {
+		t.Errorf("expected a multiple of 2000, got %v", expr)
+	}
+	divide := expr[0].(bson.M)["$trunc"].(bson.M)["$divide"].([]interface{})
+	if divide[0] != "$timestamp" || divide[1] != int64(2000) {
+		t.Errorf("expected the timestamp divided by 2000, got %v", divide)
+	}
+}
+
+func TestGroupBuckets(t *testing.T) {
+	data := []storage.DataItem{
+		{Timestamp: 1000, Value: 1},
+		{Timestamp: bucketMili - 1, Value: 2},
+		{Timestamp: bucketMili, Value: 3},
+		{Timestamp: 3*bucketMili + 5, Value: 4},
+	}
+
+	buckets := groupBuckets(data)
+	if len(buckets) != 3 || len(buckets[0]) != 2 || len(buckets[bucketMili]) != 1 || len(buckets[3*bucketMili]) != 1 {
+		t.Errorf("unexpected buckets %v", buckets)
+	}
+
+	update := bucketUpdate(bucketMili, buckets[bucketMili])
+	if tm := update["$setOnInsert"].(bson.M)["time"].(time.Time); !tm.Equal(msTime(2 * bucketMili)) {
+		t.Errorf("expected the bucket end time, got %v", tm)
+	}
+	if points := update["$push"].(bson.M)["points"].(bson.M)["$each"].([]storage.DataItem); len(points) != 1 || points[0].Value != 3 {
+		t.Errorf("unexpected pushed points %v", points)
+	}
+}
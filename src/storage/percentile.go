@@ -0,0 +1,206 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package storage interface for metric data storage
+package storage
+
+import (
+	"math"
+	"sort"
+)
+
+// exactQuantileValues max number of bucket values kept for exact percentiles,
+// larger buckets are summarized in a t-digest
+const exactQuantileValues = 1000
+
+// digestCompression the t-digest compression, bounds the number of centroids
+const digestCompression = 100
+
+// digestBuffer number of values added to a t-digest before they are merged
+const digestBuffer = 500
+
+// Quantiles accumulate the values of one stat bucket and compute percentiles,
+// small buckets keep all values and percentiles are exact, large buckets are
+// summarized in a t-digest and percentiles are estimated
+type Quantiles struct {
+	values []float64
+	digest *tDigest
+}
+
+// Add add a value to the bucket
+func (q *Quantiles) Add(v float64) {
+	if q.digest != nil {
+		q.digest.add(v)
+		return
+	}
+
+	q.values = append(q.values, v)
+	if len(q.values) > exactQuantileValues {
+		q.digest = &tDigest{min: math.Inf(1), max: math.Inf(-1)}
+		for _, v := range q.values {
+			q.digest.add(v)
+		}
+		q.values = nil
+	}
+}
+
+// Reset remove all values from the bucket
+func (q *Quantiles) Reset() {
+	q.values = q.values[:0]
+	q.digest = nil
+}
+
+// Percentiles return the bucket percentiles, percentiles are in [0, 100]
+func (q *Quantiles) Percentiles(percentiles []float64) []Percentile {
+	if len(percentiles) == 0 {
+		return nil
+	}
+
+	res := make([]Percentile, 0, len(percentiles))
+	if q.digest == nil {
+		sort.Float64s(q.values)
+	}
+
+	for _, p := range percentiles {
+		var v float64
+		if q.digest == nil {
+			v = exactQuantile(q.values, p/100)
+		} else {
+			v = q.digest.quantile(p / 100)
+		}
+		res = append(res, Percentile{Quantile: p, Value: v})
+	}
+
+	return res
+}
+
+// exactQuantile return a quantile of sorted values, interpolating between
+// the closest ranks
+func exactQuantile(sorted []float64, q float64) float64 {
+	n := len(sorted)
+	if n == 0 {
+		return 0
+	}
+
+	rank := q * float64(n-1)
+	i := int(math.Floor(rank))
+	if i >= n-1 {
+		return sorted[n-1]
+	}
+
+	return sorted[i] + (rank-float64(i))*(sorted[i+1]-sorted[i])
+}
+
+// centroid a t-digest cluster of values
+type centroid struct {
+	mean  float64
+	count float64
+}
+
+// tDigest a merging t-digest, see "Computing Extremely Accurate Quantiles
+// Using t-Digests" (Dunning and Ertl, 2019)
+type tDigest struct {
+	centroids []centroid
+	buffer    []float64
+	count     float64
+	min       float64
+	max       float64
+}
+
+// add add one value to the digest
+func (d *tDigest) add(v float64) {
+	d.buffer = append(d.buffer, v)
+	d.min = math.Min(d.min, v)
+	d.max = math.Max(d.max, v)
+
+	if len(d.buffer) >= digestBuffer {
+		d.compress()
+	}
+}
+
+// scale the k1 scale function, limits the size of centroids near the tails
+func scale(q float64) float64 {
+	return digestCompression / (2 * math.Pi) * math.Asin(2*q-1)
+}
+
+// compress merge buffered values into the centroids
+func (d *tDigest) compress() {
+	if len(d.buffer) == 0 {
+		return
+	}
+
+	all := d.centroids
+	for _, v := range d.buffer {
+		all = append(all, centroid{mean: v, count: 1})
+		d.count++
+	}
+	d.buffer = d.buffer[:0]
+	sort.Slice(all, func(i, j int) bool { return all[i].mean < all[j].mean })
+
+	merged := make([]centroid, 0, len(all))
+	cur := all[0]
+	done := 0.0
+	kLeft := scale(0)
+	for _, c := range all[1:] {
+		if scale((done+cur.count+c.count)/d.count)-kLeft <= 1 {
+			cur.mean += (c.mean - cur.mean) * c.count / (cur.count + c.count)
+			cur.count += c.count
+			continue
+		}
+
+		merged = append(merged, cur)
+		done += cur.count
+		kLeft = scale(done / d.count)
+		cur = c
+	}
+	d.centroids = append(merged, cur)
+}
+
+// quantile return an estimated quantile, interpolating between centroid centers
+func (d *tDigest) quantile(q float64) float64 {
+	d.compress()
+
+	if len(d.centroids) == 0 {
+		return 0
+	}
+	if q <= 0 {
+		return d.min
+	}
+	if len(d.centroids) == 1 {
+		return d.centroids[0].mean
+	}
+	if q >= 1 {
+		return d.max
+	}
+
+	rank := q * d.count
+	center := d.centroids[0].count / 2
+	if rank < center {
+		return d.min + (d.centroids[0].mean-d.min)*rank/center
+	}
+
+	for i := 1; i < len(d.centroids); i++ {
+		next := center + (d.centroids[i-1].count+d.centroids[i].count)/2
+		if rank < next {
+			a := d.centroids[i-1].mean
+			b := d.centroids[i].mean
+			return a + (b-a)*(rank-center)/(next-center)
+		}
+		center = next
+	}
+
+	last := d.centroids[len(d.centroids)-1]
+	return last.mean + (d.max-last.mean)*(rank-center)/(d.count-center)
+}
@@ -0,0 +1,55 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package storage interface for metric data storage
+package storage
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestQuantiles(t *testing.T) {
+	var q Quantiles
+
+	// small buckets are exact
+	for _, v := range []float64{5, 1, 4, 2, 3} {
+		q.Add(v)
+	}
+	res := q.Percentiles([]float64{0, 25, 50, 90, 100})
+	expected := []float64{1, 2, 3, 4.6, 5}
+	for i, p := range res {
+		if math.Abs(p.Value-expected[i]) > 1e-9 {
+			t.Errorf("percentile %v: expected %v, got %v", p.Quantile, expected[i], p.Value)
+		}
+	}
+
+	// large buckets are estimated, a uniform distribution of 0..n-1
+	q.Reset()
+	n := 100000
+	for _, i := range rand.New(rand.NewSource(1)).Perm(n) {
+		q.Add(float64(i))
+	}
+	if q.digest == nil {
+		t.Fatalf("expected a large bucket to use a t-digest")
+	}
+	for _, p := range q.Percentiles([]float64{1, 50, 90, 99, 99.9}) {
+		exact := p.Quantile / 100 * float64(n-1)
+		if math.Abs(p.Value-exact) > 0.005*float64(n) {
+			t.Errorf("percentile %v: expected about %v, got %v", p.Quantile, exact, p.Value)
+		}
+	}
+}
@@ -0,0 +1,375 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package queue on disk queues of writes to a storage plugin
+//
+// Composite storage plugins write to more than one storage, a write that
+// failed on a storage is queued in a file, and retried in order until the
+// storage accepts it. A write that can never succeed, e.g. a duplicate
+// point, is dropped and saved in a ".failed" file next to the queue file,
+// a batch is first split so only its failing points are dropped.
+package queue
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/MohawkTSDB/mohawk/src/storage"
+)
+
+// op names
+const (
+	OpPostRawData   = "post-raw-data"
+	OpPostBatchData = "post-batch-data"
+	OpPutTags       = "put-tags"
+	OpDeleteData    = "delete-data"
+	OpDeleteTags    = "delete-tags"
+)
+
+// Op one write request, stored as one json line in a queue file
+type Op struct {
+	Op     string              `json:"op"`
+	Tenant string              `json:"tenant"`
+	ID     string              `json:"id,omitempty"`
+	T      int64               `json:"t,omitempty"`
+	V      float64             `json:"v,omitempty"`
+	Items  []storage.BatchItem `json:"items,omitempty"`
+	Tags   map[string]string   `json:"tags,omitempty"`
+	Keys   []string            `json:"keys,omitempty"`
+	End    int64               `json:"end,omitempty"`
+	Start  int64               `json:"start,omitempty"`
+}
+
+// Do do a write request on a storage
+func (o Op) Do(s storage.Storage) error {
+	var err error
+
+	switch o.Op {
+	case OpPostRawData:
+		err = s.PostRawData(o.Tenant, o.ID, o.T, o.V)
+	case OpPostBatchData:
+		err = s.PostBatchData(o.Tenant, o.Items)
+	case OpPutTags:
+		err = s.PutTags(o.Tenant, o.ID, o.Tags)
+	case OpDeleteData:
+		err = s.DeleteData(o.Tenant, o.ID, o.End, o.Start)
+	case OpDeleteTags:
+		err = s.DeleteTags(o.Tenant, o.ID, o.Keys)
+	default:
+		err = fmt.Errorf("queue: Unknown op %s", o.Op)
+	}
+
+	return err
+}
+
+// split split a batch write into one write per point, other writes are
+// not split
+func (o Op) split() []Op {
+	var ops []Op
+
+	if o.Op != OpPostBatchData {
+		return []Op{o}
+	}
+	for _, item := range o.Items {
+		for _, d := range item.Data {
+			ops = append(ops, Op{
+				Op:     OpPostBatchData,
+				Tenant: o.Tenant,
+				Items:  []storage.BatchItem{{ID: item.ID, Data: []storage.DataItem{d}}},
+			})
+		}
+	}
+
+	return ops
+}
+
+// Queue the writes waiting for a storage, while writes are queued new
+// writes are queued after them, the storage is called without holding the
+// queue lock
+type Queue struct {
+	s          storage.Storage
+	fileName   string
+	file       *os.File
+	mutex      sync.Mutex
+	retryMutex sync.Mutex
+	pending    []Op
+}
+
+// Open create a queue of writes to a storage, and load the writes queued
+// in the queue file
+func Open(s storage.Storage, fileName string) (*Queue, error) {
+	q := &Queue{s: s, fileName: fileName}
+
+	f, err := os.Open(fileName)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// a partly written last line is dropped, it was never acknowledged
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var o Op
+		if err = json.Unmarshal(scanner.Bytes(), &o); err != nil {
+			log.Printf("queue: %s: skip bad queued write: %s\n", fileName, err)
+			continue
+		}
+		q.pending = append(q.pending, o)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// Write apply a write to the storage, or queue it if the storage failed or
+// writes are already queued, a not found error is returned and not queued
+func (q *Queue) Write(o Op) error {
+	if q.Len() == 0 {
+		rest, err := q.do(o)
+		if err == nil || storage.IsNotFound(err) {
+			return err
+		}
+		log.Printf("queue: %s: queue write: %s\n", q.s.Name(), err)
+		if rest != nil {
+			return q.enqueue(rest...)
+		}
+	}
+
+	return q.enqueue(o)
+}
+
+// Retry apply queued writes in order, until a write fails, and return the
+// number of applied or dropped writes, deleting an unknown id is not an
+// error, and writes that fail permanently are dropped
+func (q *Queue) Retry() (int, error) {
+	q.retryMutex.Lock()
+	defer q.retryMutex.Unlock()
+
+	var err error
+
+	// only Retry removes writes, new writes are appended while the first
+	// write is applied
+	n := 0
+	changed := false
+	for {
+		q.mutex.Lock()
+		if len(q.pending) == 0 {
+			q.mutex.Unlock()
+			break
+		}
+		o := q.pending[0]
+		q.mutex.Unlock()
+
+		var rest []Op
+		rest, err = q.do(o)
+		if err != nil && !storage.IsNotFound(err) {
+			// a split batch keeps only the writes left to apply
+			if rest != nil {
+				q.mutex.Lock()
+				q.pending = append(rest, q.pending[1:]...)
+				q.mutex.Unlock()
+				changed = true
+			}
+			break
+		}
+		err = nil
+
+		q.mutex.Lock()
+		q.pending = q.pending[1:]
+		q.mutex.Unlock()
+		changed = true
+		n++
+	}
+	if !changed {
+		return 0, err
+	}
+
+	q.mutex.Lock()
+	errWrite := q.writeQueue()
+	q.mutex.Unlock()
+	if errWrite != nil {
+		return n, errWrite
+	}
+
+	return n, err
+}
+
+// Len return the number of queued writes
+func (q *Queue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return len(q.pending)
+}
+
+// Name return the name of the storage
+func (q *Queue) Name() string {
+	return q.s.Name()
+}
+
+// Close close the queue file, queued writes are loaded by the next Open
+func (q *Queue) Close() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.closeFile()
+}
+
+// do apply a write, a batch that failed permanently, e.g. on a duplicate
+// point, is split into one write per point, and only the points that fail
+// permanently are dropped, on error do return the writes of a split batch
+// left to apply
+func (q *Queue) do(o Op) ([]Op, error) {
+	err := o.Do(q.s)
+	if err == nil || !storage.IsPermanent(err) {
+		return nil, err
+	}
+
+	ops := o.split()
+	if len(ops) <= 1 {
+		return nil, q.drop(o, err)
+	}
+	for i, p := range ops {
+		err = p.Do(q.s)
+		if err != nil && storage.IsPermanent(err) {
+			err = q.drop(p, err)
+		}
+		if err != nil && !storage.IsNotFound(err) {
+			return ops[i:], err
+		}
+	}
+
+	return nil, nil
+}
+
+// enqueue append writes to the queue file, the file is kept open while
+// writes are queued
+func (q *Queue) enqueue(ops ...Op) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.file == nil {
+		var err error
+		if q.file, err = os.OpenFile(q.fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+			return err
+		}
+	}
+
+	for _, o := range ops {
+		b, err := json.Marshal(o)
+		if err != nil {
+			return err
+		}
+		if _, err = q.file.Write(append(b, '\n')); err != nil {
+			return err
+		}
+	}
+
+	// a queued write was acknowledged, it must survive a crash
+	if err := q.file.Sync(); err != nil {
+		return err
+	}
+
+	q.pending = append(q.pending, ops...)
+
+	return nil
+}
+
+// drop save a write that failed permanently in the failed writes file
+func (q *Queue) drop(o Op, cause error) error {
+	log.Printf("queue: %s: drop write %s of %s: %s\n", q.s.Name(), o.Op, o.ID, cause)
+
+	b, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(q.fileName+".failed", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// closeFile close the queue file if it is open
+func (q *Queue) closeFile() error {
+	if q.file == nil {
+		return nil
+	}
+
+	err := q.file.Close()
+	q.file = nil
+
+	return err
+}
+
+// writeQueue replace the queue file with the pending writes
+func (q *Queue) writeQueue() error {
+	// the open file is replaced, later writes open the new file
+	if err := q.closeFile(); err != nil {
+		return err
+	}
+
+	if len(q.pending) == 0 {
+		err := os.Remove(q.fileName)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	tmpName := q.fileName + ".tmp"
+	f, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, o := range q.pending {
+		b, err := json.Marshal(o)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(append(b, '\n'))
+	}
+	if err = w.Flush(); err == nil {
+		err = f.Sync()
+	}
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	return os.Rename(tmpName, q.fileName)
+}
@@ -0,0 +1,202 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package queue on disk queues of writes to a storage plugin
+package queue
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MohawkTSDB/mohawk/src/storage"
+	"github.com/MohawkTSDB/mohawk/src/storage/memory"
+)
+
+// testStorage a memory storage that fails writes while down, rejects
+// points of the "dup" id as duplicates, and waits for block while posting
+type testStorage struct {
+	memory.Storage
+	down  bool
+	block chan struct{}
+}
+
+func (r *testStorage) PostRawData(tenant string, id string, t int64, v float64) error {
+	if r.block != nil {
+		<-r.block
+	}
+	if r.down {
+		return errors.New("test: down")
+	}
+	if id == "dup" {
+		return storage.ConflictError{ID: id, Timestamp: t}
+	}
+
+	return r.Storage.PostRawData(tenant, id, t, v)
+}
+
+// PostBatchData reject the whole batch if one of its points is a duplicate
+func (r *testStorage) PostBatchData(tenant string, items []storage.BatchItem) error {
+	if r.down {
+		return errors.New("test: down")
+	}
+	for _, item := range items {
+		if item.ID == "dup" && len(item.Data) > 0 {
+			return storage.ConflictError{ID: item.ID, Timestamp: item.Data[0].Timestamp}
+		}
+	}
+
+	return r.Storage.PostBatchData(tenant, items)
+}
+
+func TestRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mohawk-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := &testStorage{}
+	s.Open(url.Values{"granularity": {"1s"}})
+
+	fileName := filepath.Join(dir, "test.queue")
+	q, err := Open(s, fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	// writes are queued while the storage is down
+	now := time.Now().Unix() * 1000
+	s.down = true
+	for i, id := range []string{"cpu", "dup", "cpu"} {
+		if err = q.Write(Op{Op: OpPostRawData, Tenant: "tenant", ID: id, T: now - int64(i)*1000, V: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if q.Len() != 3 {
+		t.Fatalf("expected 3 queued writes, got %d", q.Len())
+	}
+
+	// a duplicate point fails permanently, it is dropped and does not block
+	// the writes after it
+	s.down = false
+	if n, err := q.Retry(); n != 3 || err != nil {
+		t.Errorf("expected 3 applied or dropped writes, got %d, %v", n, err)
+	}
+	if _, err = os.Stat(fileName); !os.IsNotExist(err) {
+		t.Errorf("expected the queue file to be removed, got %v", err)
+	}
+	res, err := s.GetRawData("tenant", "cpu", now+1, now-10000, 10, "ASC")
+	if err != nil || len(res) != 2 {
+		t.Errorf("unexpected points: %+v, %v", res, err)
+	}
+
+	// a permanent failure is not queued
+	if err = q.Write(Op{Op: OpPostRawData, Tenant: "tenant", ID: "dup", T: now, V: 1}); err != nil || q.Len() != 0 {
+		t.Errorf("expected a dropped write, got %d queued writes, %v", q.Len(), err)
+	}
+
+	b, err := ioutil.ReadFile(fileName + ".failed")
+	if err != nil || strings.Count(string(b), `"id":"dup"`) != 2 {
+		t.Errorf("unexpected failed writes file: %s, %v", b, err)
+	}
+}
+
+func TestSplitBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mohawk-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := &testStorage{}
+	s.Open(url.Values{"granularity": {"1s"}})
+
+	fileName := filepath.Join(dir, "test.queue")
+	q, err := Open(s, fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	now := time.Now().Unix() * 1000
+	o := Op{Op: OpPostBatchData, Tenant: "tenant", Items: []storage.BatchItem{
+		{ID: "cpu", Data: []storage.DataItem{{Timestamp: now - 1000, Value: 1}, {Timestamp: now, Value: 2}}},
+		{ID: "dup", Data: []storage.DataItem{{Timestamp: now, Value: 3}}},
+	}}
+
+	// a batch with a duplicate point is split, only the duplicate is dropped
+	for _, down := range []bool{false, true} {
+		s.down = down
+		if err = q.Write(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.down = false
+	if n, err := q.Retry(); n != 1 || err != nil || q.Len() != 0 {
+		t.Errorf("expected 1 applied write, got %d, %v, %d queued", n, err, q.Len())
+	}
+
+	res, err := s.GetRawData("tenant", "cpu", now+1, now-10000, 10, "ASC")
+	if err != nil || len(res) != 2 {
+		t.Errorf("unexpected points: %+v, %v", res, err)
+	}
+	b, err := ioutil.ReadFile(fileName + ".failed")
+	if err != nil || strings.Count(string(b), `"id":"dup"`) != 2 || strings.Contains(string(b), `"id":"cpu"`) {
+		t.Errorf("unexpected failed writes file: %s, %v", b, err)
+	}
+}
+
+func TestWriteUnlocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mohawk-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := &testStorage{block: make(chan struct{})}
+	s.Open(url.Values{"granularity": {"1s"}})
+
+	q, err := Open(s, filepath.Join(dir, "test.queue"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	// the queue is not locked while a write waits for the storage
+	done := make(chan error)
+	go func() {
+		done <- q.Write(Op{Op: OpPostRawData, Tenant: "tenant", ID: "cpu", T: time.Now().Unix() * 1000, V: 1})
+	}()
+
+	lenDone := make(chan int)
+	go func() { lenDone <- q.Len() }()
+	select {
+	case <-lenDone:
+	case <-time.After(10 * time.Second):
+		t.Error("the queue is locked while a write waits for the storage")
+	}
+
+	close(s.block)
+	if err = <-done; err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package storage interface for metric data storage
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Factory create a new storage plugin, the plugin is opened by the caller
+type Factory func() Storage
+
+var (
+	registryMutex sync.RWMutex
+	registry      = make(map[string]Factory)
+)
+
+// Register make a storage plugin available by name, plugins call it from
+// their init function, registering a name twice panics
+func Register(name string, factory Factory) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	if factory == nil {
+		panic("storage: Register factory is nil for " + name)
+	}
+	if _, ok := registry[name]; ok {
+		panic("storage: Register called twice for " + name)
+	}
+
+	registry[name] = factory
+}
+
+// New create a storage plugin by name
+func New(name string) (Storage, error) {
+	registryMutex.RLock()
+	factory, ok := registry[name]
+	registryMutex.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("storage: Can't find storage %s", name)
+	}
+
+	return factory(), nil
+}
+
+// Names return the sorted names of the registered storage plugins
+func Names() []string {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	res := make([]string, 0, len(registry))
+	for name := range registry {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+
+	return res
+}
@@ -0,0 +1,75 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package storage interface for metric data storage
+package storage
+
+import (
+	"net/url"
+	"testing"
+)
+
+// nopStorage a storage that does nothing
+type nopStorage struct {
+	Storage
+}
+
+func (r *nopStorage) Name() string {
+	return "Storage-Nop"
+}
+
+func (r *nopStorage) Open(options url.Values) error {
+	return nil
+}
+
+func TestRegistry(t *testing.T) {
+	Register("registry-test-b", func() Storage { return &nopStorage{} })
+	Register("registry-test-a", func() Storage { return &nopStorage{} })
+
+	// every call creates a new plugin
+	a, err := New("registry-test-a")
+	if err != nil || a.Name() != "Storage-Nop" {
+		t.Fatalf("unexpected plugin %v, %v", a, err)
+	}
+	if b, _ := New("registry-test-a"); a == b {
+		t.Error("expected a new plugin on each call")
+	}
+
+	if _, err = New("registry-test-unknown"); err == nil {
+		t.Error("expected an error for an unknown plugin")
+	}
+
+	names := Names()
+	i := 0
+	for _, name := range names {
+		if name == "registry-test-a" || name == "registry-test-b" {
+			if name != []string{"registry-test-a", "registry-test-b"}[i] {
+				t.Errorf("expected sorted names, got %v", names)
+			}
+			i++
+		}
+	}
+	if i != 2 {
+		t.Errorf("expected the registered names, got %v", names)
+	}
+
+	// registering a name twice panics
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic when registering a name twice")
+		}
+	}()
+	Register("registry-test-a", func() Storage { return &nopStorage{} })
+}
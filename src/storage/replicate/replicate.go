@@ -0,0 +1,400 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package replicate interface for replicated metric data storage
+package replicate
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MohawkTSDB/mohawk/src/storage"
+	"github.com/MohawkTSDB/mohawk/src/storage/queue"
+)
+
+// errNoFactory a new error with missing storage factory message
+var errNoFactory = errors.New("replicate: No storage factory, use NewStorage")
+
+// errNoBackends a new error with missing backends message
+var errNoBackends = errors.New("replicate: No backends")
+
+// Storage a composite storage, writes are forwarded to all the backends,
+// reads use the primary backend, and fail over to the other backends on
+// error
+type Storage struct {
+	newStorage       func(name string) (storage.Storage, error)
+	backends         []storage.Storage
+	names            []string
+	primary          int
+	queues           []*queue.Queue
+	queueDirName     string
+	retryIntervalSec int64
+	done             chan struct{}
+	stopped          chan struct{}
+	closeOnce        sync.Once
+}
+
+// NewStorage create a replicate storage, newStorage creates the backend
+// storage plugins by name
+func NewStorage(newStorage func(name string) (storage.Storage, error)) *Storage {
+	return &Storage{newStorage: newStorage}
+}
+
+func init() {
+	storage.Register("replicate", func() storage.Storage { return NewStorage(storage.New) })
+}
+
+// Storage functions
+// Required by storage interface
+
+// Name return a human readable storage name
+func (r *Storage) Name() string {
+	return "Storage-Replicate"
+}
+
+// Help return a human readable storage help message
+func (r *Storage) Help() string {
+	return `Replicate storage [replicate]:
+	backends       - comma separated list of backend storages, e.g. "memory,sqlite".
+	primary        - (optional) index of the backend used for reads (default 0).
+	queue-dirname  - (optional) a directory for queues of writes that failed on a secondary
+	                 backend (default "."), writes that can never succeed, e.g. duplicate points,
+	                 are dropped and saved in ".failed" files.
+	retry-interval - (optional) time between retries of queued writes (default "10s").
+	<index>.<option> - option of the backend at index, e.g. "1.db-dirname=/data".
+	Examples:
+		--options=backends=memory,sqlite&1.db-dirname=/data
+		--options=backends=sqlite,mongo&0.db-dirname=/data&1.db-url=mongodb://db:27017&queue-dirname=/queue`
+}
+
+// Open storage
+func (r *Storage) Open(options url.Values) error {
+	var err error
+
+	if r.newStorage == nil {
+		return errNoFactory
+	}
+
+	// get storage options
+	if backendsStr := options.Get("backends"); backendsStr != "" {
+		r.names = strings.Split(backendsStr, ",")
+	}
+	if len(r.names) == 0 {
+		return errNoBackends
+	}
+
+	if primaryStr := options.Get("primary"); primaryStr != "" {
+		if r.primary, err = strconv.Atoi(primaryStr); err != nil || r.primary < 0 || r.primary >= len(r.names) {
+			return fmt.Errorf("replicate: Bad primary %s", primaryStr)
+		}
+	}
+
+	r.queueDirName = options.Get("queue-dirname")
+	if r.queueDirName == "" {
+		r.queueDirName = "."
+	}
+
+	r.retryIntervalSec = 10
+	if intervalStr := options.Get("retry-interval"); intervalStr != "" {
+		if r.retryIntervalSec, err = storage.ParseDuration(intervalStr); err != nil || r.retryIntervalSec < 1 {
+			return fmt.Errorf("replicate: Bad retry interval %s", intervalStr)
+		}
+	}
+
+	if err = os.MkdirAll(r.queueDirName, 0755); err != nil {
+		return err
+	}
+
+	// create and open the backends, and load the queued writes of the secondaries
+	for i, name := range r.names {
+		s, err := r.openBackend(name, fmt.Sprintf("%d.", i), options)
+		if err != nil {
+			r.closeBackends()
+			return err
+		}
+		r.backends = append(r.backends, s)
+
+		if i == r.primary {
+			r.queues = append(r.queues, nil)
+			continue
+		}
+
+		q, err := queue.Open(s, filepath.Join(r.queueDirName, fmt.Sprintf("replicate-%d-%s.queue", i, name)))
+		if err != nil {
+			r.closeBackends()
+			return fmt.Errorf("replicate: %s: %s", name, err)
+		}
+		r.queues = append(r.queues, q)
+	}
+
+	// log init arguments
+	log.Printf("Start replicate storage:")
+	for i, s := range r.backends {
+		if i == r.primary {
+			log.Printf("  backend %d: %s (primary)", i, s.Name())
+			continue
+		}
+		log.Printf("  backend %d: %s (%d queued writes)", i, s.Name(), r.queues[i].Len())
+	}
+	log.Printf("  queue dirname: %+v", r.queueDirName)
+	log.Printf("  retry interval: %ds", r.retryIntervalSec)
+
+	// start a worker that will retry queued writes periodically
+	r.done = make(chan struct{})
+	r.stopped = make(chan struct{})
+	go r.retries()
+
+	return nil
+}
+
+// Close stop the retry worker, and close the queues and the backends
+func (r *Storage) Close() error {
+	var err error
+
+	r.closeOnce.Do(func() {
+		if r.done != nil {
+			close(r.done)
+			<-r.stopped
+		}
+
+		for _, q := range r.queues {
+			if q == nil {
+				continue
+			}
+			if errClose := q.Close(); err == nil {
+				err = errClose
+			}
+		}
+		if errClose := r.closeBackends(); err == nil {
+			err = errClose
+		}
+	})
+
+	return err
+}
+
+// Stats return the number of writes waiting for each secondary backend
+func (r *Storage) Stats() map[string]float64 {
+	res := map[string]float64{
+		"queuedWrites": 0,
+	}
+
+	for i, q := range r.queues {
+		if q == nil {
+			continue
+		}
+
+		n := float64(q.Len())
+		res[fmt.Sprintf("queuedWrites.%d", i)] = n
+		res["queuedWrites"] += n
+	}
+
+	return res
+}
+
+func (r *Storage) GetTenants() ([]storage.Tenant, error) {
+	var res []storage.Tenant
+
+	err := r.read(func(s storage.Storage) (err error) {
+		res, err = s.GetTenants()
+		return err
+	})
+
+	return res, err
+}
+
+func (r *Storage) GetItemList(tenant string, tags map[string]string) ([]storage.Item, error) {
+	var res []storage.Item
+
+	err := r.read(func(s storage.Storage) (err error) {
+		res, err = s.GetItemList(tenant, tags)
+		return err
+	})
+
+	return res, err
+}
+
+func (r *Storage) GetRawData(tenant string, id string, end int64, start int64, limit int64, order string) ([]storage.DataItem, error) {
+	var res []storage.DataItem
+
+	err := r.read(func(s storage.Storage) (err error) {
+		res, err = s.GetRawData(tenant, id, end, start, limit, order)
+		return err
+	})
+
+	return res, err
+}
+
+func (r *Storage) GetStatData(tenant string, id string, end int64, start int64, limit int64, order string, bucketDuration int64, percentiles []float64) ([]storage.StatItem, error) {
+	var res []storage.StatItem
+
+	err := r.read(func(s storage.Storage) (err error) {
+		res, err = s.GetStatData(tenant, id, end, start, limit, order, bucketDuration, percentiles)
+		return err
+	})
+
+	return res, err
+}
+
+// PostRawData handle posting data to db
+func (r *Storage) PostRawData(tenant string, id string, t int64, v float64) error {
+	return r.write(queue.Op{Op: queue.OpPostRawData, Tenant: tenant, ID: id, T: t, V: v})
+}
+
+// PostBatchData handle posting a batch of data points to db
+func (r *Storage) PostBatchData(tenant string, items []storage.BatchItem) error {
+	return r.write(queue.Op{Op: queue.OpPostBatchData, Tenant: tenant, Items: items})
+}
+
+// PutTags handle posting tags to db
+func (r *Storage) PutTags(tenant string, id string, tags map[string]string) error {
+	return r.write(queue.Op{Op: queue.OpPutTags, Tenant: tenant, ID: id, Tags: tags})
+}
+
+// DeleteData handle delete data fron db
+func (r *Storage) DeleteData(tenant string, id string, end int64, start int64) error {
+	return r.write(queue.Op{Op: queue.OpDeleteData, Tenant: tenant, ID: id, End: end, Start: start})
+}
+
+// DeleteTags handle delete tags fron db
+func (r *Storage) DeleteTags(tenant string, id string, tags []string) error {
+	return r.write(queue.Op{Op: queue.OpDeleteTags, Tenant: tenant, ID: id, Keys: tags})
+}
+
+// Helper functions
+// Not required by storage interface
+
+// read read from the primary backend, on error read from the other backends
+// in order, a not found error is a valid answer of a backend
+func (r *Storage) read(read func(s storage.Storage) error) error {
+	err := read(r.backends[r.primary])
+	if err == nil || storage.IsNotFound(err) {
+		return err
+	}
+	log.Printf("replicate: %s: read: %s\n", r.backends[r.primary].Name(), err)
+
+	for i, s := range r.backends {
+		if i == r.primary {
+			continue
+		}
+
+		errRead := read(s)
+		if errRead == nil || storage.IsNotFound(errRead) {
+			return errRead
+		}
+		log.Printf("replicate: %s: read: %s\n", s.Name(), errRead)
+	}
+
+	return err
+}
+
+// write write to the primary backend, and then to the secondary backends,
+// a write that failed on a secondary backend is queued for a retry
+func (r *Storage) write(o queue.Op) error {
+	err := o.Do(r.backends[r.primary])
+	if err != nil && !storage.IsNotFound(err) {
+		return err
+	}
+
+	for _, q := range r.queues {
+		if q == nil {
+			continue
+		}
+		if errQueue := q.Write(o); errQueue != nil && !storage.IsNotFound(errQueue) {
+			return fmt.Errorf("replicate: %s: Can't queue write: %s", q.Name(), errQueue)
+		}
+	}
+
+	return err
+}
+
+func (r *Storage) retries() {
+	defer close(r.stopped)
+
+	c := time.NewTicker(time.Duration(r.retryIntervalSec) * time.Second)
+	defer c.Stop()
+
+	for {
+		select {
+		case <-c.C:
+			r.retry()
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// retry apply the queued writes of all secondary backends
+func (r *Storage) retry() {
+	for _, q := range r.queues {
+		if q == nil || q.Len() == 0 {
+			continue
+		}
+
+		n, err := q.Retry()
+		if n > 0 {
+			log.Printf("replicate: %s: applied %d queued writes, %d left\n", q.Name(), n, q.Len())
+		}
+		if err != nil {
+			log.Printf("replicate: %s: retry: %s\n", q.Name(), err)
+		}
+	}
+}
+
+// openBackend create and open a backend storage, options starting with the
+// prefix are passed to the backend without the prefix
+func (r *Storage) openBackend(name string, prefix string, options url.Values) (storage.Storage, error) {
+	s, err := r.newStorage(name)
+	if err != nil {
+		return nil, err
+	}
+
+	backendOptions := url.Values{}
+	for k, v := range options {
+		if strings.HasPrefix(k, prefix) {
+			backendOptions[k[len(prefix):]] = v
+		}
+	}
+
+	if err = s.Open(backendOptions); err != nil {
+		return nil, fmt.Errorf("replicate: %s: %s", name, err)
+	}
+
+	return s, nil
+}
+
+// closeBackends close the backends that implement io.Closer
+func (r *Storage) closeBackends() error {
+	var err error
+
+	for _, s := range r.backends {
+		if c, ok := s.(io.Closer); ok {
+			if errClose := c.Close(); err == nil {
+				err = errClose
+			}
+		}
+	}
+
+	return err
+}
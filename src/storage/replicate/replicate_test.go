@@ -0,0 +1,194 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package replicate interface for replicated metric data storage
+package replicate
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MohawkTSDB/mohawk/src/storage"
+	"github.com/MohawkTSDB/mohawk/src/storage/memory"
+	"github.com/MohawkTSDB/mohawk/src/storage/queue"
+	"github.com/MohawkTSDB/mohawk/src/storage/storagetest"
+)
+
+var errDown = errors.New("storage is down")
+
+// minuteMili one minute in ms
+const minuteMili = int64(60 * 1000)
+
+func init() {
+	storage.Register("flaky", func() storage.Storage { return &flakyStorage{Storage: &memory.Storage{}} })
+}
+
+// flakyStorage a memory storage that fails all requests while down
+type flakyStorage struct {
+	*memory.Storage
+	down bool
+}
+
+func (r *flakyStorage) GetRawData(tenant string, id string, end int64, start int64, limit int64, order string) ([]storage.DataItem, error) {
+	if r.down {
+		return nil, errDown
+	}
+	return r.Storage.GetRawData(tenant, id, end, start, limit, order)
+}
+
+func (r *flakyStorage) PostRawData(tenant string, id string, t int64, v float64) error {
+	if r.down {
+		return errDown
+	}
+	return r.Storage.PostRawData(tenant, id, t, v)
+}
+
+func (r *flakyStorage) DeleteData(tenant string, id string, end int64, start int64) error {
+	if r.down {
+		return errDown
+	}
+	return r.Storage.DeleteData(tenant, id, end, start)
+}
+
+// openStorage open a replicate storage with queues in a directory
+func openStorage(t *testing.T, dir string, backends string) *Storage {
+	r := NewStorage(storage.New)
+	if err := r.Open(url.Values{"backends": {backends}, "queue-dirname": {dir}}); err != nil {
+		t.Fatal(err)
+	}
+
+	return r
+}
+
+func TestStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mohawk-replicate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := openStorage(t, dir, "memory,memory")
+	defer r.Close()
+
+	storagetest.Run(t, r)
+
+	// both backends hold the same data
+	for _, s := range r.backends {
+		items, err := s.GetItemList("storagetest-tags", map[string]string{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) == 0 {
+			t.Errorf("%s: expected replicated items", s.Name())
+		}
+	}
+}
+
+func TestQueuedWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mohawk-replicate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := openStorage(t, dir, "memory,flaky")
+	defer r.Close()
+	flaky := r.backends[1].(*flakyStorage)
+
+	base := time.Now().Unix()*1000 - 10*minuteMili
+	base -= base % minuteMili
+
+	// writes to a down replica are queued in order, a later write is queued
+	// even if the replica can handle it
+	flaky.down = true
+	for i := int64(0); i < 3; i++ {
+		if err = r.PostRawData("tenant", "cpu", base+i*minuteMili, float64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flaky.down = false
+	if err = r.DeleteData("tenant", "cpu", base+minuteMili+1, base+minuteMili); err != nil {
+		t.Fatal(err)
+	}
+	if n := r.Stats()["queuedWrites"]; n != 4 {
+		t.Fatalf("expected 4 queued writes, got %v", n)
+	}
+
+	// the queue survives a restart
+	q, err := queue.Open(flaky, filepath.Join(dir, "replicate-1-flaky.queue"))
+	if err != nil || q.Len() != 4 {
+		t.Fatalf("expected 4 queued writes in file, got %d, %v", q.Len(), err)
+	}
+
+	r.retry()
+	if n := r.Stats()["queuedWrites"]; n != 0 {
+		t.Errorf("expected no queued writes after retry, got %v", n)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "replicate-1-flaky.queue")); !os.IsNotExist(err) {
+		t.Errorf("expected the queue file to be removed, got %v", err)
+	}
+
+	res, err := flaky.GetRawData("tenant", "cpu", base+10*minuteMili, base, 10, "ASC")
+	if err != nil || len(res) != 2 || res[0].Value != 0 || res[1].Value != 2 {
+		t.Errorf("unexpected replica points: %+v, %v", res, err)
+	}
+}
+
+func TestReadFailover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mohawk-replicate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := openStorage(t, dir, "flaky,memory")
+	defer r.Close()
+
+	now := time.Now().Unix() * 1000
+
+	if err = r.PostRawData("tenant", "cpu", now-2*minuteMili, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// a down primary fails writes, and reads use the secondary
+	r.backends[0].(*flakyStorage).down = true
+	if err = r.PostRawData("tenant", "cpu", now-minuteMili, 2); err != errDown {
+		t.Errorf("expected a primary write error, got %v", err)
+	}
+
+	res, err := r.GetRawData("tenant", "cpu", now, now-10*minuteMili, 10, "ASC")
+	if err != nil || len(res) != 1 || res[0].Value != 1 {
+		t.Errorf("unexpected failover points: %+v, %v", res, err)
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	for _, options := range []url.Values{
+		{},
+		{"backends": {"memory"}, "primary": {"1"}},
+		{"backends": {"memory"}, "retry-interval": {"0"}},
+		{"backends": {"memory"}, "retry-interval": {"1x"}},
+	} {
+		r := NewStorage(storage.New)
+		if err := r.Open(options); err == nil {
+			t.Errorf("%v: expected an error", options)
+		}
+	}
+}
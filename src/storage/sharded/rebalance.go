@@ -0,0 +1,172 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sharded interface for hash sharded metric data storage
+package sharded
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"time"
+
+	"github.com/MohawkTSDB/mohawk/src/storage"
+)
+
+// rebalancePageSize max number of points moved in one batch
+const rebalancePageSize = 10000
+
+// Rebalance move the series of a sharded storage to their shards after the
+// number of shards changed, fromShards is the number of shards before the
+// change, and return the number of moved series
+func Rebalance(newStorage func(name string) (storage.Storage, error), options url.Values, fromShards int) (int, error) {
+	r := NewStorage(newStorage)
+	if err := r.open(options, fromShards); err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	return r.rebalance()
+}
+
+// rebalance move series that are not in their shard
+func (r *Storage) rebalance() (int, error) {
+	moved := 0
+
+	for i, s := range r.backends {
+		tenants, err := s.GetTenants()
+		if err != nil {
+			return moved, err
+		}
+
+		for _, t := range tenants {
+			items, err := s.GetItemList(t.ID, map[string]string{})
+			if err != nil {
+				return moved, err
+			}
+
+			for _, item := range items {
+				to := r.ring.shard(t.ID, item.ID)
+				if to == i {
+					continue
+				}
+
+				ok, err := moveSeries(s, r.backends[to], t.ID, item)
+				if err != nil {
+					return moved, fmt.Errorf("sharded: Can't move %s@%s from shard %d to %d: %s", item.ID, t.ID, i, to, err)
+				}
+				if ok {
+					log.Printf("sharded: moved %s@%s from shard %d to %d\n", item.ID, t.ID, i, to)
+					moved++
+				}
+			}
+		}
+	}
+
+	return moved, nil
+}
+
+// moveSeries copy the points and tags of a series to another storage, and
+// delete them from the source storage, return false if the series was empty,
+// points already in the destination storage are not copied again, so an
+// interrupted rebalance can run again
+func moveSeries(from storage.Storage, to storage.Storage, tenant string, item storage.Item) (bool, error) {
+	// posted points may be in the future, move points up to a year ahead, or
+	// up to the last point of the series
+	end := (time.Now().Unix() + 365*24*60*60) * 1000
+	if len(item.LastValues) > 0 && item.LastValues[0].Timestamp >= end {
+		end = item.LastValues[0].Timestamp + 1
+	}
+
+	n := 0
+	for start := int64(0); start < end; {
+		data, err := from.GetRawData(tenant, item.ID, end, start, rebalancePageSize, "ASC")
+		if storage.IsNotFound(err) {
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+		if len(data) == 0 {
+			break
+		}
+
+		n += len(data)
+		start = data[len(data)-1].Timestamp + 1
+
+		if data, err = newPoints(to, tenant, item.ID, data); err != nil {
+			return false, err
+		}
+		if len(data) == 0 {
+			continue
+		}
+		if err = to.PostBatchData(tenant, []storage.BatchItem{{ID: item.ID, Data: data}}); err != nil {
+			return false, err
+		}
+	}
+
+	if len(item.Tags) > 0 {
+		if err := to.PutTags(tenant, item.ID, item.Tags); err != nil {
+			return false, err
+		}
+	}
+	if n == 0 && len(item.Tags) == 0 {
+		return false, nil
+	}
+
+	// the series is left in the source storage without points and tags,
+	// the sharded storage does not list it
+	if err := from.DeleteData(tenant, item.ID, end, 0); err != nil && !storage.IsNotFound(err) {
+		return true, err
+	}
+	if len(item.Tags) > 0 {
+		keys := make([]string, 0, len(item.Tags))
+		for k := range item.Tags {
+			keys = append(keys, k)
+		}
+		if err := from.DeleteTags(tenant, item.ID, keys); err != nil && !storage.IsNotFound(err) {
+			return true, err
+		}
+	}
+
+	return true, nil
+}
+
+// newPoints return the points of a page of ascending points that are not in
+// a storage
+func newPoints(s storage.Storage, tenant string, id string, data []storage.DataItem) ([]storage.DataItem, error) {
+	existing, err := s.GetRawData(tenant, id, data[len(data)-1].Timestamp+1, data[0].Timestamp, math.MaxInt32, "ASC")
+	if storage.IsNotFound(err) || len(existing) == 0 {
+		return data, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[int64]bool, len(existing))
+	for _, d := range existing {
+		found[d.Timestamp] = true
+	}
+
+	res := make([]storage.DataItem, 0, len(data))
+	for _, d := range data {
+		if !found[d.Timestamp] {
+			res = append(res, d)
+		}
+	}
+
+	return res, nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sharded interface for hash sharded metric data storage
+package sharded
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// ringReplicas number of points of one shard on the hash ring
+const ringReplicas = 160
+
+// ring a consistent hash ring, when the number of shards changes only the
+// series of added or removed shards move
+type ring struct {
+	hashes []uint64
+	shards []int
+}
+
+// ringPoint one point of a shard on the hash ring
+type ringPoint struct {
+	hash  uint64
+	shard int
+}
+
+// newRing create a hash ring of n shards
+func newRing(n int) *ring {
+	points := make([]ringPoint, 0, n*ringReplicas)
+	for shard := 0; shard < n; shard++ {
+		for i := 0; i < ringReplicas; i++ {
+			key := strconv.Itoa(shard) + "-" + strconv.Itoa(i)
+			points = append(points, ringPoint{hash: hashKey(key), shard: shard})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash == points[j].hash {
+			return points[i].shard < points[j].shard
+		}
+		return points[i].hash < points[j].hash
+	})
+
+	r := &ring{
+		hashes: make([]uint64, len(points)),
+		shards: make([]int, len(points)),
+	}
+	for i, p := range points {
+		r.hashes[i] = p.hash
+		r.shards[i] = p.shard
+	}
+
+	return r
+}
+
+// shard return the shard of a series, the first ring point after the
+// series hash
+func (r *ring) shard(tenant string, id string) int {
+	h := hashKey(tenant + "\x00" + id)
+
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+
+	return r.shards[i]
+}
+
+// hashKey return a 64 bit hash of a key, the fnv hash is mixed so short
+// keys that differ in one char spread over the ring
+func hashKey(key string) uint64 {
+	f := fnv.New64a()
+	f.Write([]byte(key))
+	h := f.Sum64()
+
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+
+	return h
+}
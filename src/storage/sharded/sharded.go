@@ -0,0 +1,308 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sharded interface for hash sharded metric data storage
+package sharded
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/MohawkTSDB/mohawk/src/storage"
+)
+
+// errNoFactory a new error with missing storage factory message
+var errNoFactory = errors.New("sharded: No storage factory, use NewStorage")
+
+// locationOptions backend options that set where a backend stores its data
+var locationOptions = []string{"db-dirname", "db-url", "snapshot-dir", "wal-dir"}
+
+// Storage a composite storage, series are distributed across a number of
+// backend storages by consistent hashing of the tenant and id
+type Storage struct {
+	newStorage  func(name string) (storage.Storage, error)
+	backendName string
+	backends    []storage.Storage
+	ring        *ring
+	closeOnce   sync.Once
+}
+
+// NewStorage create a sharded storage, newStorage creates the backend
+// storage plugins by name
+func NewStorage(newStorage func(name string) (storage.Storage, error)) *Storage {
+	return &Storage{newStorage: newStorage}
+}
+
+func init() {
+	storage.Register("sharded", func() storage.Storage { return NewStorage(storage.New) })
+}
+
+// Storage functions
+// Required by storage interface
+
+// Name return a human readable storage name
+func (r *Storage) Name() string {
+	return "Storage-Sharded"
+}
+
+// Help return a human readable storage help message
+func (r *Storage) Help() string {
+	return `Sharded storage [sharded]:
+	backend          - (optional) storage of each shard (default "sqlite").
+	shards           - (optional) number of shards (default 2), use "mohawk rebalance"
+	                   to move the series after changing the number of shards.
+	backend.<option> - option of all shards, "{shard}" is replaced by the shard index.
+	<index>.<option> - option of the shard at index.
+	A shard without a db-dirname, db-url, snapshot-dir or wal-dir option stores in the
+	"shard-<index>" directory, shards must not use the same options.
+	Examples:
+		--options=shards=4&backend.db-dirname=/data/shard-{shard}
+		--options=backend=mongo&0.db-url=mongodb://db0:27017&1.db-url=mongodb://db1:27017`
+}
+
+// Open storage
+func (r *Storage) Open(options url.Values) error {
+	return r.open(options, 0)
+}
+
+// Close close the shards
+func (r *Storage) Close() error {
+	var err error
+
+	r.closeOnce.Do(func() {
+		err = r.closeBackends()
+	})
+
+	return err
+}
+
+func (r *Storage) GetTenants() ([]storage.Tenant, error) {
+	res := make([]storage.Tenant, 0)
+	found := make(map[string]bool)
+
+	for _, s := range r.backends {
+		tenants, err := s.GetTenants()
+		if err != nil {
+			return res, err
+		}
+		for _, t := range tenants {
+			if !found[t.ID] {
+				found[t.ID] = true
+				res = append(res, t)
+			}
+		}
+	}
+
+	return res, nil
+}
+
+func (r *Storage) GetItemList(tenant string, tags map[string]string) ([]storage.Item, error) {
+	res := make([]storage.Item, 0)
+
+	// a shard lists only the series it owns, series left in a shard before
+	// a rebalance are not listed
+	for i, s := range r.backends {
+		items, err := s.GetItemList(tenant, tags)
+		if err != nil {
+			return res, err
+		}
+		for _, item := range items {
+			if r.ring.shard(tenant, item.ID) == i {
+				res = append(res, item)
+			}
+		}
+	}
+
+	return res, nil
+}
+
+func (r *Storage) GetRawData(tenant string, id string, end int64, start int64, limit int64, order string) ([]storage.DataItem, error) {
+	return r.shard(tenant, id).GetRawData(tenant, id, end, start, limit, order)
+}
+
+func (r *Storage) GetStatData(tenant string, id string, end int64, start int64, limit int64, order string, bucketDuration int64, percentiles []float64) ([]storage.StatItem, error) {
+	return r.shard(tenant, id).GetStatData(tenant, id, end, start, limit, order, bucketDuration, percentiles)
+}
+
+// PostRawData handle posting data to db
+func (r *Storage) PostRawData(tenant string, id string, t int64, v float64) error {
+	return r.shard(tenant, id).PostRawData(tenant, id, t, v)
+}
+
+// PostBatchData handle posting a batch of data points to db
+func (r *Storage) PostBatchData(tenant string, items []storage.BatchItem) error {
+	// split the batch by shard, keeping the order of the items
+	batches := make([][]storage.BatchItem, len(r.backends))
+	for _, item := range items {
+		i := r.ring.shard(tenant, item.ID)
+		batches[i] = append(batches[i], item)
+	}
+
+	for i, batch := range batches {
+		if len(batch) == 0 {
+			continue
+		}
+		if err := r.backends[i].PostBatchData(tenant, batch); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PutTags handle posting tags to db
+func (r *Storage) PutTags(tenant string, id string, tags map[string]string) error {
+	return r.shard(tenant, id).PutTags(tenant, id, tags)
+}
+
+// DeleteData handle delete data fron db
+func (r *Storage) DeleteData(tenant string, id string, end int64, start int64) error {
+	return r.shard(tenant, id).DeleteData(tenant, id, end, start)
+}
+
+// DeleteTags handle delete tags fron db
+func (r *Storage) DeleteTags(tenant string, id string, tags []string) error {
+	return r.shard(tenant, id).DeleteTags(tenant, id, tags)
+}
+
+// Helper functions
+// Not required by storage interface
+
+// open open the shards, and at least minBackends backends, backends that
+// are not shards hold series that need a rebalance
+func (r *Storage) open(options url.Values, minBackends int) error {
+	if r.newStorage == nil {
+		return errNoFactory
+	}
+
+	// get storage options
+	r.backendName = options.Get("backend")
+	if r.backendName == "" {
+		r.backendName = "sqlite"
+	}
+
+	shards := 2
+	if shardsStr := options.Get("shards"); shardsStr != "" {
+		var err error
+		if shards, err = strconv.Atoi(shardsStr); err != nil || shards < 1 {
+			return fmt.Errorf("sharded: Bad number of shards %s", shardsStr)
+		}
+	}
+	r.ring = newRing(shards)
+
+	// create and open the backends
+	n := shards
+	if minBackends > n {
+		n = minBackends
+	}
+	opts := make([]url.Values, n)
+	for i := range opts {
+		opts[i] = backendOptions(i, options)
+		for j := 0; j < i; j++ {
+			if reflect.DeepEqual(opts[i], opts[j]) {
+				return fmt.Errorf("sharded: Shards %d and %d use the same options, use {shard} in an option", j, i)
+			}
+		}
+	}
+	for i := 0; i < n; i++ {
+		s, err := r.openBackend(i, opts[i])
+		if err != nil {
+			r.closeBackends()
+			return err
+		}
+		r.backends = append(r.backends, s)
+	}
+
+	// log init arguments
+	log.Printf("Start sharded storage:")
+	log.Printf("  backend: %s", r.backendName)
+	log.Printf("  shards: %d", shards)
+
+	return nil
+}
+
+// shard return the backend of a series
+func (r *Storage) shard(tenant string, id string) storage.Storage {
+	return r.backends[r.ring.shard(tenant, id)]
+}
+
+// backendOptions return the options of a shard, options starting with
+// "backend." are passed to all shards, and options starting with the shard
+// index are passed to the shard
+func backendOptions(i int, options url.Values) url.Values {
+	index := strconv.Itoa(i)
+	res := url.Values{}
+	for k, v := range options {
+		if strings.HasPrefix(k, "backend.") {
+			values := make([]string, len(v))
+			for j := range v {
+				values[j] = strings.Replace(v[j], "{shard}", index, -1)
+			}
+			res[k[len("backend."):]] = values
+		}
+	}
+	for k, v := range options {
+		if strings.HasPrefix(k, index+".") {
+			res[k[len(index)+1:]] = v
+		}
+	}
+
+	// a shard without a location stores in its own directory
+	for _, k := range locationOptions {
+		if res.Get(k) != "" {
+			return res
+		}
+	}
+	res.Set("db-dirname", filepath.Join(".", "shard-"+index))
+
+	return res
+}
+
+// openBackend create and open the backend of a shard
+func (r *Storage) openBackend(i int, options url.Values) (storage.Storage, error) {
+	s, err := r.newStorage(r.backendName)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = s.Open(options); err != nil {
+		return nil, fmt.Errorf("sharded: shard %d: %s", i, err)
+	}
+
+	return s, nil
+}
+
+// closeBackends close the backends that implement io.Closer
+func (r *Storage) closeBackends() error {
+	var err error
+
+	for _, s := range r.backends {
+		if c, ok := s.(io.Closer); ok {
+			if errClose := c.Close(); err == nil {
+				err = errClose
+			}
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,273 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sharded interface for hash sharded metric data storage
+package sharded
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MohawkTSDB/mohawk/src/storage"
+	_ "github.com/MohawkTSDB/mohawk/src/storage/file"
+	_ "github.com/MohawkTSDB/mohawk/src/storage/sqlite"
+	"github.com/MohawkTSDB/mohawk/src/storage/storagetest"
+)
+
+// shardOptions return the options of a sharded file storage in a directory
+func shardOptions(dir string, shards int) url.Values {
+	return url.Values{
+		"backend":            {"file"},
+		"shards":             {fmt.Sprintf("%d", shards)},
+		"backend.db-dirname": {filepath.Join(dir, "shard-{shard}")},
+	}
+}
+
+// openStorage open a sharded file storage in a directory
+func openStorage(t *testing.T, dir string, shards int) *Storage {
+	r := NewStorage(storage.New)
+	if err := r.Open(shardOptions(dir, shards)); err != nil {
+		t.Fatal(err)
+	}
+
+	return r
+}
+
+func TestStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mohawk-sharded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := openStorage(t, dir, 3)
+	defer r.Close()
+
+	storagetest.Run(t, r)
+}
+
+func TestRing(t *testing.T) {
+	before := newRing(4)
+	after := newRing(5)
+
+	// series are spread over the shards, and adding a shard only moves
+	// series to the new shard
+	count := make([]int, 5)
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		id := fmt.Sprintf("cpu-%d", i)
+		from, to := before.shard("tenant", id), after.shard("tenant", id)
+		count[to]++
+		if from != to {
+			moved++
+			if to != 4 {
+				t.Fatalf("series %s moved from shard %d to an old shard %d", id, from, to)
+			}
+		}
+	}
+
+	for i, n := range count {
+		if n < 1000 || n > 3000 {
+			t.Errorf("unbalanced shard %d: %d series", i, n)
+		}
+	}
+	if moved < 1000 || moved > 3000 {
+		t.Errorf("expected about a fifth of the series to move, got %d", moved)
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mohawk-sharded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := openStorage(t, dir, 2)
+	for i := 0; i < 50; i++ {
+		id := fmt.Sprintf("cpu-%d", i)
+		if err = r.PostRawData("tenant", id, 1000, float64(i)); err != nil {
+			t.Fatal(err)
+		}
+		if err = r.PutTags("tenant", id, map[string]string{"n": fmt.Sprintf("%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.Close()
+
+	// grow from 2 to 3 shards, and shrink from 3 to 1 shard
+	for _, c := range []struct{ from, to int }{{2, 3}, {3, 1}} {
+		moved, err := Rebalance(storage.New, shardOptions(dir, c.to), c.from)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if moved == 0 || moved == 50 {
+			t.Errorf("%d to %d shards: unexpected number of moved series %d", c.from, c.to, moved)
+		}
+
+		r = openStorage(t, dir, c.to)
+		items, err := r.GetItemList("tenant", map[string]string{})
+		if err != nil || len(items) != 50 {
+			t.Errorf("%d to %d shards: expected 50 items, got %d, %v", c.from, c.to, len(items), err)
+		}
+		for i := 0; i < 50; i++ {
+			id := fmt.Sprintf("cpu-%d", i)
+			res, err := r.GetRawData("tenant", id, 2000, 0, 10, "ASC")
+			if err != nil || len(res) != 1 || res[0].Value != float64(i) {
+				t.Errorf("%d to %d shards: %s: unexpected points %+v, %v", c.from, c.to, id, res, err)
+			}
+		}
+		r.Close()
+	}
+}
+
+func TestRebalanceAgain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mohawk-sharded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	options := url.Values{"backend": {"sqlite"}, "backend.db-dirname": {filepath.Join(dir, "shard-{shard}")}}
+	for _, shard := range []string{"shard-0", "shard-1"} {
+		if err = os.Mkdir(filepath.Join(dir, shard), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	options.Set("shards", "1")
+	r := NewStorage(storage.New)
+	if err = r.Open(options); err != nil {
+		t.Fatal(err)
+	}
+
+	// points in the past and years ahead
+	future := (time.Now().Unix() + 3*365*24*60*60) * 1000
+	for i := 0; i < 20; i++ {
+		id := fmt.Sprintf("cpu-%d", i)
+		data := []storage.DataItem{{Timestamp: 1000, Value: 1}, {Timestamp: future, Value: 2}}
+		if err = r.PostBatchData("tenant", []storage.BatchItem{{ID: id, Data: data}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.Close()
+
+	// an interrupted rebalance copied the points of a series, and did not
+	// delete them from the source shard
+	options.Set("shards", "2")
+	r = NewStorage(storage.New)
+	if err = r.open(options, 1); err != nil {
+		t.Fatal(err)
+	}
+	copied := ""
+	for i := 0; i < 20 && copied == ""; i++ {
+		id := fmt.Sprintf("cpu-%d", i)
+		if r.ring.shard("tenant", id) == 1 {
+			copied = id
+			data, _ := r.backends[0].GetRawData("tenant", id, future+1, 0, 10, "ASC")
+			if err = r.backends[1].PostBatchData("tenant", []storage.BatchItem{{ID: id, Data: data}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	r.Close()
+
+	if _, err = Rebalance(storage.New, options, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	r = NewStorage(storage.New)
+	if err = r.Open(options); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for i := 0; i < 20; i++ {
+		id := fmt.Sprintf("cpu-%d", i)
+		res, err := r.GetRawData("tenant", id, future+1, 0, 10, "ASC")
+		if err != nil || len(res) != 2 || res[1].Timestamp != future {
+			t.Errorf("%s: unexpected points %+v, %v", id, res, err)
+		}
+	}
+	for i, s := range r.backends {
+		items, _ := s.GetItemList("tenant", map[string]string{})
+		for _, item := range items {
+			if r.ring.shard("tenant", item.ID) != i && len(item.LastValues) > 0 {
+				t.Errorf("%s: points left in shard %d", item.ID, i)
+			}
+		}
+	}
+	if copied == "" {
+		t.Errorf("no series moved to the new shard")
+	}
+}
+
+func TestBackendOptions(t *testing.T) {
+	// a shard without a location stores in its own directory
+	for i, dir := range []string{"shard-0", "shard-1"} {
+		if o := backendOptions(i, url.Values{"backend.max-open-tenants": {"8"}}); o.Get("db-dirname") != dir || o.Get("max-open-tenants") != "8" {
+			t.Errorf("shard %d: unexpected options %v", i, o)
+		}
+	}
+
+	options := url.Values{"backend.db-url": {"mongodb://db-{shard}:27017"}, "1.db-url": {"mongodb://other:27017"}}
+	if o := backendOptions(0, options); o.Get("db-url") != "mongodb://db-0:27017" || o.Get("db-dirname") != "" {
+		t.Errorf("shard 0: unexpected options %v", o)
+	}
+	if o := backendOptions(1, options); o.Get("db-url") != "mongodb://other:27017" {
+		t.Errorf("shard 1: unexpected options %v", o)
+	}
+}
+
+func TestRebalanceSharedOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mohawk-sharded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// one shard in a directory shared by all shards
+	options := url.Values{"backend": {"sqlite"}, "backend.db-dirname": {dir}, "shards": {"1"}}
+	r := NewStorage(storage.New)
+	if err = r.Open(options); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.PostRawData("tenant", "cpu", 1000, 1); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	// shards using the same options would delete the moved series
+	options.Set("shards", "2")
+	if _, err = Rebalance(storage.New, options, 1); err == nil {
+		t.Error("expected a rebalance of shards using the same options to fail")
+	}
+	if err = NewStorage(storage.New).Open(options); err == nil {
+		t.Error("expected an open of shards using the same options to fail")
+	}
+
+	options.Set("shards", "1")
+	r = NewStorage(storage.New)
+	if err = r.Open(options); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if res, err := r.GetRawData("tenant", "cpu", 2000, 0, 10, "ASC"); err != nil || len(res) != 1 {
+		t.Errorf("unexpected points %+v, %v", res, err)
+	}
+}
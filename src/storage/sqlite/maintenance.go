@@ -0,0 +1,166 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sqlite interface for sqlite metric data storage
+package sqlite
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// autoVacuumIncremental the auto_vacuum pragma value of incremental vacuum
+const autoVacuumIncremental = 2
+
+// cleanStats what one maintenance run removed from a tenant db
+type cleanStats struct {
+	points int64
+	series int64
+	bytes  int64
+}
+
+// setIncrementalVacuum enable incremental vacuum, free pages are kept in the
+// db file until an incremental vacuum returns them to the file system
+//
+// a new db is set before its tables are created, a db created by an older
+// version of this storage is converted by a full vacuum.
+func setIncrementalVacuum(db *sql.DB) error {
+	var mode int
+	var pages int64
+
+	if err := db.QueryRow("pragma auto_vacuum").Scan(&mode); err != nil {
+		return err
+	}
+	if mode == autoVacuumIncremental {
+		return nil
+	}
+
+	if _, err := db.Exec("pragma auto_vacuum = incremental"); err != nil {
+		return err
+	}
+	if err := db.QueryRow("pragma page_count").Scan(&pages); err != nil {
+		return err
+	}
+	if pages > 0 {
+		_, err := db.Exec("vacuum")
+		return err
+	}
+
+	return nil
+}
+
+func (r *Storage) maintenance() {
+	c := time.NewTicker(time.Duration(r.maintenanceIntervalSec) * time.Second)
+	defer c.Stop()
+
+	// once a tick clean data, until the storage is closed
+	for {
+		select {
+		case <-c.C:
+			log.Printf("maintenance: start\n")
+			r.cleanData()
+		case <-r.done:
+			return
+		}
+	}
+}
+
+func (r *Storage) closeIdle() {
+	idleTimeout := time.Duration(r.idleTimeoutSec) * time.Second
+	c := time.NewTicker(idleTimeout / 2)
+	defer c.Stop()
+
+	for {
+		select {
+		case <-c.C:
+			r.pool.closeIdle(time.Now().Add(-idleTimeout))
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// cleanData clean all tenant dbs
+func (r *Storage) cleanData() {
+	tenants, err := r.GetTenants()
+	if err != nil {
+		log.Printf("maintenance: %s\n", err)
+		return
+	}
+
+	for _, t := range tenants {
+		tenant, err := r.lookupTenant(t.ID)
+		if err != nil {
+			log.Printf("maintenance: tenant %s: %s\n", t.ID, err)
+			continue
+		}
+
+		stats, err := r.cleanTenant(tenant.write)
+		r.pool.release(tenant)
+		if err != nil {
+			log.Printf("maintenance: tenant %s: %s\n", t.ID, err)
+			continue
+		}
+		log.Printf("maintenance: tenant %s: deleted %d points and %d series, reclaimed %d bytes\n",
+			t.ID, stats.points, stats.series, stats.bytes)
+	}
+}
+
+// cleanTenant delete expired points and series without points,
+// and return the free pages of a tenant db to the file system
+func (r *Storage) cleanTenant(db *sql.DB) (cleanStats, error) {
+	var stats cleanStats
+	var pageSize int64
+	var pagesBefore int64
+	var pagesAfter int64
+
+	if r.timeRetentionSec > 0 {
+		validTimeStamp := (time.Now().Unix() - r.timeRetentionSec) * 1000
+
+		res, err := db.Exec("delete from points where timestamp < ?", validTimeStamp)
+		if err != nil {
+			return stats, err
+		}
+		stats.points, _ = res.RowsAffected()
+
+		// series with no points left, and their tags
+		_, err = db.Exec("delete from tags where series not in (select series from points)")
+		if err != nil {
+			return stats, err
+		}
+		res, err = db.Exec("delete from series where key not in (select series from points)")
+		if err != nil {
+			return stats, err
+		}
+		stats.series, _ = res.RowsAffected()
+	}
+
+	if err := db.QueryRow("pragma page_size").Scan(&pageSize); err != nil {
+		return stats, err
+	}
+	if err := db.QueryRow("pragma page_count").Scan(&pagesBefore); err != nil {
+		return stats, err
+	}
+	if _, err := db.Exec("pragma incremental_vacuum"); err != nil {
+		return stats, err
+	}
+	if err := db.QueryRow("pragma page_count").Scan(&pagesAfter); err != nil {
+		return stats, err
+	}
+	stats.bytes = (pagesBefore - pagesAfter) * pageSize
+
+	return stats, nil
+}
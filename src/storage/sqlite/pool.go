@@ -0,0 +1,220 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sqlite interface for sqlite metric data storage
+package sqlite
+
+import (
+	"container/list"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// errClosed a new error with closed storage message
+var errClosed = errors.New("sqlite: Storage is closed")
+
+// tenantPool a bounded pool of open tenant dbs, tenant dbs are referenced
+// while in use, and the least recently used unreferenced dbs are closed when
+// more then max dbs are open, dbs are opened and closed outside the pool lock
+type tenantPool struct {
+	lock    sync.Mutex
+	max     int
+	closed  bool
+	tenants map[string]*list.Element
+	lru     *list.List
+}
+
+// poolEntry a tenant db in the pool, ready is closed when the db is open or
+// when opening it failed
+type poolEntry struct {
+	name     string
+	t        *tenantDB
+	err      error
+	ready    chan struct{}
+	refs     int
+	lastUsed time.Time
+}
+
+// newTenantPool create an empty pool of tenant dbs
+func newTenantPool(max int) *tenantPool {
+	return &tenantPool{
+		max:     max,
+		tenants: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// get return a referenced tenant db, open is called if the db is not in the pool,
+// the caller must release the db when done
+//
+// a caller waiting for the open of another caller calls its own open if the
+// other open failed, callers may open differently, e.g. a lookup does not
+// create a missing db
+func (p *tenantPool) get(name string, open func() (*tenantDB, error)) (*tenantDB, error) {
+	p.lock.Lock()
+
+	if p.closed {
+		p.lock.Unlock()
+		return nil, errClosed
+	}
+
+	// wait for a db opened by another caller
+	if e, ok := p.tenants[name]; ok {
+		p.lru.MoveToFront(e)
+		pe := e.Value.(*poolEntry)
+		pe.refs++
+		p.lock.Unlock()
+
+		<-pe.ready
+		if pe.err != nil {
+			return p.get(name, open)
+		}
+		return pe.t, nil
+	}
+
+	// add a referenced entry, so the db is not evicted while it opens
+	pe := &poolEntry{name: name, ready: make(chan struct{}), refs: 1}
+	e := p.lru.PushFront(pe)
+	p.tenants[name] = e
+	p.lock.Unlock()
+
+	t, err := open()
+
+	p.lock.Lock()
+	if err != nil {
+		// a failed db is removed from the pool, the next get opens it again
+		delete(p.tenants, name)
+		p.lru.Remove(e)
+		pe.err = err
+	} else {
+		t.name = name
+		pe.t = t
+	}
+	close(pe.ready)
+	evicted := p.evict()
+	p.lock.Unlock()
+
+	closeEntries(evicted)
+
+	return t, err
+}
+
+// release remove a reference to a tenant db
+func (p *tenantPool) release(t *tenantDB) {
+	var evicted []*poolEntry
+
+	p.lock.Lock()
+
+	pe := p.tenants[t.name].Value.(*poolEntry)
+	pe.refs--
+	pe.lastUsed = time.Now()
+
+	// a closed pool closes dbs when their last reference is released
+	if p.closed {
+		if pe.refs == 0 {
+			evicted = append(evicted, p.remove(p.tenants[t.name]))
+		}
+	} else {
+		evicted = p.evict()
+	}
+
+	p.lock.Unlock()
+
+	closeEntries(evicted)
+}
+
+// closeIdle close unreferenced tenant dbs not used since a time
+func (p *tenantPool) closeIdle(since time.Time) {
+	var idle []*poolEntry
+
+	p.lock.Lock()
+	for e := p.lru.Back(); e != nil; {
+		prev := e.Prev()
+		if pe := e.Value.(*poolEntry); pe.refs == 0 && pe.lastUsed.Before(since) {
+			log.Printf("sqlite: close idle tenant %s\n", pe.name)
+			idle = append(idle, p.remove(e))
+		}
+		e = prev
+	}
+	p.lock.Unlock()
+
+	closeEntries(idle)
+}
+
+// closeAll close all unreferenced tenant dbs, referenced dbs are closed
+// when released, the pool does not open new dbs
+func (p *tenantPool) closeAll() {
+	var unused []*poolEntry
+
+	p.lock.Lock()
+	p.closed = true
+	for e := p.lru.Back(); e != nil; {
+		prev := e.Prev()
+		if pe := e.Value.(*poolEntry); pe.refs == 0 {
+			unused = append(unused, p.remove(e))
+		}
+		e = prev
+	}
+	p.lock.Unlock()
+
+	closeEntries(unused)
+}
+
+// open return the number of open tenant dbs
+func (p *tenantPool) open() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.lru.Len()
+}
+
+// evict remove the least recently used unreferenced tenant dbs while more
+// then max dbs are open, caller must hold the pool lock and close the
+// removed dbs
+func (p *tenantPool) evict() []*poolEntry {
+	var evicted []*poolEntry
+
+	for e := p.lru.Back(); e != nil && p.lru.Len() > p.max; {
+		prev := e.Prev()
+		if pe := e.Value.(*poolEntry); pe.refs == 0 {
+			evicted = append(evicted, p.remove(e))
+		}
+		e = prev
+	}
+
+	return evicted
+}
+
+// remove remove a tenant db from the pool, caller must hold the pool lock
+// and close the removed db
+func (p *tenantPool) remove(e *list.Element) *poolEntry {
+	pe := e.Value.(*poolEntry)
+
+	delete(p.tenants, pe.name)
+	p.lru.Remove(e)
+
+	return pe
+}
+
+// closeEntries close removed tenant dbs, caller must not hold the pool lock
+func closeEntries(entries []*poolEntry) {
+	for _, pe := range entries {
+		if err := pe.t.close(); err != nil {
+			log.Printf("sqlite: close tenant %s: %s\n", pe.name, err)
+		}
+	}
+}
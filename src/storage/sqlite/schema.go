@@ -0,0 +1,226 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sqlite interface for sqlite metric data storage
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// migration upgrade a tenant db from the previous schema version
+type migration func(tx *sql.Tx) error
+
+// migrations the schema migrations, migration i upgrades a db from
+// schema version i to version i+1, the schema version of a db is kept
+// in its user_version pragma
+var migrations = []migration{
+	migrateSeriesTables,
+	migrateLastValues,
+}
+
+// schemaV1 the normalized tables, series keys are integers, metric ids
+// are only used as values, never as table or column names
+const schemaV1 = `
+	create table series (
+		key integer primary key,
+		id  text not null unique);
+	create table points (
+		series    integer not null,
+		timestamp integer not null,
+		value     real,
+		primary key (series, timestamp)) without rowid;
+	create table tags (
+		series integer not null,
+		tag    text not null,
+		value  text not null,
+		primary key (series, tag)) without rowid;
+	create index tags_tag_value on tags (tag, value);
+	`
+
+// migrate upgrade a tenant db to the latest schema version
+func migrate(db *sql.DB) error {
+	var version int
+
+	if err := db.QueryRow("pragma user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("sqlite: Unknown schema version %d", version)
+	}
+
+	for ; version < len(migrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		err = migrations[version](tx)
+		if err == nil {
+			// pragma values can not be bound as parameters
+			_, err = tx.Exec(fmt.Sprintf("pragma user_version = %d", version+1))
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+
+		log.Printf("sqlite: migrated schema to version %d\n", version+1)
+	}
+
+	return nil
+}
+
+// migrateSeriesTables create the normalized tables, data of older versions of
+// this storage is moved into them:
+// 	an ids table and a tags table keyed by the metric id
+// 	a table per metric id, or a single data table keyed by the metric id
+func migrateSeriesTables(tx *sql.Tx) error {
+	tables, err := tableNames(tx)
+	if err != nil {
+		return err
+	}
+
+	// new db, nothing to move
+	if !tables["ids"] {
+		_, err = tx.Exec(schemaV1)
+		return err
+	}
+
+	// per id tables, listed before the legacy tables are renamed
+	var idTables []string
+	rows, err := tx.Query(`select id from ids
+		where id not in ('ids', 'tags', 'data')
+		and id in (select name from sqlite_master where type = 'table')`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		idTables = append(idTables, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	// move the legacy tables out of the way, an id table may use one of
+	// the new table names, legacy table names are quoted, this is the only
+	// place an id is used as an identifier
+	legacy := []string{"ids", "tags", "data"}
+	for _, name := range legacy {
+		if tables[name] {
+			if _, err = tx.Exec("alter table " + name + " rename to legacy_" + name); err != nil {
+				return err
+			}
+		}
+	}
+	for i, id := range idTables {
+		if _, err = tx.Exec(fmt.Sprintf("alter table %s rename to legacy_id_%d", quoteIdentifier(id), i)); err != nil {
+			return err
+		}
+	}
+
+	if _, err = tx.Exec(schemaV1); err != nil {
+		return err
+	}
+
+	stmts := []string{"insert into series (id) select id from legacy_ids"}
+	if tables["tags"] {
+		stmts = append(stmts, `insert or replace into tags (series, tag, value)
+			select s.key, t.tag, t.value from legacy_tags t join series s on s.id = t.id
+			where t.tag is not null and t.value is not null`)
+	}
+	if tables["data"] {
+		stmts = append(stmts, `insert or ignore into points (series, timestamp, value)
+			select s.key, d.timestamp, d.value from legacy_data d join series s on s.id = d.id`)
+	}
+	for _, stmt := range stmts {
+		if _, err = tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	for i, id := range idTables {
+		_, err = tx.Exec(fmt.Sprintf(`insert or ignore into points (series, timestamp, value)
+			select (select key from series where id = ?), timestamp, value from legacy_id_%d`, i), id)
+		if err == nil {
+			_, err = tx.Exec(fmt.Sprintf("drop table legacy_id_%d", i))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, name := range legacy {
+		if tables[name] {
+			if _, err = tx.Exec("drop table legacy_" + name); err != nil {
+				return err
+			}
+		}
+	}
+
+	log.Printf("sqlite: moved %d legacy tables\n", len(idTables))
+
+	return nil
+}
+
+// migrateLastValues add the last point of each series to the series table
+func migrateLastValues(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		alter table series add column last_timestamp integer;
+		alter table series add column last_value real;
+		update series set (last_timestamp, last_value) = (
+			select timestamp, value from points
+			where points.series = series.key
+			order by timestamp desc limit 1);`)
+
+	return err
+}
+
+// tableNames return the names of the tables in a db
+func tableNames(tx *sql.Tx) (map[string]bool, error) {
+	tables := make(map[string]bool)
+
+	rows, err := tx.Query("select name from sqlite_master where type = 'table'")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		tables[name] = true
+	}
+
+	return tables, rows.Err()
+}
+
+// quoteIdentifier quote an sqlite identifier
+func quoteIdentifier(s string) string {
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+}
@@ -22,55 +22,176 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
 	"net/url"
+	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/MohawkTSDB/mohawk/src/storage"
-	// go-sqlite3 is used by the database/sql package
-	_ "github.com/mattn/go-sqlite3"
+	sqlite3 "github.com/mattn/go-sqlite3"
 )
 
-// errBadMetricID a new error with bad metrics id message
-var errBadMetricID = errors.New("sqlite: Bad metrics ID")
+// driverName the sql driver of tenant dbs, sqlite3 with a regexp function
+const driverName = "sqlite3_mohawk"
+
+// errBadTenant a new error with bad tenant name message
+var errBadTenant = errors.New("sqlite: Bad tenant name")
+
+func init() {
+	storage.Register("sqlite", func() storage.Storage { return &Storage{} })
+
+	sql.Register(driverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.RegisterFunc("regexp", sqlRegexp, true)
+		},
+	})
+}
+
+// tenantDB a tenant db, writes use one connection and a group commit
+// writer, reads use a pool of connections that do not block on the writer
+type tenantDB struct {
+	name   string
+	write  *sql.DB
+	read   *sql.DB
+	writer *groupWriter
+}
 
 type Storage struct {
-	dbDirName string
-	tenant    map[string]*sql.DB
+	dbDirName              string
+	timeRetentionSec       int64
+	maintenanceIntervalSec int64
+	commitInterval         time.Duration
+	commitSize             int
+	readConnections        int
+	maxOpenTenants         int
+	idleTimeoutSec         int64
+	pool                   *tenantPool
+	done                   chan struct{}
+	closeOnce              sync.Once
 }
 
 // Storage functions
 // Required by storage interface
 
 // Name return a human readable storage name
-func (r Storage) Name() string {
+func (r *Storage) Name() string {
 	return "Storage-Sqlite3"
 }
 
 // Help return a human readable storage help message
-func (r Storage) Help() string {
-	return `Mongo storage [mongo]:
-	db-dirname - a directory for sqlite db file storage.
+func (r *Storage) Help() string {
+	return `Sqlite storage [sqlite]:
+	db-dirname           - a directory for sqlite db file storage.
+	retention            - (optional) samples max retention, samples are kept forever if not set.
+	maintenance-interval - (optional) time between maintenance runs (default "1h").
+	commit-interval      - (optional) max time posted data waits for a group commit (default "50ms").
+	commit-size          - (optional) number of posted data points that triggers a group commit (default 1000).
+	read-connections     - (optional) number of db connections used for reads, per tenant (default 4).
+	max-open-tenants     - (optional) max number of open tenant db files (default 128).
+	idle-timeout         - (optional) time an unused tenant db file is kept open (default "10mn").
 	Examples:
-		--options=db-dirname=/data`
+		--options=db-dirname=/data
+		--options=db-dirname=/data&retention=30d&maintenance-interval=6h
+		--options=db-dirname=/data&commit-interval=200ms&commit-size=5000`
 }
 
 // Open storage
-func (r *Storage) Open(options url.Values) {
+func (r *Storage) Open(options url.Values) error {
 	// get storage options
 	r.dbDirName = options.Get("db-dirname")
 	if r.dbDirName == "" {
 		r.dbDirName = "."
 	}
 
-	r.tenant = make(map[string]*sql.DB)
+	var err error
+	if retentionStr := options.Get("retention"); retentionStr != "" {
+		if r.timeRetentionSec, err = storage.ParseDuration(retentionStr); err != nil || r.timeRetentionSec < 0 {
+			return fmt.Errorf("sqlite: Bad retention %s", retentionStr)
+		}
+	}
+
+	r.maintenanceIntervalSec = int64(60 * 60)
+	if intervalStr := options.Get("maintenance-interval"); intervalStr != "" {
+		if r.maintenanceIntervalSec, err = storage.ParseDuration(intervalStr); err != nil || r.maintenanceIntervalSec < 1 {
+			return fmt.Errorf("sqlite: Bad maintenance interval %s", intervalStr)
+		}
+	}
+
+	r.commitInterval = 50 * time.Millisecond
+	if intervalStr := options.Get("commit-interval"); intervalStr != "" {
+		if r.commitInterval, err = time.ParseDuration(intervalStr); err != nil || r.commitInterval <= 0 {
+			return fmt.Errorf("sqlite: Bad commit interval %s", intervalStr)
+		}
+	}
+
+	r.commitSize = 1000
+	if sizeStr := options.Get("commit-size"); sizeStr != "" {
+		if r.commitSize, err = strconv.Atoi(sizeStr); err != nil || r.commitSize < 1 {
+			return fmt.Errorf("sqlite: Bad commit size %s", sizeStr)
+		}
+	}
+
+	r.readConnections = 4
+	if connStr := options.Get("read-connections"); connStr != "" {
+		if r.readConnections, err = strconv.Atoi(connStr); err != nil || r.readConnections < 1 {
+			return fmt.Errorf("sqlite: Bad read connections %s", connStr)
+		}
+	}
+
+	r.maxOpenTenants = 128
+	if maxStr := options.Get("max-open-tenants"); maxStr != "" {
+		if r.maxOpenTenants, err = strconv.Atoi(maxStr); err != nil || r.maxOpenTenants < 1 {
+			return fmt.Errorf("sqlite: Bad max open tenants %s", maxStr)
+		}
+	}
+
+	r.idleTimeoutSec = int64(10 * 60)
+	if idleStr := options.Get("idle-timeout"); idleStr != "" {
+		if r.idleTimeoutSec, err = storage.ParseDuration(idleStr); err != nil || r.idleTimeoutSec < 1 {
+			return fmt.Errorf("sqlite: Bad idle timeout %s", idleStr)
+		}
+	}
+
+	r.pool = newTenantPool(r.maxOpenTenants)
+	r.done = make(chan struct{})
 
 	// log init arguments
 	log.Printf("Start sqlite storage:")
 	log.Printf("  db dirname: %+v", r.dbDirName)
+	log.Printf("  retention: %ds", r.timeRetentionSec)
+	log.Printf("  maintenance interval: %ds", r.maintenanceIntervalSec)
+	log.Printf("  commit interval: %v", r.commitInterval)
+	log.Printf("  commit size: %d", r.commitSize)
+	log.Printf("  read connections: %d", r.readConnections)
+	log.Printf("  max open tenants: %d", r.maxOpenTenants)
+	log.Printf("  idle timeout: %ds", r.idleTimeoutSec)
+
+	// start a maintenance worker that will clean the db periodically
+	go r.maintenance()
+
+	// start a worker that will close idle tenant dbs
+	go r.closeIdle()
+
+	return nil
+}
+
+// Close close all tenant dbs, posted data waiting for a group commit is
+// committed, tenant dbs in use are closed when their requests end
+func (r *Storage) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.done)
+		r.pool.closeAll()
+	})
+
+	return nil
 }
 
-func (r Storage) GetTenants() ([]storage.Tenant, error) {
+func (r *Storage) GetTenants() ([]storage.Tenant, error) {
 	res := make([]storage.Tenant, 0)
 
 	files, _ := ioutil.ReadDir(r.dbDirName)
@@ -84,86 +205,84 @@ func (r Storage) GetTenants() ([]storage.Tenant, error) {
 	return res, nil
 }
 
-func (r Storage) GetItemList(tenant string, tags map[string]string) ([]storage.Item, error) {
+func (r *Storage) GetItemList(tenant string, tags map[string]string) ([]storage.Item, error) {
 	res := make([]storage.Item, 0)
-	db, _ := r.getTenant(tenant)
 
-	// create one item per id
-	sqlStmt := "select id from ids"
-	rows, err := db.Query(sqlStmt)
+	// an unknown tenant has no items, reads do not create it
+	t, err := r.lookupTenant(tenant)
+	if storage.IsNotFound(err) {
+		return res, nil
+	}
 	if err != nil {
 		return res, err
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var id string
+	defer r.pool.release(t)
 
-		err = rows.Scan(&id)
-		if err != nil {
-			return res, err
-		}
-		res = append(res, storage.Item{
-			ID:   id,
-			Type: "gauge",
-			Tags: map[string]string{},
-		})
-	}
-	err = rows.Err()
+	// filter using tags, and get all the tags of matching series
+	where, args, err := tagsFilter(tags)
 	if err != nil {
 		return res, err
 	}
-
-	// update item tags
-	rows, err = db.Query("select id, tag, value from tags")
+	rows, err := t.read.Query(`select s.id, s.last_timestamp, s.last_value, t.tag, t.value
+		from series s left join tags t on t.series = s.key
+		where `+where+`
+		order by s.key`, args...)
 	if err != nil {
 		return res, err
 	}
 	defer rows.Close()
 	for rows.Next() {
 		var id string
-		var tag string
-		var value string
+		var lastTimestamp sql.NullInt64
+		var lastValue sql.NullFloat64
+		var tag sql.NullString
+		var value sql.NullString
 
-		err = rows.Scan(&id, &tag, &value)
+		err = rows.Scan(&id, &lastTimestamp, &lastValue, &tag, &value)
 		if err != nil {
 			return res, err
 		}
-		res = r.updateTag(res, tenant, id, tag, value)
-	}
-	err = rows.Err()
-	if err != nil {
-		return res, err
-	}
 
-	// filter using tags
-	if len(tags) > 0 {
-		for key, value := range tags {
-			res = storage.FilterItems(res, func(i storage.Item) bool {
-				r, _ := regexp.Compile("^" + value + "$")
-				return r.MatchString(i.Tags[key])
+		// rows of one series are sequential
+		if len(res) == 0 || res[len(res)-1].ID != id {
+			lastValues := []storage.DataItem{}
+			if lastTimestamp.Valid && lastValue.Valid {
+				lastValues = append(lastValues, storage.DataItem{Timestamp: lastTimestamp.Int64, Value: lastValue.Float64})
+			}
+
+			res = append(res, storage.Item{
+				ID:         id,
+				Type:       "gauge",
+				Tags:       map[string]string{},
+				LastValues: lastValues,
 			})
 		}
+		if tag.Valid && value.Valid {
+			res[len(res)-1].Tags[tag.String] = value.String
+		}
 	}
+	err = rows.Err()
 
 	return res, err
 }
 
-func (r Storage) GetRawData(tenant string, id string, end int64, start int64, limit int64, order string) ([]storage.DataItem, error) {
+func (r *Storage) GetRawData(tenant string, id string, end int64, start int64, limit int64, order string) ([]storage.DataItem, error) {
 	res := make([]storage.DataItem, 0)
-	db, _ := r.getTenant(tenant)
 
-	// check if id exist
-	if !r.IDExist(tenant, id) {
-		return res, errBadMetricID
+	// check if id exist, reads do not create it
+	t, key, err := r.lookupSeries(tenant, id)
+	if err != nil {
+		return res, err
 	}
+	defer r.pool.release(t)
 
 	// id exist, get timestamp, value pairs
 	sqlStmt := fmt.Sprintf(`select timestamp, value
-		from '%s'
-		where timestamp >= %d and timestamp < %d
-		order by timestamp %s limit %d`,
-		id, start, end, order, limit)
-	rows, err := db.Query(sqlStmt)
+		from points
+		where series = ? and timestamp >= ? and timestamp < ?
+		order by timestamp %s limit ?`,
+		sqlOrder(order))
+	rows, err := t.read.Query(sqlStmt, key, start, end, limit)
 	if err != nil {
 		return res, err
 	}
@@ -186,257 +305,453 @@ func (r Storage) GetRawData(tenant string, id string, end int64, start int64, li
 	return res, err
 }
 
-func (r Storage) GetStatData(tenant string, id string, end int64, start int64, limit int64, order string, bucketDuration int64) ([]storage.StatItem, error) {
+func (r *Storage) GetStatData(tenant string, id string, end int64, start int64, limit int64, order string, bucketDuration int64, percentiles []float64) ([]storage.StatItem, error) {
 	var samples int64
 	var startT int64
-	var endT int64
 	var min float64
 	var max float64
 	var avg float64
 	var sum float64
+	var avgSq float64
+	var first float64
+	var last float64
+	var median float64
 
-	count := int64(0)
 	res := make([]storage.StatItem, 0)
-	db, _ := r.getTenant(tenant)
 
+	// buckets are aligned to the bucket duration, only points in the
+	// requested time range are read
 	timeStep := bucketDuration * 1000
-	startTime := int64(start/timeStep) * timeStep
-	endTime := int64(1+end/timeStep) * timeStep
 
-	// check if id exist
-	if !r.IDExist(tenant, id) {
-		return res, errBadMetricID
+	// check if id exist, reads do not create it
+	t, key, err := r.lookupSeries(tenant, id)
+	if err != nil {
+		return res, err
 	}
+	defer r.pool.release(t)
 
-	// id exist, get timestamp, value pairs
+	// id exist, get bucket stats, first, last and median values use window
+	// functions over the points of each bucket
 	sqlStmt := fmt.Sprintf(`select
-		count(timestamp) as samples, cast((timestamp / %d) as integer) * %d as start, max(timestamp) as end,
-		min(value) as min, max(value) as max, avg(value) as avg, sum(value) as sum
-		from '%s'
-		where timestamp >= %d and timestamp < %d
+		start, count(timestamp) as samples,
+		min(value) as min, max(value) as max, avg(value) as avg, sum(value) as sum, avg(value * value) as avgSq,
+		first, last, avg(case when rn in ((n + 1) / 2, (n + 2) / 2) then value end) as median
+		from (select start, timestamp, value,
+			row_number() over (partition by start order by value) as rn,
+			count(*) over (partition by start) as n,
+			first_value(value) over w as first,
+			last_value(value) over w as last
+			from (select cast((timestamp / ?) as integer) * ? as start, timestamp, value
+				from points
+				where series = ? and timestamp >= ? and timestamp < ?)
+			window w as (partition by start order by timestamp
+				rows between unbounded preceding and unbounded following))
 		group by start
-		order by start %s`,
-		timeStep, timeStep, id, startTime, endTime, order)
-	rows, err := db.Query(sqlStmt)
+		order by start %s
+		limit ?`,
+		sqlOrder(order))
+	rows, err := t.read.Query(sqlStmt, timeStep, timeStep, key, start, end, limit)
 	if err != nil {
 		return res, err
 	}
 	defer rows.Close()
 
-	for rows.Next() && count < limit {
-		err = rows.Scan(&samples, &startT, &endT, &min, &max, &avg, &sum)
+	for rows.Next() {
+		err = rows.Scan(&startT, &samples, &min, &max, &avg, &sum, &avgSq, &first, &last, &median)
 		if err != nil {
 			return res, err
 		}
 
-		// add data
-		count++
+		// add data, sqlite has no sqrt function
 		res = append(res, storage.StatItem{
 			Start:   startT,
 			End:     startT + timeStep,
 			Empty:   false,
 			Samples: samples,
+			First:   first,
+			Last:    last,
 			Min:     min,
 			Max:     max,
 			Avg:     avg,
+			Median:  median,
+			Std:     math.Sqrt(math.Max(avgSq-avg*avg, 0)),
 			Sum:     sum,
 		})
 	}
-	err = rows.Err()
+	if err = rows.Err(); err != nil || len(percentiles) == 0 {
+		return res, err
+	}
+
+	err = getPercentiles(t.read, res, percentiles, timeStep, key, start, end)
 
 	return res, err
 }
 
-// PostRawData handle posting data to db
-func (r Storage) PostRawData(tenant string, id string, t int64, v float64) error {
-	// check if id exist
-	if !r.IDExist(tenant, id) {
-		if err := r.createID(tenant, id); err != nil {
+// getPercentiles set the percentiles of stat buckets, the values of the
+// buckets are streamed from the db one bucket after the other
+func getPercentiles(db *sql.DB, res []storage.StatItem, percentiles []float64, timeStep int64, key int64, start int64, end int64) error {
+	var quantiles storage.Quantiles
+	var bucketStart int64
+	var value float64
+
+	buckets := make(map[int64]int, len(res))
+	for i, item := range res {
+		buckets[item.Start] = i
+	}
+
+	rows, err := db.Query(`select cast((timestamp / ?) as integer) * ? as start, value
+		from points
+		where series = ? and timestamp >= ? and timestamp < ?
+		order by timestamp`,
+		timeStep, timeStep, key, start, end)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	current := int64(-1)
+	flush := func() {
+		if i, ok := buckets[current]; ok {
+			res[i].Percentiles = quantiles.Percentiles(percentiles)
+		}
+		quantiles.Reset()
+	}
+	for rows.Next() {
+		if err = rows.Scan(&bucketStart, &value); err != nil {
 			return err
 		}
+		if bucketStart != current {
+			flush()
+			current = bucketStart
+		}
+		quantiles.Add(value)
 	}
+	flush()
 
-	err := r.insertData(tenant, id, t, v)
-	return err
+	return rows.Err()
+}
+
+// PostRawData handle posting data to db
+func (r *Storage) PostRawData(tenant string, id string, t int64, v float64) error {
+	return r.PostBatchData(tenant, []storage.BatchItem{{
+		ID:   id,
+		Data: []storage.DataItem{{Timestamp: t, Value: v}},
+	}})
+}
+
+// PostBatchData handle posting a batch of data points to db
+func (r *Storage) PostBatchData(tenant string, items []storage.BatchItem) error {
+	t, err := r.getTenant(tenant)
+	if err != nil {
+		return err
+	}
+	defer r.pool.release(t)
+
+	// all data points are inserted in one transaction
+	return t.writer.write(items)
 }
 
 // PutTags handle posting tags to db
-func (r Storage) PutTags(tenant string, id string, tags map[string]string) error {
-	// check if id exist
-	if !r.IDExist(tenant, id) {
-		if err := r.createID(tenant, id); err != nil {
+func (r *Storage) PutTags(tenant string, id string, tags map[string]string) error {
+	return r.update(tenant, func(tx *sql.Tx) error {
+		// create the id if necessary
+		key, err := seriesKey(tx, id)
+		if err != nil {
 			return err
 		}
-	}
 
-	for k, v := range tags {
-		if err := r.insertTag(tenant, id, k, v); err != nil {
-			return err
+		for k, v := range tags {
+			if _, err = tx.Exec("insert or replace into tags (series, tag, value) values (?, ?, ?)", key, k, v); err != nil {
+				return err
+			}
 		}
-	}
-	return nil
+		return nil
+	})
 }
 
 // DeleteData handle delete data fron db
-func (r Storage) DeleteData(tenant string, id string, end int64, start int64) error {
+func (r *Storage) DeleteData(tenant string, id string, end int64, start int64) error {
 	// check if id exist
-	if r.IDExist(tenant, id) {
-		err := r.deleteData(tenant, id, end, start)
+	t, key, err := r.lookupSeries(tenant, id)
+	if err != nil {
 		return err
 	}
+	defer r.pool.release(t)
 
-	return errors.New("slite: ID not found")
+	return r.update(tenant, func(tx *sql.Tx) error {
+		_, err := tx.Exec("delete from points where series = ? and timestamp >= ? and timestamp < ?", key, start, end)
+		if err != nil {
+			return err
+		}
+
+		// if the last point was deleted, find the new last point
+		_, err = tx.Exec(`update series set (last_timestamp, last_value) = (
+				select timestamp, value from points
+				where points.series = series.key
+				order by timestamp desc limit 1)
+			where key = ? and last_timestamp >= ? and last_timestamp < ?`, key, start, end)
+
+		return err
+	})
 }
 
 // DeleteTags handle delete tags fron db
-func (r Storage) DeleteTags(tenant string, id string, tags []string) error {
+func (r *Storage) DeleteTags(tenant string, id string, tags []string) error {
 	// check if id exist
-	if r.IDExist(tenant, id) {
-		for _, k := range tags {
-			if err := r.deleteTag(tenant, id, k); err != nil {
-				return err
-			}
+	t, key, err := r.lookupSeries(tenant, id)
+	if err != nil {
+		return err
+	}
+	defer r.pool.release(t)
+
+	for _, k := range tags {
+		if _, err = t.write.Exec("delete from tags where series = ? and tag = ?", key, k); err != nil {
+			return err
 		}
-		return nil
 	}
 
-	return errors.New("sqlite: ID not found")
+	return nil
 }
 
 // Helper functions
 // Not required by storage interface
 
-func (r *Storage) getTenant(name string) (*sql.DB, error) {
-	var filename string
+// getTenant return a referenced tenant db, the db file is created if missing,
+// the caller must release the db
+func (r *Storage) getTenant(name string) (*tenantDB, error) {
+	return r.pool.get(name, func() (*tenantDB, error) {
+		return r.openTenant(name)
+	})
+}
 
-	if tenant, ok := r.tenant[name]; ok {
-		return tenant, nil
+// lookupTenant return a referenced existing tenant db, a NotFoundError if the
+// db file is missing, the caller must release the db
+func (r *Storage) lookupTenant(name string) (*tenantDB, error) {
+	return r.pool.get(name, func() (*tenantDB, error) {
+		filename, err := r.tenantFilename(name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = os.Stat(filename); os.IsNotExist(err) {
+			return nil, storage.NotFoundError{Tenant: name}
+		}
+
+		return r.openTenant(name)
+	})
+}
+
+// openTenant open a tenant db, the db file is created if missing
+func (r *Storage) openTenant(name string) (*tenantDB, error) {
+	filename, err := r.tenantFilename(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// the write ahead log lets readers run while the writer commits
+	write, err := sql.Open(driverName, dsn(filename, "_journal_mode=WAL&_busy_timeout=5000"))
+	if err != nil {
+		return nil, err
 	}
+	write.SetMaxOpenConns(1)
 
-	filename = fmt.Sprintf("%s/%s.db", r.dbDirName, name)
+	if err = setIncrementalVacuum(write); err != nil {
+		write.Close()
+		return nil, err
+	}
+	if err = migrate(write); err != nil {
+		write.Close()
+		return nil, err
+	}
 
-	db, err := sql.Open("sqlite3", filename)
+	read, err := sql.Open(driverName, dsn(filename, "_query_only=1&_busy_timeout=5000"))
 	if err != nil {
+		write.Close()
 		return nil, err
 	}
-	db.SetMaxOpenConns(1)
+	read.SetMaxOpenConns(r.readConnections)
+
+	return &tenantDB{
+		write:  write,
+		read:   read,
+		writer: newGroupWriter(write, r.commitInterval, r.commitSize),
+	}, nil
+}
 
-	sqlStmt := `
-		create table if not exists ids (
-			id    text,
-			primary key (id));
-		create table if not exists tags (
-			id    text,
-			tag   text,
-			value text,
-			primary key (id, tag));
-		`
+// close close a tenant db after waiting points are committed
+func (t *tenantDB) close() error {
+	t.writer.close()
 
-	_, err = db.Exec(sqlStmt)
-	if err == nil {
-		r.tenant[name] = db
+	err := t.read.Close()
+	if errWrite := t.write.Close(); err == nil {
+		err = errWrite
 	}
 
-	return db, err
+	return err
 }
 
-func (r Storage) IDExist(tenant string, id string) bool {
-	var _id string
-	db, err := r.getTenant(tenant)
+// lookupSeries return a referenced existing tenant db and series key, a NotFoundError
+// if the tenant or the series is missing, the caller must release the db
+func (r *Storage) lookupSeries(tenant string, id string) (*tenantDB, int64, error) {
+	var key int64
+
+	t, err := r.lookupTenant(tenant)
+	if storage.IsNotFound(err) {
+		return nil, 0, storage.NotFoundError{Tenant: tenant, ID: id}
+	}
 	if err != nil {
-		return false
+		return nil, 0, err
+	}
+
+	err = t.read.QueryRow("select key from series where id = ?", id).Scan(&key)
+	if err == sql.ErrNoRows {
+		err = storage.NotFoundError{Tenant: tenant, ID: id}
+	}
+	if err != nil {
+		r.pool.release(t)
+		return nil, 0, err
 	}
 
-	sqlStmt := fmt.Sprintf("select id from ids where id='%s'", id)
-	err = db.QueryRow(sqlStmt).Scan(&_id)
-	return err != sql.ErrNoRows
+	return t, key, nil
 }
 
-func (r Storage) insertData(tenant string, id string, t int64, v float64) error {
-	db, err := r.getTenant(tenant)
-	if err != nil {
-		return err
+// dsn return the data source name of a db file, the file name is escaped
+// and connection parameters are added
+func dsn(filename string, params string) string {
+	return "file:" + (&url.URL{Path: filename}).EscapedPath() + "?" + params
+}
+
+// tenantFilename return the db file name of a tenant,
+// tenant names that are not plain file names are rejected
+func (r *Storage) tenantFilename(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) || strings.ContainsRune(name, 0) {
+		return "", errBadTenant
 	}
 
-	sqlStmt := fmt.Sprintf("insert into '%s' values (%d, %f)", id, t, v)
-	_, err = db.Exec(sqlStmt)
+	return filepath.Join(r.dbDirName, name+".db"), nil
+}
 
-	return err
+// tagsFilter return an sql condition on the series table s, matching series
+// that have all the tags, tag values are regexps, plain values use the tags index
+//
+// a series without a tag matches if the regexp matches an empty string.
+func tagsFilter(tags map[string]string) (string, []interface{}, error) {
+	where := []string{"1"}
+	args := []interface{}{}
+
+	for key, value := range tags {
+		re, err := regexp.Compile("^" + value + "$")
+		if err != nil {
+			return "", nil, err
+		}
+
+		cond := "exists (select 1 from tags t where t.series = s.key and t.tag = ? and t.value = ?)"
+		arg := value
+		if regexp.QuoteMeta(value) != value {
+			cond = "exists (select 1 from tags t where t.series = s.key and t.tag = ? and regexp(?, t.value))"
+			arg = re.String()
+		}
+		args = append(args, key, arg)
+
+		if re.MatchString("") {
+			cond = "(" + cond + " or not exists (select 1 from tags t where t.series = s.key and t.tag = ?))"
+			args = append(args, key)
+		}
+		where = append(where, cond)
+	}
+
+	return strings.Join(where, " and "), args, nil
 }
 
-func (r Storage) insertTag(tenant string, id string, k string, v string) error {
-	db, err := r.getTenant(tenant)
-	if err != nil {
-		return err
+// sqlRegexp the regexp function used by tag filters, regexp(pattern, value)
+func sqlRegexp(pattern string, value string) (bool, error) {
+	return regexp.MatchString(pattern, value)
+}
+
+// sqlOrder return the sql sort order of a query order
+func sqlOrder(order string) string {
+	if order == "DESC" {
+		return "desc"
 	}
-	sqlStmt := fmt.Sprintf("insert or replace into tags values ('%s', '%s', '%s')", id, k, v)
-	_, err = db.Exec(sqlStmt)
 
-	return err
+	return "asc"
 }
 
-func (r Storage) deleteData(tenant string, id string, end int64, start int64) error {
-	db, err := r.getTenant(tenant)
+func (r *Storage) IDExist(tenant string, id string) bool {
+	t, _, err := r.lookupSeries(tenant, id)
 	if err != nil {
-		return err
+		return false
 	}
+	r.pool.release(t)
 
-	sqlStmt := fmt.Sprintf("delete from '%s' where timestamp >= %d and timestamp < %d", id, start, end)
-	_, err = db.Exec(sqlStmt)
+	return true
+}
 
-	return err
+// seriesKey return the key of a series, the series is created if missing
+func seriesKey(tx *sql.Tx, id string) (int64, error) {
+	var key int64
+
+	if _, err := tx.Exec("insert or ignore into series (id) values (?)", id); err != nil {
+		return 0, err
+	}
+	err := tx.QueryRow("select key from series where id = ?", id).Scan(&key)
+
+	return key, err
 }
 
-func (r Storage) deleteTag(tenant string, id string, k string) error {
-	db, err := r.getTenant(tenant)
+// update run a function in a transaction on a tenant db
+func (r *Storage) update(tenant string, f func(tx *sql.Tx) error) error {
+	t, err := r.getTenant(tenant)
 	if err != nil {
 		return err
 	}
+	defer r.pool.release(t)
 
-	sqlStmt := fmt.Sprintf("delete from tags where id='%s' and tag='%s'", id, k)
-	_, err = db.Exec(sqlStmt)
+	tx, err := t.write.Begin()
+	if err != nil {
+		return err
+	}
+	if err = f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
 
-	return err
+	return tx.Commit()
 }
 
-func (r Storage) createID(tenant string, id string) error {
-	db, err := r.getTenant(tenant)
+func insertBatchItem(tx *sql.Tx, item storage.BatchItem) error {
+	// create the id if necessary
+	key, err := seriesKey(tx, item.ID)
 	if err != nil {
 		return err
 	}
 
-	sqlStmt := fmt.Sprintf("insert into ids values ('%s')", id)
-	_, err = db.Exec(sqlStmt)
+	stmt, err := tx.Prepare("insert into points (series, timestamp, value) values (?, ?, ?)")
 	if err != nil {
 		return err
 	}
+	defer stmt.Close()
 
-	sqlStmt = fmt.Sprintf(`
-	create table if not exists '%s' (
-		timestamp integer,
-		value     numeric,
-		primary key (timestamp));
-	`, id)
-
-	_, err = db.Exec(sqlStmt)
-
-	return err
-}
+	if len(item.Data) == 0 {
+		return nil
+	}
 
-func (r Storage) updateTag(items []storage.Item, tenant string, id string, tag string, value string) []storage.Item {
-	// try to update tag if item exist
-	for i, item := range items {
-		if item.ID == id {
-			items[i].Tags[tag] = value
-			return items
+	last := item.Data[0]
+	for _, d := range item.Data {
+		if _, err := stmt.Exec(key, d.Timestamp, d.Value); err != nil {
+			if e, ok := err.(sqlite3.Error); ok && e.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
+				return storage.ConflictError{ID: item.ID, Timestamp: d.Timestamp}
+			}
+			return err
+		}
+		if d.Timestamp >= last.Timestamp {
+			last = d
 		}
 	}
 
-	// if here we did not find a matching item
-	items = append(items, storage.Item{
-		ID:   id,
-		Tags: map[string]string{tag: value},
-	})
+	// update the last point if this batch holds a newer point
+	_, err = tx.Exec(`update series set last_timestamp = ?, last_value = ?
+		where key = ? and (last_timestamp is null or last_timestamp <= ?)`,
+		last.Timestamp, last.Value, key, last.Timestamp)
 
-	return items
+	return err
 }
@@ -0,0 +1,389 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sqlite interface for sqlite metric data storage
+package sqlite
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MohawkTSDB/mohawk/src/storage"
+	"github.com/MohawkTSDB/mohawk/src/storage/storagetest"
+)
+
+func TestStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mohawk-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := &Storage{}
+	r.Open(url.Values{"db-dirname": {dir}})
+
+	storagetest.Run(t, r)
+}
+
+func TestMigrateLegacyTables(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mohawk-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a db using a table per metric id, "points" is also a new table name
+	db, err := sql.Open(driverName, filepath.Join(dir, "legacy.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`
+		create table ids (id text, primary key (id));
+		create table tags (id text, tag text, value text, primary key (id, tag));
+		insert into ids values ('cpu'), ('points');
+		insert into tags values ('cpu', 'host', 'a');
+		create table 'cpu' (timestamp integer, value numeric, primary key (timestamp));
+		insert into 'cpu' values (1000, 1), (2000, 2);
+		create table 'points' (timestamp integer, value numeric, primary key (timestamp));
+		insert into 'points' values (1000, 3);`)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &Storage{}
+	r.Open(url.Values{"db-dirname": {dir}})
+
+	res, err := r.GetRawData("legacy", "cpu", 3000, 0, 10, "ASC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 || res[1].Value != 2 {
+		t.Errorf("unexpected cpu data points: %+v", res)
+	}
+
+	res, err = r.GetRawData("legacy", "points", 3000, 0, 10, "ASC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].Value != 3 {
+		t.Errorf("unexpected points data points: %+v", res)
+	}
+
+	items, err := r.GetItemList("legacy", map[string]string{"host": "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].ID != "cpu" {
+		t.Fatalf("unexpected items for host a: %+v", items)
+	}
+	if len(items[0].LastValues) != 1 || items[0].LastValues[0].Timestamp != 2000 {
+		t.Errorf("unexpected last values: %+v", items[0].LastValues)
+	}
+
+	// a regexp matching an empty value matches series without the tag
+	items, err = r.GetItemList("legacy", map[string]string{"host": "a?"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 {
+		t.Errorf("unexpected items for host a?: %+v", items)
+	}
+
+	var version int
+	tenant, _ := r.getTenant("legacy")
+	defer r.pool.release(tenant)
+	if err = tenant.read.QueryRow("pragma user_version").Scan(&version); err != nil || version != len(migrations) {
+		t.Errorf("unexpected schema version %d, %v", version, err)
+	}
+}
+
+func TestCleanData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mohawk-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := &Storage{}
+	r.Open(url.Values{"db-dirname": {dir}, "retention": {"1h"}})
+
+	now := time.Now().Unix() * 1000
+	old := now - 2*60*60*1000
+
+	// an expired series, and a series with one expired point
+	batch := []storage.BatchItem{
+		{ID: "expired", Data: []storage.DataItem{{Timestamp: old, Value: 1}}},
+		{ID: "cpu", Data: []storage.DataItem{{Timestamp: old, Value: 1}, {Timestamp: now - 1000, Value: 2}}},
+	}
+	for i := int64(0); i < 1000; i++ {
+		batch[0].Data = append(batch[0].Data, storage.DataItem{Timestamp: old + i + 1, Value: float64(i)})
+	}
+	if err = r.PostBatchData("clean", batch); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.PutTags("clean", "expired", map[string]string{"host": "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tenant, _ := r.getTenant("clean")
+	stats, err := r.cleanTenant(tenant.write)
+	r.pool.release(tenant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.points != 1002 || stats.series != 1 || stats.bytes <= 0 {
+		t.Errorf("unexpected clean stats: %+v", stats)
+	}
+
+	if r.IDExist("clean", "expired") {
+		t.Errorf("expired series still exists")
+	}
+	res, err := r.GetRawData("clean", "cpu", now, old, 10, "ASC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].Value != 2 {
+		t.Errorf("unexpected data points after clean: %+v", res)
+	}
+}
+
+func TestGroupCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mohawk-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := &Storage{}
+	r.Open(url.Values{"db-dirname": {dir}, "commit-interval": {"20ms"}, "commit-size": {"10"}})
+
+	if err = r.PostRawData("group", "dup", 1000, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// concurrent writers share commits, a failed write does not fail the others
+	var wg sync.WaitGroup
+	errs := make([]error, 50)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i == 0 {
+				errs[i] = r.PostRawData("group", "dup", 1000, 2)
+				return
+			}
+			errs[i] = r.PostRawData("group", "cpu", int64(i)*1000, float64(i))
+		}(i)
+	}
+	wg.Wait()
+
+	if !storage.IsConflict(errs[0]) {
+		t.Errorf("expected a conflict error while posting a duplicate data point, got %v", errs[0])
+	}
+	for i, err := range errs[1:] {
+		if err != nil {
+			t.Errorf("unexpected error while posting data point %d: %v", i+1, err)
+		}
+	}
+
+	res, err := r.GetRawData("group", "cpu", 100*1000, 0, 100, "ASC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != len(errs)-1 {
+		t.Errorf("expected %d data points, got %d", len(errs)-1, len(res))
+	}
+}
+
+func TestTenantPool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mohawk-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := &Storage{}
+	r.Open(url.Values{"db-dirname": {dir}, "max-open-tenants": {"2"}})
+
+	tenants := []string{"a", "b", "c", "d"}
+	for _, tenant := range tenants {
+		if err = r.PostRawData(tenant, "cpu", 1000, 1); err != nil {
+			t.Fatal(err)
+		}
+		if n := r.pool.open(); n > 2 {
+			t.Errorf("expected at most 2 open tenants, got %d", n)
+		}
+	}
+
+	// closed tenant dbs are opened again
+	for _, tenant := range tenants {
+		res, err := r.GetRawData(tenant, "cpu", 2000, 0, 10, "ASC")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != 1 {
+			t.Errorf("tenant %s: expected 1 data point, got %d", tenant, len(res))
+		}
+	}
+
+	// idle tenant dbs are closed
+	r.pool.closeIdle(time.Now().Add(time.Second))
+	if n := r.pool.open(); n != 0 {
+		t.Errorf("expected idle tenants to be closed, got %d open", n)
+	}
+
+	if err = r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.PostRawData("a", "cpu", 2000, 2); err != errClosed {
+		t.Errorf("expected a closed storage error, got %v", err)
+	}
+}
+
+func TestTenantPoolOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mohawk-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := &Storage{}
+	r.Open(url.Values{"db-dirname": {dir}})
+	defer r.Close()
+
+	// a tenant db opens outside the pool lock
+	opening := make(chan struct{})
+	unblock := make(chan struct{})
+	opened := make(chan *tenantDB, 2)
+	opens := 0
+	open := func() (*tenantDB, error) {
+		opens++
+		close(opening)
+		<-unblock
+		return r.openTenant("a")
+	}
+	for i := 0; i < 2; i++ {
+		go func() {
+			tenant, err := r.pool.get("a", open)
+			if err != nil {
+				t.Error(err)
+			}
+			opened <- tenant
+		}()
+	}
+	<-opening
+
+	done := make(chan error)
+	go func() {
+		tenant, err := r.getTenant("b")
+		if err == nil {
+			r.pool.release(tenant)
+		}
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("get of a tenant waits for the open of another tenant")
+	}
+
+	// callers of a tenant that is opening wait for the same db
+	close(unblock)
+	a1, a2 := <-opened, <-opened
+	if opens != 1 || a1 == nil || a1 != a2 {
+		t.Errorf("expected one open of tenant a, got %d opens", opens)
+	}
+	r.pool.release(a1)
+	r.pool.release(a2)
+}
+
+func TestTenantPoolFailedOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mohawk-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := &Storage{}
+	r.Open(url.Values{"db-dirname": {dir}})
+	defer r.Close()
+
+	// a read looks up the missing tenant db while a post waits for it
+	unblock := make(chan struct{})
+	lookup := make(chan error)
+	go func() {
+		_, err := r.pool.get("a", func() (*tenantDB, error) {
+			<-unblock
+			return nil, storage.NotFoundError{Tenant: "a"}
+		})
+		lookup <- err
+	}()
+
+	posted := make(chan error)
+	go func() {
+		for waiting := false; !waiting; time.Sleep(time.Millisecond) {
+			r.pool.lock.Lock()
+			e, ok := r.pool.tenants["a"]
+			waiting = ok && e.Value.(*poolEntry).refs == 1
+			r.pool.lock.Unlock()
+		}
+		posted <- r.PostRawData("a", "cpu", 1000, 1)
+	}()
+
+	// the post opens the db itself when the lookup fails
+	for waiting := false; !waiting; time.Sleep(time.Millisecond) {
+		r.pool.lock.Lock()
+		e, ok := r.pool.tenants["a"]
+		waiting = ok && e.Value.(*poolEntry).refs == 2
+		r.pool.lock.Unlock()
+	}
+	close(unblock)
+
+	if err := <-lookup; !storage.IsNotFound(err) {
+		t.Errorf("expected a not found error from the lookup, got %v", err)
+	}
+	if err := <-posted; err != nil {
+		t.Errorf("expected the post to open the tenant, got %v", err)
+	}
+	if res, err := r.GetRawData("a", "cpu", 2000, 0, 10, "ASC"); err != nil || len(res) != 1 {
+		t.Errorf("expected 1 data point, got %v %v", res, err)
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	for _, options := range []url.Values{
+		{"retention": {"7x"}},
+		{"maintenance-interval": {"0s"}},
+		{"commit-interval": {"fast"}},
+		{"commit-size": {"0"}},
+		{"idle-timeout": {"-1"}},
+	} {
+		r := &Storage{}
+		if err := r.Open(options); err == nil {
+			r.Close()
+			t.Errorf("%v: expected an error", options)
+		}
+	}
+}
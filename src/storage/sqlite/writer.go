@@ -0,0 +1,152 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sqlite interface for sqlite metric data storage
+package sqlite
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/MohawkTSDB/mohawk/src/storage"
+)
+
+// writeRequest a batch of data points waiting for a group commit
+type writeRequest struct {
+	items []storage.BatchItem
+	done  chan error
+}
+
+// groupWriter insert data points of a tenant db, points posted at the same
+// time are inserted in one transaction, committed every commit interval or
+// when commit size points are waiting
+type groupWriter struct {
+	db       *sql.DB
+	requests chan writeRequest
+	interval time.Duration
+	size     int
+	stopped  chan struct{}
+}
+
+// newGroupWriter start a group commit writer on a db
+func newGroupWriter(db *sql.DB, interval time.Duration, size int) *groupWriter {
+	w := &groupWriter{
+		db:       db,
+		requests: make(chan writeRequest, size),
+		interval: interval,
+		size:     size,
+		stopped:  make(chan struct{}),
+	}
+	go w.run()
+
+	return w
+}
+
+// write insert data points, returns after the points are committed
+func (w *groupWriter) write(items []storage.BatchItem) error {
+	req := writeRequest{items: items, done: make(chan error, 1)}
+	w.requests <- req
+
+	return <-req.done
+}
+
+// close stop the writer after all waiting points are committed
+func (w *groupWriter) close() {
+	close(w.requests)
+	<-w.stopped
+}
+
+func (w *groupWriter) run() {
+	defer close(w.stopped)
+
+	for req := range w.requests {
+		batch := []writeRequest{req}
+		points := req.points()
+
+		// collect requests until the commit interval ends or the batch is full
+		timer := time.NewTimer(w.interval)
+	collect:
+		for points < w.size {
+			select {
+			case req, ok := <-w.requests:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, req)
+				points += req.points()
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+
+		w.commit(batch)
+	}
+}
+
+// commit insert a batch of requests in one transaction, each request is
+// inserted in a savepoint, so a failed request does not fail the others
+func (w *groupWriter) commit(batch []writeRequest) {
+	errs := make([]error, len(batch))
+
+	tx, err := w.db.Begin()
+	if err != nil {
+		for _, req := range batch {
+			req.done <- err
+		}
+		return
+	}
+
+	for i, req := range batch {
+		if _, err = tx.Exec("savepoint request"); err != nil {
+			errs[i] = err
+			continue
+		}
+
+		for _, item := range req.items {
+			if errs[i] = insertBatchItem(tx, item); errs[i] != nil {
+				break
+			}
+		}
+
+		if errs[i] != nil {
+			_, err = tx.Exec("rollback to request")
+		}
+		if err == nil {
+			_, err = tx.Exec("release request")
+		}
+		if err != nil && errs[i] == nil {
+			errs[i] = err
+		}
+	}
+
+	err = tx.Commit()
+	for i, req := range batch {
+		if errs[i] == nil {
+			errs[i] = err
+		}
+		req.done <- errs[i]
+	}
+}
+
+// points return the number of data points in a request
+func (req writeRequest) points() int {
+	n := 0
+	for _, item := range req.items {
+		n += len(item.Data)
+	}
+
+	return n
+}
@@ -17,6 +17,7 @@
 package storage
 
 import (
+	"fmt"
 	"net/url"
 )
 
@@ -39,33 +40,134 @@ type DataItem struct {
 	Value     float64 `json:"value" bson:"value"`
 }
 
+// BatchItem a list of data points of one metric
+type BatchItem struct {
+	ID   string     `json:"id"`
+	Data []DataItem `json:"data"`
+}
+
 // StatItem one statistics data point
 type StatItem struct {
-	Start   int64   `json:"start"`
-	End     int64   `json:"end"`
-	Empty   bool    `json:"empty"`
-	Samples int64   `json:"samples,omitempty"`
-	Min     float64 `json:"min,omitempty"`
-	Max     float64 `json:"max,omitempty"`
-	First   float64 `json:"first,omitempty"`
-	Last    float64 `json:"last,omitempty"`
-	Avg     float64 `json:"avg,omitempty"`
-	Median  float64 `json:"median,omitempty"`
-	Std     float64 `json:"std,omitempty"`
-	Sum     float64 `json:"sum,omitempty"`
+	Start       int64        `json:"start"`
+	End         int64        `json:"end"`
+	Empty       bool         `json:"empty"`
+	Samples     int64        `json:"samples,omitempty"`
+	Min         float64      `json:"min,omitempty"`
+	Max         float64      `json:"max,omitempty"`
+	First       float64      `json:"first,omitempty"`
+	Last        float64      `json:"last,omitempty"`
+	Avg         float64      `json:"avg,omitempty"`
+	Median      float64      `json:"median,omitempty"`
+	Std         float64      `json:"std,omitempty"`
+	Sum         float64      `json:"sum,omitempty"`
+	Percentiles []Percentile `json:"percentiles,omitempty"`
+}
+
+// Percentile one percentile of a stat bucket, quantile is in [0, 100]
+type Percentile struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
 }
 
 // Storage metric data interface
+//
+// time ranges are in ms and end exclusive, reads and deletes use the points
+// in [start, end), stat buckets start at multiples of the bucket duration
 type Storage interface {
 	Name() string
 	Help() string
-	Open(options url.Values)
+	Open(options url.Values) error
 	GetTenants() ([]Tenant, error)
 	GetItemList(tenant string, tags map[string]string) ([]Item, error)
 	GetRawData(tenant string, id string, end int64, start int64, limit int64, order string) ([]DataItem, error)
-	GetStatData(tenant string, id string, end int64, start int64, limit int64, order string, bucketDuration int64) ([]StatItem, error)
+	GetStatData(tenant string, id string, end int64, start int64, limit int64, order string, bucketDuration int64, percentiles []float64) ([]StatItem, error)
 	PostRawData(tenant string, id string, t int64, v float64) error
+	PostBatchData(tenant string, items []BatchItem) error
 	PutTags(tenant string, id string, tags map[string]string) error
 	DeleteData(tenant string, id string, end int64, start int64) error
 	DeleteTags(tenant string, id string, tags []string) error
 }
+
+// NotFoundError a tenant or metric ID that does not exist in the storage,
+// storage plugins return it from read and delete requests, reads never
+// create a tenant or an ID
+type NotFoundError struct {
+	Tenant string
+	ID     string
+}
+
+func (e NotFoundError) Error() string {
+	if e.ID == "" {
+		return fmt.Sprintf("Tenant %s not found", e.Tenant)
+	}
+
+	return fmt.Sprintf("ID %s@%s not found", e.ID, e.Tenant)
+}
+
+// IsNotFound return true if err is a NotFoundError
+func IsNotFound(err error) bool {
+	switch err.(type) {
+	case NotFoundError, *NotFoundError:
+		return true
+	}
+
+	return false
+}
+
+// BadIDError a metric ID that the storage can not store, storage plugins
+// return it from write requests
+type BadIDError struct {
+	ID     string
+	Reason string
+}
+
+func (e BadIDError) Error() string {
+	if e.Reason == "" {
+		return "Bad metrics ID"
+	}
+
+	return fmt.Sprintf("Bad metrics ID %q: %s", e.ID, e.Reason)
+}
+
+// IsBadID return true if err is a BadIDError
+func IsBadID(err error) bool {
+	switch err.(type) {
+	case BadIDError, *BadIDError:
+		return true
+	}
+
+	return false
+}
+
+// ConflictError a point posted at the timestamp of a stored point, storage
+// plugins that do not replace points return it from write requests
+type ConflictError struct {
+	ID        string
+	Timestamp int64
+}
+
+func (e ConflictError) Error() string {
+	return fmt.Sprintf("ID %s already has a point at %d", e.ID, e.Timestamp)
+}
+
+// IsConflict return true if err is a ConflictError
+func IsConflict(err error) bool {
+	switch err.(type) {
+	case ConflictError, *ConflictError:
+		return true
+	}
+
+	return false
+}
+
+// IsPermanent return true if a write that failed with err fails again when
+// retried, e.g. a BadIDError or a ConflictError
+func IsPermanent(err error) bool {
+	return IsBadID(err) || IsConflict(err)
+}
+
+// StatsReporter optional storage interface, a storage that reports
+// internal statistics, e.g. memory usage
+type StatsReporter interface {
+	Stats() map[string]float64
+}
@@ -0,0 +1,408 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package storagetest shared behavior tests for storage plugins
+//
+// A storage plugin test opens the storage and calls Run, e.g.
+//
+// 	func TestStorage(t *testing.T) {
+// 		r := &Storage{}
+// 		if err := r.Open(options); err != nil {
+// 			t.Fatal(err)
+// 		}
+// 		storagetest.Run(t, r)
+// 	}
+package storagetest
+
+import (
+	"math"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/MohawkTSDB/mohawk/src/storage"
+)
+
+// pointsCount number of data points posted by each test
+const pointsCount = 10
+
+// pointsStep time in ms between data points
+const pointsStep = int64(60 * 1000)
+
+// Run run the shared behavior tests on an open storage
+func Run(t *testing.T, r storage.Storage) {
+	t.Run("RawData", func(t *testing.T) { testRawData(t, r) })
+	t.Run("Tags", func(t *testing.T) { testTags(t, r) })
+	t.Run("StatData", func(t *testing.T) { testStatData(t, r) })
+	t.Run("LastValues", func(t *testing.T) { testLastValues(t, r) })
+	t.Run("DeleteData", func(t *testing.T) { testDeleteData(t, r) })
+	t.Run("DeleteUnknownID", func(t *testing.T) { testDeleteUnknownID(t, r) })
+	t.Run("ReadUnknownID", func(t *testing.T) { testReadUnknownID(t, r) })
+	t.Run("UnusualIDs", func(t *testing.T) { testUnusualIDs(t, r) })
+	t.Run("Tenants", func(t *testing.T) { testTenants(t, r) })
+}
+
+// baseTime return a round timestamp in ms, 30 minutes ago
+func baseTime() int64 {
+	now := time.Now().UTC().Unix() * 1000
+	return now - now%pointsStep - 30*pointsStep
+}
+
+// postPoints post pointsCount data points, point i has value i
+func postPoints(t *testing.T, r storage.Storage, tenant string, id string, base int64) {
+	batch := storage.BatchItem{ID: id}
+
+	for i := int64(0); i < pointsCount; i++ {
+		// post half the points one by one, and half using a batch
+		if i%2 == 0 {
+			if err := r.PostRawData(tenant, id, base+i*pointsStep, float64(i)); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			batch.Data = append(batch.Data, storage.DataItem{Timestamp: base + i*pointsStep, Value: float64(i)})
+		}
+	}
+
+	if err := r.PostBatchData(tenant, []storage.BatchItem{batch}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// itemIDs return the sorted ids of a list of items
+func itemIDs(items []storage.Item) []string {
+	ids := make([]string, 0, len(items))
+	for _, i := range items {
+		ids = append(ids, i.ID)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+func testRawData(t *testing.T, r storage.Storage) {
+	tenant := "storagetest-raw"
+	base := baseTime()
+	postPoints(t, r, tenant, "cpu", base)
+
+	res, err := r.GetRawData(tenant, "cpu", base+pointsCount*pointsStep, base, 100, "ASC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != pointsCount {
+		t.Fatalf("expected %d data points, got %d", pointsCount, len(res))
+	}
+	for i, d := range res {
+		if d.Timestamp != base+int64(i)*pointsStep || d.Value != float64(i) {
+			t.Errorf("unexpected data point %d: %+v", i, d)
+		}
+	}
+
+	// get the last 3 points
+	res, err = r.GetRawData(tenant, "cpu", base+pointsCount*pointsStep, base, 3, "DESC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 3 || res[0].Value != pointsCount-1 || res[2].Value != pointsCount-3 {
+		t.Errorf("unexpected data points in DESC order: %+v", res)
+	}
+}
+
+func testTags(t *testing.T, r storage.Storage) {
+	tenant := "storagetest-tags"
+	base := baseTime()
+	postPoints(t, r, tenant, "cpu-a", base)
+	postPoints(t, r, tenant, "cpu-b", base)
+
+	if err := r.PutTags(tenant, "cpu-a", map[string]string{"host": "a", "units": "cores"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.PutTags(tenant, "cpu-b", map[string]string{"host": "b", "units": "cores"}); err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := r.GetItemList(tenant, map[string]string{"host": "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := itemIDs(items); len(ids) != 1 || ids[0] != "cpu-a" {
+		t.Errorf("unexpected items for host a: %+v", ids)
+	}
+
+	items, err = r.GetItemList(tenant, map[string]string{"host": "[ab]"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := itemIDs(items); len(ids) != 2 {
+		t.Errorf("unexpected items for host [ab]: %+v", ids)
+	}
+
+	// delete the host tag of cpu-a, other tags should not change
+	if err = r.DeleteTags(tenant, "cpu-a", []string{"host"}); err != nil {
+		t.Fatal(err)
+	}
+
+	items, err = r.GetItemList(tenant, map[string]string{"host": "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 0 {
+		t.Errorf("deleted tag still matches: %+v", itemIDs(items))
+	}
+
+	items, err = r.GetItemList(tenant, map[string]string{"units": "cores"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := itemIDs(items); len(ids) != 2 {
+		t.Errorf("unexpected items for units cores: %+v", ids)
+	}
+}
+
+func testStatData(t *testing.T, r storage.Storage) {
+	tenant := "storagetest-stats"
+	id := "cpu"
+
+	// two buckets of 5 points, bucket starts are aligned to the bucket duration
+	bucketDuration := int64(5 * pointsStep / 1000)
+	base := baseTime()
+	base -= base % (bucketDuration * 1000)
+
+	// values out of time order, so first, last, min and max differ
+	values := []float64{3, 1, 4, 1, 5, 9, 2, 6, 5, 3}
+	batch := storage.BatchItem{ID: id}
+	for i, v := range values {
+		batch.Data = append(batch.Data, storage.DataItem{Timestamp: base + int64(i)*pointsStep, Value: v})
+	}
+	if err := r.PostBatchData(tenant, []storage.BatchItem{batch}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []storage.StatItem{
+		{Start: base, Samples: 5, First: 3, Last: 5, Min: 1, Max: 5, Avg: 2.8, Median: 3, Std: math.Sqrt(2.56), Sum: 14,
+			Percentiles: []storage.Percentile{{Quantile: 50, Value: 3}, {Quantile: 90, Value: 4.6}}},
+		{Start: base + 5*pointsStep, Samples: 5, First: 9, Last: 3, Min: 2, Max: 9, Avg: 5, Median: 5, Std: math.Sqrt(6), Sum: 25,
+			Percentiles: []storage.Percentile{{Quantile: 50, Value: 5}, {Quantile: 90, Value: 7.8}}},
+	}
+
+	res, err := r.GetStatData(tenant, id, base+int64(len(values))*pointsStep, base, 10, "ASC", bucketDuration, []float64{50, 90})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != len(expected) {
+		t.Fatalf("expected %d buckets, got %d: %+v", len(expected), len(res), res)
+	}
+
+	near := func(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+	for i, e := range expected {
+		s := res[i]
+		if s.Start != e.Start || s.End != e.Start+bucketDuration*1000 || s.Empty || s.Samples != e.Samples {
+			t.Errorf("bucket %d: unexpected times or samples: %+v", i, s)
+		}
+		if !near(s.First, e.First) || !near(s.Last, e.Last) || !near(s.Min, e.Min) || !near(s.Max, e.Max) {
+			t.Errorf("bucket %d: unexpected first, last, min or max: %+v", i, s)
+		}
+		if !near(s.Avg, e.Avg) || !near(s.Median, e.Median) || !near(s.Std, e.Std) || !near(s.Sum, e.Sum) {
+			t.Errorf("bucket %d: unexpected avg, median, std or sum: %+v", i, s)
+		}
+		if len(s.Percentiles) != len(e.Percentiles) {
+			t.Errorf("bucket %d: unexpected percentiles: %+v", i, s.Percentiles)
+			continue
+		}
+		for j, p := range e.Percentiles {
+			if s.Percentiles[j].Quantile != p.Quantile || !near(s.Percentiles[j].Value, p.Value) {
+				t.Errorf("bucket %d: unexpected percentile %v: %+v", i, p.Quantile, s.Percentiles[j])
+			}
+		}
+	}
+
+	// an unaligned start keeps the bucket starts aligned, and only points in
+	// [start, end) are counted, the point at end is not
+	res, err = r.GetStatData(tenant, id, base+9*pointsStep, base+2*pointsStep, 10, "ASC", bucketDuration, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 {
+		t.Fatalf("expected 2 buckets for an unaligned start, got %d: %+v", len(res), res)
+	}
+	if s := res[0]; s.Start != base || s.Samples != 3 || !near(s.First, 4) || !near(s.Sum, 10) {
+		t.Errorf("unaligned start: unexpected first bucket: %+v", s)
+	}
+	if s := res[1]; s.Start != base+5*pointsStep || s.Samples != 4 || !near(s.Last, 5) || !near(s.Sum, 22) {
+		t.Errorf("unaligned start: unexpected last bucket: %+v", s)
+	}
+}
+
+func testLastValues(t *testing.T, r storage.Storage) {
+	tenant := "storagetest-last"
+	base := baseTime()
+	postPoints(t, r, tenant, "cpu", base)
+
+	lastValue := func() storage.DataItem {
+		items, err := r.GetItemList(tenant, map[string]string{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != 1 || len(items[0].LastValues) != 1 {
+			t.Fatalf("unexpected items: %+v", items)
+		}
+		return items[0].LastValues[0]
+	}
+
+	if d := lastValue(); d.Timestamp != base+(pointsCount-1)*pointsStep || d.Value != pointsCount-1 {
+		t.Errorf("unexpected last value: %+v", d)
+	}
+
+	// an older point does not change the last value
+	if err := r.PostRawData(tenant, "cpu", base-pointsStep, 100); err != nil {
+		t.Fatal(err)
+	}
+	if d := lastValue(); d.Value != pointsCount-1 {
+		t.Errorf("unexpected last value after posting an older point: %+v", d)
+	}
+
+	// deleting the last point sets the previous point as last value
+	if err := r.DeleteData(tenant, "cpu", base+pointsCount*pointsStep, base+(pointsCount-1)*pointsStep); err != nil {
+		t.Fatal(err)
+	}
+	if d := lastValue(); d.Timestamp != base+(pointsCount-2)*pointsStep || d.Value != pointsCount-2 {
+		t.Errorf("unexpected last value after delete: %+v", d)
+	}
+}
+
+func testDeleteData(t *testing.T, r storage.Storage) {
+	tenant := "storagetest-delete"
+	base := baseTime()
+	postPoints(t, r, tenant, "cpu", base)
+
+	// delete points 2, 3 and 4
+	if err := r.DeleteData(tenant, "cpu", base+5*pointsStep, base+2*pointsStep); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := r.GetRawData(tenant, "cpu", base+pointsCount*pointsStep, base, 100, "ASC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != pointsCount-3 {
+		t.Fatalf("expected %d data points, got %d", pointsCount-3, len(res))
+	}
+	for _, d := range res {
+		if d.Value >= 2 && d.Value <= 4 {
+			t.Errorf("deleted data point found: %+v", d)
+		}
+	}
+}
+
+func testDeleteUnknownID(t *testing.T, r storage.Storage) {
+	tenant := "storagetest-delete"
+	base := baseTime()
+
+	if err := r.DeleteData(tenant, "no-such-id", base+pointsStep, base); !storage.IsNotFound(err) {
+		t.Errorf("expected a not found error while deleting data of unknown id, got %v", err)
+	}
+	if err := r.DeleteTags(tenant, "no-such-id", []string{"host"}); !storage.IsNotFound(err) {
+		t.Errorf("expected a not found error while deleting tags of unknown id, got %v", err)
+	}
+}
+
+func testReadUnknownID(t *testing.T, r storage.Storage) {
+	tenant := "storagetest-read"
+	base := baseTime()
+	postPoints(t, r, tenant, "cpu", base)
+
+	// unknown ids in known and unknown tenants
+	for _, tenant := range []string{tenant, "storagetest-no-such-tenant"} {
+		if _, err := r.GetRawData(tenant, "no-such-id", base+pointsCount*pointsStep, base, 100, "ASC"); !storage.IsNotFound(err) {
+			t.Errorf("expected a not found error while reading raw data of unknown id, got %v", err)
+		}
+		if _, err := r.GetStatData(tenant, "no-such-id", base+pointsCount*pointsStep, base, 100, "ASC", 60, nil); !storage.IsNotFound(err) {
+			t.Errorf("expected a not found error while reading stat data of unknown id, got %v", err)
+		}
+	}
+
+	// reads should not create ids or tenants
+	items, err := r.GetItemList(tenant, map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := itemIDs(items); len(ids) != 1 || ids[0] != "cpu" {
+		t.Errorf("unexpected items after reading unknown ids: %+v", ids)
+	}
+
+	items, err = r.GetItemList("storagetest-no-such-tenant", map[string]string{})
+	if err != nil || len(items) != 0 {
+		t.Errorf("unexpected items of unknown tenant: %+v, %v", itemIDs(items), err)
+	}
+
+	tenants, err := r.GetTenants()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range tenants {
+		if i.ID == "storagetest-no-such-tenant" {
+			t.Error("reading an unknown tenant created it")
+		}
+	}
+}
+
+func testTenants(t *testing.T, r storage.Storage) {
+	tenant := "storagetest-tenants"
+	postPoints(t, r, tenant, "cpu", baseTime())
+
+	tenants, err := r.GetTenants()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range tenants {
+		if i.ID == tenant {
+			return
+		}
+	}
+	t.Errorf("tenant %s not found in %+v", tenant, tenants)
+}
+
+func testUnusualIDs(t *testing.T, r storage.Storage) {
+	tenant := "storagetest-ids"
+	base := baseTime()
+	ids := []string{
+		`it's "quoted"`,
+		`cpu'; drop table ids; --`,
+		"שלום/мир 😀",
+		"a+b c%20d",
+	}
+
+	for _, id := range ids {
+		postPoints(t, r, tenant, id, base)
+		if err := r.PutTags(tenant, id, map[string]string{"kind": "unusual"}); err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := r.GetRawData(tenant, id, base+pointsCount*pointsStep, base, 100, "ASC")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != pointsCount {
+			t.Errorf("id %q: expected %d data points, got %d", id, pointsCount, len(res))
+		}
+	}
+
+	items, err := r.GetItemList(tenant, map[string]string{"kind": "unusual"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := itemIDs(items); len(got) != len(ids) {
+		t.Errorf("unexpected items: %q", got)
+	}
+}
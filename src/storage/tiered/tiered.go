@@ -0,0 +1,623 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tiered interface for hot and cold tiered metric data storage
+package tiered
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MohawkTSDB/mohawk/src/storage"
+	"github.com/MohawkTSDB/mohawk/src/storage/queue"
+)
+
+// errNoFactory a new error with missing storage factory message
+var errNoFactory = errors.New("tiered: No storage factory, use NewStorage")
+
+// errClosed a new error with closed storage message
+var errClosed = errors.New("tiered: Storage is closed")
+
+// hotSinceFileName the file holding the time since the hot storage holds all
+// written data, in ms
+const hotSinceFileName = "tiered-hot-since"
+
+// writeOp a write waiting for the cold tier worker, done is closed when the
+// write is applied or queued
+type writeOp struct {
+	op   queue.Op
+	done chan struct{}
+}
+
+// Storage a composite storage, all data is written to a hot and a cold
+// storage, reads of recent data use the hot storage, reads of older data
+// and of data written before the storage was opened use the cold storage
+type Storage struct {
+	newStorage       func(name string) (storage.Storage, error)
+	hot              storage.Storage
+	cold             storage.Storage
+	hotName          string
+	coldName         string
+	hotRetentionSec  int64
+	hotSince         int64
+	asyncCold        bool
+	queueSize        int
+	queueDirName     string
+	retryIntervalSec int64
+	coldQueue        *queue.Queue
+	writes           chan writeOp
+	stopped          chan struct{}
+	mutex            sync.RWMutex
+	closed           bool
+	closeOnce        sync.Once
+}
+
+// NewStorage create a tiered storage, newStorage creates the hot and cold
+// storage plugins by name
+func NewStorage(newStorage func(name string) (storage.Storage, error)) *Storage {
+	return &Storage{newStorage: newStorage}
+}
+
+func init() {
+	storage.Register("tiered", func() storage.Storage { return NewStorage(storage.New) })
+}
+
+// Storage functions
+// Required by storage interface
+
+// Name return a human readable storage name
+func (r *Storage) Name() string {
+	return "Storage-Tiered"
+}
+
+// Help return a human readable storage help message
+func (r *Storage) Help() string {
+	return `Tiered storage [tiered]:
+	hot            - (optional) storage used for recent data (default "memory").
+	cold           - (optional) storage used for older data (default "sqlite").
+	hot-retention  - (optional) age of data read from the hot storage, must not be longer
+	                 then the hot storage retention (default "1d").
+	cold-write     - (optional) "sync" write to the cold storage before a post returns,
+	                 or "async" write to the cold storage in the background (default "sync").
+	queue-size     - (optional) max number of async writes waiting for the cold storage (default 1000).
+	queue-dirname  - (optional) a directory for the queue of async writes that failed on the
+	                 cold storage, and for the time since the hot storage holds all
+	                 written data (default ".").
+	retry-interval - (optional) time between retries of queued cold writes (default "10s").
+	hot.<option>   - option of the hot storage.
+	cold.<option>  - option of the cold storage.
+	Examples:
+		--options=hot=memory&cold=sqlite&cold.db-dirname=/data
+		--options=hot-retention=6h&hot.retention=12h&cold=file&cold.db-dirname=/data&cold-write=async`
+}
+
+// Open storage
+func (r *Storage) Open(options url.Values) error {
+	var err error
+
+	if r.newStorage == nil {
+		return errNoFactory
+	}
+
+	// get storage options
+	r.hotName = options.Get("hot")
+	if r.hotName == "" {
+		r.hotName = "memory"
+	}
+	r.coldName = options.Get("cold")
+	if r.coldName == "" {
+		r.coldName = "sqlite"
+	}
+
+	r.hotRetentionSec = int64(24 * 60 * 60)
+	if retentionStr := options.Get("hot-retention"); retentionStr != "" {
+		if r.hotRetentionSec, err = storage.ParseDuration(retentionStr); err != nil || r.hotRetentionSec < 1 {
+			return fmt.Errorf("tiered: Bad hot retention %s", retentionStr)
+		}
+	}
+
+	switch options.Get("cold-write") {
+	case "", "sync":
+		r.asyncCold = false
+	case "async":
+		r.asyncCold = true
+	default:
+		return fmt.Errorf("tiered: Unknown cold write mode %s", options.Get("cold-write"))
+	}
+
+	r.queueSize = 1000
+	if sizeStr := options.Get("queue-size"); sizeStr != "" {
+		if r.queueSize, err = strconv.Atoi(sizeStr); err != nil || r.queueSize < 1 {
+			return fmt.Errorf("tiered: Bad queue size %s", sizeStr)
+		}
+	}
+
+	r.queueDirName = options.Get("queue-dirname")
+	if r.queueDirName == "" {
+		r.queueDirName = "."
+	}
+
+	r.retryIntervalSec = 10
+	if intervalStr := options.Get("retry-interval"); intervalStr != "" {
+		if r.retryIntervalSec, err = storage.ParseDuration(intervalStr); err != nil || r.retryIntervalSec < 1 {
+			return fmt.Errorf("tiered: Bad retry interval %s", intervalStr)
+		}
+	}
+
+	// create and open the tiers
+	if r.hot, err = r.openTier(r.hotName, "hot.", options); err != nil {
+		return err
+	}
+	if r.cold, err = r.openTier(r.coldName, "cold.", options); err != nil {
+		closeStorage(r.hot)
+		return err
+	}
+
+	// a restarted hot storage may be missing recent data, data written before
+	// it holds all written data is read from the cold storage
+	if err = os.MkdirAll(r.queueDirName, 0755); err == nil {
+		r.hotSince, err = r.loadHotSince()
+	}
+	if err != nil {
+		closeStorage(r.hot)
+		closeStorage(r.cold)
+		return fmt.Errorf("tiered: %s", err)
+	}
+
+	// load the cold writes that failed before a restart
+	if r.asyncCold {
+		r.coldQueue, err = queue.Open(r.cold, filepath.Join(r.queueDirName, "tiered-cold.queue"))
+		if err != nil {
+			closeStorage(r.hot)
+			closeStorage(r.cold)
+			return fmt.Errorf("tiered: %s: %s", r.coldName, err)
+		}
+	}
+
+	// log init arguments
+	log.Printf("Start tiered storage:")
+	log.Printf("  hot: %s", r.hot.Name())
+	log.Printf("  cold: %s", r.cold.Name())
+	log.Printf("  hot retention: %ds", r.hotRetentionSec)
+	log.Printf("  hot since: %v", time.Unix(r.hotSince/1000, 0).UTC())
+	log.Printf("  async cold writes: %v", r.asyncCold)
+	if r.asyncCold {
+		log.Printf("  queue dirname: %+v (%d queued writes)", r.queueDirName, r.coldQueue.Len())
+		log.Printf("  retry interval: %ds", r.retryIntervalSec)
+	}
+
+	// start a worker that will write to the cold storage
+	if r.asyncCold {
+		r.writes = make(chan writeOp, r.queueSize)
+		r.stopped = make(chan struct{})
+		go r.writeCold()
+	}
+
+	return nil
+}
+
+// Close wait for queued cold writes, and close the tiers
+func (r *Storage) Close() error {
+	var err error
+
+	r.closeOnce.Do(func() {
+		// wait for writes sending to the cold worker, later writes fail
+		r.mutex.Lock()
+		r.closed = true
+		r.mutex.Unlock()
+
+		if r.writes != nil {
+			close(r.writes)
+			<-r.stopped
+			err = r.coldQueue.Close()
+		}
+
+		if errClose := closeStorage(r.hot); err == nil {
+			err = errClose
+		}
+		if errClose := closeStorage(r.cold); err == nil {
+			err = errClose
+		}
+	})
+
+	return err
+}
+
+func (r *Storage) GetTenants() ([]storage.Tenant, error) {
+	res := make([]storage.Tenant, 0)
+	found := make(map[string]bool)
+
+	for _, s := range []storage.Storage{r.hot, r.cold} {
+		tenants, err := s.GetTenants()
+		if err != nil {
+			return res, err
+		}
+		for _, t := range tenants {
+			if !found[t.ID] {
+				found[t.ID] = true
+				res = append(res, t)
+			}
+		}
+	}
+
+	return res, nil
+}
+
+func (r *Storage) GetItemList(tenant string, tags map[string]string) ([]storage.Item, error) {
+	res := make([]storage.Item, 0)
+	found := make(map[string]int)
+
+	for _, s := range []storage.Storage{r.hot, r.cold} {
+		items, err := s.GetItemList(tenant, tags)
+		if err != nil {
+			return res, err
+		}
+
+		for _, item := range items {
+			i, ok := found[item.ID]
+			if !ok {
+				found[item.ID] = len(res)
+				res = append(res, item)
+				continue
+			}
+
+			// the hot item is listed first, use the newer last value
+			if newerLastValue(item, res[i]) {
+				res[i].LastValues = item.LastValues
+			}
+		}
+	}
+
+	return res, nil
+}
+
+func (r *Storage) GetRawData(tenant string, id string, end int64, start int64, limit int64, order string) ([]storage.DataItem, error) {
+	res := make([]storage.DataItem, 0)
+	boundary := r.boundary()
+
+	// read the tiers in the requested order, until the limit
+	ranges := r.split(end, start, boundary)
+	if order == "DESC" {
+		ranges[0], ranges[1] = ranges[1], ranges[0]
+	}
+
+	found := false
+	for _, t := range ranges {
+		// an empty range only checks that the id exists in the tier
+		if int64(len(res)) >= limit {
+			t.end = t.start
+		}
+		if t.end <= t.start && found {
+			continue
+		}
+
+		data, err := t.s.GetRawData(tenant, id, t.end, t.start, maxInt64(limit-int64(len(res)), 1), order)
+		if storage.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return res, err
+		}
+		found = true
+		res = append(res, data...)
+	}
+
+	if !found {
+		return res, storage.NotFoundError{Tenant: tenant, ID: id}
+	}
+
+	return res, nil
+}
+
+func (r *Storage) GetStatData(tenant string, id string, end int64, start int64, limit int64, order string, bucketDuration int64, percentiles []float64) ([]storage.StatItem, error) {
+	res := make([]storage.StatItem, 0)
+
+	// a bucket is read from one tier, the boundary is rounded up to a bucket
+	// start aligned to the bucket duration, like the storages align
+	// buckets, so no bucket holds points of both tiers
+	boundary := r.boundary()
+	bucketMili := bucketDuration * 1000
+	if bucketMili > 0 && boundary > start {
+		boundary = (boundary + bucketMili - 1) / bucketMili * bucketMili
+	}
+
+	ranges := r.split(end, start, boundary)
+	if order == "DESC" {
+		ranges[0], ranges[1] = ranges[1], ranges[0]
+	}
+
+	found := false
+	for _, t := range ranges {
+		// an empty range only checks that the id exists in the tier
+		if int64(len(res)) >= limit {
+			t.end = t.start
+		}
+		if t.end <= t.start && found {
+			continue
+		}
+
+		data, err := t.s.GetStatData(tenant, id, t.end, t.start, maxInt64(limit-int64(len(res)), 1), order, bucketDuration, percentiles)
+		if storage.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return res, err
+		}
+		found = true
+		res = append(res, data...)
+	}
+
+	if !found {
+		return res, storage.NotFoundError{Tenant: tenant, ID: id}
+	}
+
+	return res, nil
+}
+
+// PostRawData handle posting data to db
+func (r *Storage) PostRawData(tenant string, id string, t int64, v float64) error {
+	return r.write(queue.Op{Op: queue.OpPostRawData, Tenant: tenant, ID: id, T: t, V: v})
+}
+
+// PostBatchData handle posting a batch of data points to db
+func (r *Storage) PostBatchData(tenant string, items []storage.BatchItem) error {
+	return r.write(queue.Op{Op: queue.OpPostBatchData, Tenant: tenant, Items: items})
+}
+
+// PutTags handle posting tags to db
+func (r *Storage) PutTags(tenant string, id string, tags map[string]string) error {
+	return r.write(queue.Op{Op: queue.OpPutTags, Tenant: tenant, ID: id, Tags: tags})
+}
+
+// DeleteData handle delete data fron db
+func (r *Storage) DeleteData(tenant string, id string, end int64, start int64) error {
+	return r.delete(queue.Op{Op: queue.OpDeleteData, Tenant: tenant, ID: id, End: end, Start: start})
+}
+
+// DeleteTags handle delete tags fron db
+func (r *Storage) DeleteTags(tenant string, id string, tags []string) error {
+	return r.delete(queue.Op{Op: queue.OpDeleteTags, Tenant: tenant, ID: id, Keys: tags})
+}
+
+// Helper functions
+// Not required by storage interface
+
+// tierRange a time range read from one tier
+type tierRange struct {
+	s     storage.Storage
+	end   int64
+	start int64
+}
+
+// boundary return the oldest timestamp read from the hot storage, older
+// data and data written before the storage was opened is read from the
+// cold storage
+func (r *Storage) boundary() int64 {
+	return maxInt64((time.Now().Unix()-r.hotRetentionSec)*1000, r.hotSince)
+}
+
+// split split a time range into a cold range and a hot range
+func (r *Storage) split(end int64, start int64, boundary int64) []tierRange {
+	if boundary < start {
+		boundary = start
+	}
+	if boundary > end {
+		boundary = end
+	}
+
+	return []tierRange{
+		{s: r.cold, end: boundary, start: start},
+		{s: r.hot, end: end, start: boundary},
+	}
+}
+
+// write write to the hot storage, and to the cold storage or the cold worker
+func (r *Storage) write(o queue.Op) error {
+	if err := o.Do(r.hot); err != nil {
+		return err
+	}
+
+	if r.asyncCold {
+		return r.send(writeOp{op: o})
+	}
+
+	return o.Do(r.cold)
+}
+
+// delete delete from both tiers, an async cold delete is applied after the
+// writes of the cold worker and the cold queue, an id is not found only if
+// it is not found in both tiers
+func (r *Storage) delete(o queue.Op) error {
+	if err := r.drain(); err != nil {
+		return err
+	}
+
+	errHot := o.Do(r.hot)
+	if errHot != nil && !storage.IsNotFound(errHot) {
+		return errHot
+	}
+
+	var errCold error
+	if r.asyncCold {
+		errCold = r.coldQueue.Write(o)
+	} else {
+		errCold = o.Do(r.cold)
+	}
+	if errCold != nil && !storage.IsNotFound(errCold) {
+		return errCold
+	}
+	if errHot != nil && errCold != nil {
+		return errHot
+	}
+
+	return nil
+}
+
+// drain wait until the cold worker applied or queued all writes
+func (r *Storage) drain() error {
+	if !r.asyncCold {
+		return nil
+	}
+
+	done := make(chan struct{})
+	if err := r.send(writeOp{done: done}); err != nil {
+		return err
+	}
+	<-done
+
+	return nil
+}
+
+// send send a write to the cold worker, or fail if the storage is closed
+func (r *Storage) send(w writeOp) error {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if r.closed {
+		return errClosed
+	}
+	r.writes <- w
+
+	return nil
+}
+
+// loadHotSince return the saved time since the hot storage holds all
+// written data, a hot storage that holds no data, e.g. a restarted memory
+// storage, holds the data written from now
+func (r *Storage) loadHotSince() (int64, error) {
+	fileName := filepath.Join(r.queueDirName, hotSinceFileName)
+
+	tenants, err := r.hot.GetTenants()
+	if err != nil {
+		return 0, err
+	}
+	if len(tenants) > 0 {
+		if b, err := ioutil.ReadFile(fileName); err == nil {
+			if hotSince, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64); err == nil {
+				return hotSince, nil
+			}
+		}
+	}
+
+	hotSince := time.Now().Unix() * 1000
+	err = ioutil.WriteFile(fileName, []byte(strconv.FormatInt(hotSince, 10)), 0644)
+
+	return hotSince, err
+}
+
+// writeCold write to the cold storage, writes that failed are queued and
+// retried periodically
+func (r *Storage) writeCold() {
+	defer close(r.stopped)
+
+	c := time.NewTicker(time.Duration(r.retryIntervalSec) * time.Second)
+	defer c.Stop()
+
+	for {
+		select {
+		case w, ok := <-r.writes:
+			if !ok {
+				return
+			}
+			if w.done != nil {
+				close(w.done)
+				continue
+			}
+
+			if err := r.coldQueue.Write(w.op); err != nil && !storage.IsNotFound(err) {
+				log.Printf("tiered: %s: Can't queue write: %s\n", r.cold.Name(), err)
+			}
+		case <-c.C:
+			r.retry()
+		}
+	}
+}
+
+// retry apply the queued cold writes
+func (r *Storage) retry() {
+	if r.coldQueue.Len() == 0 {
+		return
+	}
+
+	n, err := r.coldQueue.Retry()
+	if n > 0 {
+		log.Printf("tiered: %s: applied %d queued writes, %d left\n", r.cold.Name(), n, r.coldQueue.Len())
+	}
+	if err != nil {
+		log.Printf("tiered: %s: retry: %s\n", r.cold.Name(), err)
+	}
+}
+
+// openTier create and open a tier storage, options starting with the prefix
+// are passed to the tier without the prefix
+func (r *Storage) openTier(name string, prefix string, options url.Values) (storage.Storage, error) {
+	s, err := r.newStorage(name)
+	if err != nil {
+		return nil, err
+	}
+
+	tierOptions := url.Values{}
+	for k, v := range options {
+		if strings.HasPrefix(k, prefix) {
+			tierOptions[k[len(prefix):]] = v
+		}
+	}
+
+	if err = s.Open(tierOptions); err != nil {
+		return nil, fmt.Errorf("tiered: %s: %s", name, err)
+	}
+
+	return s, nil
+}
+
+// closeStorage close a storage that implements io.Closer
+func closeStorage(s storage.Storage) error {
+	if c, ok := s.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+// maxInt64 return the larger of two numbers
+func maxInt64(a int64, b int64) int64 {
+	if a > b {
+		return a
+	}
+
+	return b
+}
+
+// newerLastValue check if an item has a newer last value then another item
+func newerLastValue(item storage.Item, other storage.Item) bool {
+	if len(item.LastValues) == 0 {
+		return false
+	}
+	if len(other.LastValues) == 0 {
+		return true
+	}
+
+	return item.LastValues[0].Timestamp > other.LastValues[0].Timestamp
+}
@@ -0,0 +1,321 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tiered interface for hot and cold tiered metric data storage
+package tiered
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/MohawkTSDB/mohawk/src/storage"
+	_ "github.com/MohawkTSDB/mohawk/src/storage/file"
+	"github.com/MohawkTSDB/mohawk/src/storage/memory"
+	_ "github.com/MohawkTSDB/mohawk/src/storage/sqlite"
+	"github.com/MohawkTSDB/mohawk/src/storage/storagetest"
+)
+
+func init() {
+	storage.Register("flaky", func() storage.Storage { return &flakyStorage{} })
+}
+
+// flakyStorage a memory storage that fails writes while down
+type flakyStorage struct {
+	memory.Storage
+	down bool
+}
+
+func (r *flakyStorage) PostRawData(tenant string, id string, t int64, v float64) error {
+	if r.down {
+		return errors.New("flaky: down")
+	}
+
+	return r.Storage.PostRawData(tenant, id, t, v)
+}
+
+// openStorage open a tiered storage with a memory hot tier and a file cold tier
+func openStorage(t *testing.T, dir string, options url.Values) *Storage {
+	options.Set("hot", "memory")
+	options.Set("hot.granularity", "1s")
+	options.Set("cold", "file")
+	options.Set("cold.db-dirname", dir)
+	if options.Get("queue-dirname") == "" {
+		options.Set("queue-dirname", dir)
+	}
+
+	r := NewStorage(storage.New)
+	if err := r.Open(options); err != nil {
+		t.Fatal(err)
+	}
+
+	return r
+}
+
+func TestStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mohawk-tiered")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the shared tests post points 21 to 30 minutes ago, reads are split between the tiers
+	r := openStorage(t, dir, url.Values{"hot-retention": {"25mn"}})
+	defer r.Close()
+	r.hotSince = 0
+
+	storagetest.Run(t, r)
+}
+
+func TestSqliteColdStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mohawk-tiered")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := NewStorage(storage.New)
+	err = r.Open(url.Values{"hot": {"memory"}, "cold": {"sqlite"}, "cold.db-dirname": {dir}, "hot-retention": {"15mn"}, "queue-dirname": {dir}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	r.hotSince = 0
+
+	// one point a minute, the boundary is inside a 10mn bucket
+	minuteMili := int64(60 * 1000)
+	now := time.Now().Unix() * 1000
+	now -= now % minuteMili
+	start := now - 40*minuteMili
+	start -= start % (10 * minuteMili)
+	n := 0
+	for ts := start; ts < now; ts += minuteMili {
+		if err = r.PostRawData("tenant", "cpu", ts, 1); err != nil {
+			t.Fatal(err)
+		}
+		n++
+	}
+
+	// every point is counted once
+	res, err := r.GetStatData("tenant", "cpu", now, start, 100, "ASC", 600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples := int64(0)
+	for i, b := range res {
+		samples += b.Samples
+		if i > 0 && b.Start != res[i-1].End {
+			t.Errorf("buckets overlap or have gaps: %+v", res)
+		}
+	}
+	if samples != int64(n) {
+		t.Errorf("expected %d samples, got %d: %+v", n, samples, res)
+	}
+}
+
+func TestColdOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mohawk-tiered")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := openStorage(t, dir, url.Values{"hot-retention": {"1h"}})
+	defer r.Close()
+
+	// a recent point found only in the cold tier, e.g. after a hot memory tier restart
+	now := r.hotSince
+	if err = r.cold.PostRawData("tenant", "cpu", now-1000, 42); err != nil {
+		t.Fatal(err)
+	}
+
+	// points written before the storage was opened are read from the cold tier
+	res, err := r.GetRawData("tenant", "cpu", now+1000, now-60*1000, 10, "ASC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].Value != 42 {
+		t.Errorf("expected the cold point, got %+v", res)
+	}
+	stats, err := r.GetStatData("tenant", "cpu", now+1000, now-60*1000, 10, "ASC", 60, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples := int64(0)
+	for _, b := range stats {
+		samples += b.Samples
+	}
+	if samples != 1 {
+		t.Errorf("expected one cold sample, got %+v", stats)
+	}
+
+	items, err := r.GetItemList("tenant", map[string]string{})
+	if err != nil || len(items) != 1 || len(items[0].LastValues) != 1 || items[0].LastValues[0].Value != 42 {
+		t.Errorf("unexpected items: %+v, %v", items, err)
+	}
+
+	if err = r.DeleteData("tenant", "cpu", now, now-60*1000); err != nil {
+		t.Errorf("delete of an id found only in the cold tier: %v", err)
+	}
+}
+
+func TestAsyncColdWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mohawk-tiered")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := openStorage(t, dir, url.Values{"cold-write": {"async"}, "queue-size": {"2"}, "queue-dirname": {dir}})
+	defer r.Close()
+
+	now := time.Now().Unix() * 1000
+	for i := int64(0); i < 10; i++ {
+		if err = r.PostRawData("tenant", "cpu", now-i*1000, float64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a delete waits for queued writes, and then deletes from both tiers
+	if err = r.DeleteData("tenant", "cpu", now-4999, now-9000); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []storage.Storage{r.hot, r.cold} {
+		res, err := s.GetRawData("tenant", "cpu", now+1, now-10000, 100, "ASC")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != 5 {
+			t.Errorf("%s: expected 5 points, got %+v", s.Name(), res)
+		}
+	}
+}
+
+func TestAsyncColdRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mohawk-tiered")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := NewStorage(storage.New)
+	err = r.Open(url.Values{"hot": {"memory"}, "hot.granularity": {"1s"}, "cold": {"flaky"}, "cold.granularity": {"1s"}, "cold-write": {"async"}, "queue-dirname": {dir}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	cold := r.cold.(*flakyStorage)
+
+	// writes that failed on the cold tier are queued, and not lost
+	now := time.Now().Unix() * 1000
+	cold.down = true
+	for i := int64(0); i < 3; i++ {
+		if err = r.PostRawData("tenant", "cpu", now-i*1000, float64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.drain()
+	if n := r.coldQueue.Len(); n != 3 {
+		t.Fatalf("expected 3 queued cold writes, got %d", n)
+	}
+
+	cold.down = false
+	r.retry()
+	if n := r.coldQueue.Len(); n != 0 {
+		t.Errorf("expected no queued cold writes after retry, got %d", n)
+	}
+	res, err := cold.GetRawData("tenant", "cpu", now+1, now-10000, 10, "ASC")
+	if err != nil || len(res) != 3 {
+		t.Errorf("unexpected cold points: %+v, %v", res, err)
+	}
+}
+
+func TestWriteAfterClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mohawk-tiered")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := openStorage(t, dir, url.Values{"cold-write": {"async"}})
+	if err = r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// writes to a closed storage fail, and do not send to the stopped worker
+	now := time.Now().Unix() * 1000
+	if err = r.PostRawData("tenant", "cpu", now, 1); err != errClosed {
+		t.Errorf("expected a closed storage error, got %v", err)
+	}
+	if err = r.DeleteData("tenant", "cpu", now, now-1000); err != errClosed {
+		t.Errorf("expected a closed storage error, got %v", err)
+	}
+}
+
+func TestHotSince(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mohawk-tiered")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	open := func(hot string) *Storage {
+		r := NewStorage(storage.New)
+		err := r.Open(url.Values{"hot": {hot}, "hot.db-dirname": {dir + "/hot"}, "cold": {"file"}, "cold.db-dirname": {dir + "/cold"}, "queue-dirname": {dir}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	r := open("file")
+	hotSince := r.hotSince
+	if err = r.PostRawData("tenant", "cpu", hotSince, 1); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	time.Sleep(time.Second)
+
+	// a hot storage that kept its data keeps the time since it holds all data
+	r = open("file")
+	if r.hotSince != hotSince {
+		t.Errorf("expected hot since %d, got %d", hotSince, r.hotSince)
+	}
+	r.Close()
+
+	// a hot storage that lost its data holds the data written from now
+	r = open("memory")
+	if r.hotSince <= hotSince {
+		t.Errorf("expected hot since after %d, got %d", hotSince, r.hotSince)
+	}
+	r.Close()
+}
+
+func TestOpenErrors(t *testing.T) {
+	for _, options := range []url.Values{
+		{"hot-retention": {"1x"}},
+		{"cold-write": {"later"}},
+		{"queue-size": {"0"}},
+		{"retry-interval": {"0"}},
+	} {
+		r := NewStorage(storage.New)
+		if err := r.Open(options); err == nil {
+			t.Errorf("%v: expected an error", options)
+		}
+	}
+}
@@ -17,7 +17,9 @@
 package storage
 
 import (
+	"fmt"
 	"log"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -34,22 +36,63 @@ func FilterItems(vs []Item, f func(Item) bool) []Item {
 	return vsf
 }
 
+// Median return the median of a list of values, the mean of the two middle
+// values for a list of even length, the list is sorted in place
+func Median(values []float64) float64 {
+	n := len(values)
+	if n == 0 {
+		return 0
+	}
+
+	sort.Float64s(values)
+	if n%2 == 1 {
+		return values[n/2]
+	}
+
+	return (values[n/2-1] + values[n/2]) / 2
+}
+
+// PostBatchDataLoop post a batch of data points one point at a time,
+// used by storage plugins that do not implement a native batch write
+func PostBatchDataLoop(s Storage, tenant string, items []BatchItem) error {
+	for _, item := range items {
+		for _, d := range item.Data {
+			if err := s.PostRawData(tenant, item.ID, d.Timestamp, d.Value); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
 // ParseSec parse a time string into seconds,
-// posible postfix - s, mn, h, d
+// posible postfix - s, mn, h, d, y
 // e.g. "2h" => 2 * 60 * 60
 func ParseSec(t string) int64 {
+	i, err := ParseDuration(t)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return i
+}
+
+// ParseDuration parse a time string into seconds like ParseSec, and return
+// an error if the string can not be parsed
+func ParseDuration(t string) (int64, error) {
 	var err error
 	var i int
 
 	if len(t) < 2 {
-		log.Fatal("Can't parse time ", t)
+		return 0, fmt.Errorf("Can't parse time %s", t)
 	}
 
 	// check for ms and mn
 	switch t[len(t)-2:] {
 	case "mn":
 		if i, err = strconv.Atoi(t[:len(t)-2]); err == nil {
-			return int64(i) * 60
+			return int64(i) * 60, nil
 		}
 	}
 
@@ -57,22 +100,24 @@ func ParseSec(t string) int64 {
 	switch t[len(t)-1:] {
 	case "s":
 		if i, err = strconv.Atoi(t[:len(t)-1]); err == nil {
-			return int64(i)
+			return int64(i), nil
 		}
 	case "h":
 		if i, err = strconv.Atoi(t[:len(t)-1]); err == nil {
-			return int64(i) * 60 * 60
+			return int64(i) * 60 * 60, nil
 		}
 	case "d":
 		if i, err = strconv.Atoi(t[:len(t)-1]); err == nil {
-			return int64(i) * 60 * 60 * 24
+			return int64(i) * 60 * 60 * 24, nil
+		}
+	case "y":
+		if i, err = strconv.Atoi(t[:len(t)-1]); err == nil {
+			return int64(i) * 60 * 60 * 24 * 365, nil
 		}
 	}
 
 	// if here must be an error
-	log.Fatal("Can't parse time ", t)
-
-	return 0
+	return 0, fmt.Errorf("Can't parse time %s", t)
 }
 
 // ParseTags takes a comma separeted key:value list string and returns a map[string]string
@@ -0,0 +1,556 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package wal write ahead log used by the storage plugins
+//
+// A log is a directory of numbered segment files, records are appended to
+// the newest segment, a storage rotates the log when it saves its state, and
+// removes the segments older than the saved state. Each record is written as:
+//
+//	uint32 payload length, uint32 payload crc32, payload
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MohawkTSDB/mohawk/src/storage"
+)
+
+// sync policies
+const (
+	SyncInterval = iota
+	SyncAlways
+	SyncNever
+)
+
+// SyncPolicyNames the names of the sync policies
+var SyncPolicyNames = []string{"interval", "always", "never"}
+
+// record types
+const (
+	RecordData byte = iota + 1
+	RecordTags
+	RecordDeleteData
+	RecordDeleteTags
+)
+
+// segmentPrefix and segmentSuffix wrap the segment sequence number in segment file names
+const segmentPrefix = "wal-"
+const segmentSuffix = ".log"
+
+// ErrBadRecord a new error with bad write ahead log record message
+var ErrBadRecord = errors.New("wal: Bad write ahead log record")
+
+// ErrClosed a new error with closed write ahead log message
+var ErrClosed = errors.New("wal: Write ahead log is closed")
+
+// Record one write ahead log record
+type Record struct {
+	Type   byte
+	Tenant string
+	ID     string
+	Data   []storage.DataItem
+	Tags   map[string]string
+	End    int64
+	Start  int64
+	Keys   []string
+}
+
+// Log an append-only write ahead log, made of numbered segment files
+type Log struct {
+	mutex      sync.Mutex
+	dir        string
+	syncPolicy int
+	seq        int64
+	file       *os.File
+	w          *bufio.Writer
+	dirty      bool
+	closed     bool
+}
+
+// ParseSyncPolicy parse a sync policy name
+func ParseSyncPolicy(s string) (int, error) {
+	if s == "" {
+		return SyncInterval, nil
+	}
+
+	for i, name := range SyncPolicyNames {
+		if s == name {
+			return i, nil
+		}
+	}
+
+	return 0, fmt.Errorf("wal: Unknown sync policy %s", s)
+}
+
+// Open open a write ahead log directory, new records are written to a new segment
+//
+// appended records are written to the segment file before Append returns,
+// the always policy also syncs them to disk, the interval policy leaves
+// syncing to Sync calls, and the never policy leaves it to the file system
+func Open(dir string, syncPolicy int) (*Log, error) {
+	w := &Log{dir: dir, syncPolicy: syncPolicy}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	segments, err := w.Segments()
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) > 0 {
+		w.seq = segments[len(segments)-1]
+	}
+
+	// never append to an old segment, it may end with a partial record
+	if err = w.openSegment(w.seq + 1); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// segmentFileName return the file name of a segment
+func (w *Log) segmentFileName(seq int64) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%s%016d%s", segmentPrefix, seq, segmentSuffix))
+}
+
+// Segments return a sorted list of segment sequence numbers
+func (w *Log) Segments() ([]int64, error) {
+	var seq int64
+
+	files, err := ioutil.ReadDir(w.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]int64, 0)
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		if _, err := fmt.Sscanf(name[len(segmentPrefix):len(name)-len(segmentSuffix)], "%d", &seq); err == nil {
+			res = append(res, seq)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+
+	return res, nil
+}
+
+// openSegment open a new segment file for writing, caller must hold the log lock
+func (w *Log) openSegment(seq int64) error {
+	f, err := os.OpenFile(w.segmentFileName(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	w.seq = seq
+	w.file = f
+	w.w = bufio.NewWriter(f)
+	w.dirty = false
+
+	return nil
+}
+
+// closeSegment sync and close the current segment, caller must hold the log lock
+func (w *Log) closeSegment() error {
+	var err error
+
+	if w.dirty && w.syncPolicy != SyncNever {
+		err = w.file.Sync()
+	}
+	if errClose := w.file.Close(); err == nil {
+		err = errClose
+	}
+	w.dirty = false
+
+	return err
+}
+
+// Append write records to the current segment
+func (w *Log) Append(recs ...*Record) error {
+	var header [8]byte
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+
+	for _, rec := range recs {
+		payload := encodeRecord(rec)
+		binary.LittleEndian.PutUint32(header[0:4], uint32(len(payload)))
+		binary.LittleEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(payload))
+
+		if _, err := w.w.Write(header[:]); err != nil {
+			return err
+		}
+		if _, err := w.w.Write(payload); err != nil {
+			return err
+		}
+	}
+
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	w.dirty = true
+
+	if w.syncPolicy == SyncAlways {
+		return w.sync()
+	}
+
+	return nil
+}
+
+// sync sync written records to disk, caller must hold the log lock
+func (w *Log) sync() error {
+	if !w.dirty {
+		return nil
+	}
+
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.dirty = false
+
+	return nil
+}
+
+// Sync sync written records to disk
+func (w *Log) Sync() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return nil
+	}
+
+	return w.sync()
+}
+
+// Syncs sync written records periodically, until the log is closed
+func (w *Log) Syncs(interval time.Duration) {
+	c := time.NewTicker(interval)
+	defer c.Stop()
+
+	for range c.C {
+		w.mutex.Lock()
+		if w.closed {
+			w.mutex.Unlock()
+			return
+		}
+		err := w.sync()
+		w.mutex.Unlock()
+
+		if err != nil {
+			log.Printf("wal: %s\n", err)
+		}
+	}
+}
+
+// Rotate close the current segment and start a new one,
+// returns the sequence number of the new segment
+func (w *Log) Rotate() (int64, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return 0, ErrClosed
+	}
+	if err := w.closeSegment(); err != nil {
+		return 0, err
+	}
+	if err := w.openSegment(w.seq + 1); err != nil {
+		return 0, err
+	}
+
+	return w.seq, nil
+}
+
+// Close sync and close the current segment
+func (w *Log) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	return w.closeSegment()
+}
+
+// RemoveBefore delete all segments older than seq
+func (w *Log) RemoveBefore(seq int64) error {
+	segments, err := w.Segments()
+	if err != nil {
+		return err
+	}
+
+	for _, s := range segments {
+		if s >= seq {
+			break
+		}
+		if err = os.Remove(w.segmentFileName(s)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RemoveOlderThan delete all closed segments last written before t
+func (w *Log) RemoveOlderThan(t time.Time) error {
+	w.mutex.Lock()
+	current := w.seq
+	w.mutex.Unlock()
+
+	segments, err := w.Segments()
+	if err != nil {
+		return err
+	}
+
+	for _, s := range segments {
+		if s >= current {
+			break
+		}
+
+		info, err := os.Stat(w.segmentFileName(s))
+		if err != nil {
+			return err
+		}
+		if info.ModTime().Before(t) {
+			if err = os.Remove(w.segmentFileName(s)); err != nil {
+				return err
+			}
+			log.Printf("wal: removed expired segment %s\n", w.segmentFileName(s))
+		}
+	}
+
+	return nil
+}
+
+// Replay read all the records in the closed segments starting at seq,
+// a partial or corrupt record ends the replay of its segment
+func (w *Log) Replay(seq int64, apply func(rec *Record)) (int, error) {
+	count := 0
+
+	w.mutex.Lock()
+	current := w.seq
+	w.mutex.Unlock()
+
+	segments, err := w.Segments()
+	if err != nil {
+		return count, err
+	}
+
+	for _, s := range segments {
+		if s < seq || s >= current {
+			continue
+		}
+
+		n, err := w.replaySegment(s, apply)
+		count += n
+		if err == ErrBadRecord || err == io.ErrUnexpectedEOF {
+			log.Printf("wal: segment %s ends with a bad record, skipping the rest of it\n", w.segmentFileName(s))
+		} else if err != nil {
+			return count, err
+		}
+	}
+
+	return count, nil
+}
+
+// replaySegment read all the records in one segment
+func (w *Log) replaySegment(seq int64, apply func(rec *Record)) (int, error) {
+	var header [8]byte
+
+	count := 0
+
+	f, err := os.Open(w.segmentFileName(seq))
+	if err != nil {
+		return count, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for {
+		if _, err = io.ReadFull(reader, header[:]); err == io.EOF {
+			return count, nil
+		} else if err != nil {
+			return count, io.ErrUnexpectedEOF
+		}
+
+		payload := make([]byte, binary.LittleEndian.Uint32(header[0:4]))
+		if _, err = io.ReadFull(reader, payload); err != nil {
+			return count, io.ErrUnexpectedEOF
+		}
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:8]) {
+			return count, ErrBadRecord
+		}
+
+		rec, err := decodeRecord(payload)
+		if err != nil {
+			return count, err
+		}
+
+		apply(rec)
+		count++
+	}
+}
+
+// encodeRecord encode a record payload
+func encodeRecord(rec *Record) []byte {
+	var b bytes.Buffer
+	var buf [binary.MaxVarintLen64]byte
+
+	putUvarint := func(v uint64) {
+		b.Write(buf[:binary.PutUvarint(buf[:], v)])
+	}
+	putString := func(s string) {
+		putUvarint(uint64(len(s)))
+		b.WriteString(s)
+	}
+	putUint64 := func(v uint64) {
+		binary.LittleEndian.PutUint64(buf[:8], v)
+		b.Write(buf[:8])
+	}
+
+	b.WriteByte(rec.Type)
+	putString(rec.Tenant)
+	putString(rec.ID)
+
+	switch rec.Type {
+	case RecordData:
+		putUvarint(uint64(len(rec.Data)))
+		for _, d := range rec.Data {
+			putUint64(uint64(d.Timestamp))
+			putUint64(math.Float64bits(d.Value))
+		}
+	case RecordTags:
+		putUvarint(uint64(len(rec.Tags)))
+		for k, v := range rec.Tags {
+			putString(k)
+			putString(v)
+		}
+	case RecordDeleteData:
+		putUint64(uint64(rec.End))
+		putUint64(uint64(rec.Start))
+	case RecordDeleteTags:
+		putUvarint(uint64(len(rec.Keys)))
+		for _, k := range rec.Keys {
+			putString(k)
+		}
+	}
+
+	return b.Bytes()
+}
+
+// decodeRecord decode a record payload
+func decodeRecord(payload []byte) (*Record, error) {
+	var err error
+
+	b := bytes.NewReader(payload)
+	getUvarint := func() uint64 {
+		if err != nil {
+			return 0
+		}
+		var v uint64
+		v, err = binary.ReadUvarint(b)
+		return v
+	}
+	getString := func() string {
+		l := getUvarint()
+		if err != nil || l > uint64(b.Len()) {
+			err = ErrBadRecord
+			return ""
+		}
+		s := make([]byte, l)
+		_, err = io.ReadFull(b, s)
+		return string(s)
+	}
+	getUint64 := func() uint64 {
+		var buf [8]byte
+		if err != nil {
+			return 0
+		}
+		_, err = io.ReadFull(b, buf[:])
+		return binary.LittleEndian.Uint64(buf[:])
+	}
+
+	rec := &Record{}
+	if rec.Type, err = b.ReadByte(); err != nil {
+		return nil, ErrBadRecord
+	}
+	rec.Tenant = getString()
+	rec.ID = getString()
+
+	switch rec.Type {
+	case RecordData:
+		n := getUvarint()
+		if err == nil && n > uint64(b.Len()/16) {
+			return nil, ErrBadRecord
+		}
+		rec.Data = make([]storage.DataItem, 0, n)
+		for i := uint64(0); err == nil && i < n; i++ {
+			t := int64(getUint64())
+			v := math.Float64frombits(getUint64())
+			rec.Data = append(rec.Data, storage.DataItem{Timestamp: t, Value: v})
+		}
+	case RecordTags:
+		n := getUvarint()
+		rec.Tags = make(map[string]string)
+		for i := uint64(0); err == nil && i < n; i++ {
+			k := getString()
+			rec.Tags[k] = getString()
+		}
+	case RecordDeleteData:
+		rec.End = int64(getUint64())
+		rec.Start = int64(getUint64())
+	case RecordDeleteTags:
+		n := getUvarint()
+		rec.Keys = make([]string, 0)
+		for i := uint64(0); err == nil && i < n; i++ {
+			rec.Keys = append(rec.Keys, getString())
+		}
+	default:
+		return nil, ErrBadRecord
+	}
+
+	if err != nil {
+		return nil, ErrBadRecord
+	}
+
+	return rec, nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2016,2017,2018 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package wal write ahead log used by the storage plugins
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/MohawkTSDB/mohawk/src/storage"
+)
+
+func TestRecordEncoding(t *testing.T) {
+	rec := &Record{
+		Type:   RecordData,
+		Tenant: "_ops",
+		ID:     "cpu/usage",
+		Data:   []storage.DataItem{{Timestamp: 1, Value: 1.5}, {Timestamp: 2, Value: -3}},
+	}
+
+	decoded, err := decodeRecord(encodeRecord(rec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Tenant != rec.Tenant || decoded.ID != rec.ID || len(decoded.Data) != 2 || decoded.Data[1] != rec.Data[1] {
+		t.Errorf("unexpected decoded record %+v", decoded)
+	}
+
+	// a truncated payload must not decode
+	payload := encodeRecord(rec)
+	if _, err = decodeRecord(payload[:len(payload)-3]); err == nil {
+		t.Error("no error while decoding a truncated record")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mohawk-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := Open(dir, SyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Append(&Record{Type: RecordTags, ID: "a", Tags: map[string]string{"units": "byte"}})
+	seq, err := w.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Append(&Record{Type: RecordData, ID: "a", Data: []storage.DataItem{{Timestamp: 1, Value: 1}}}, &Record{Type: RecordDeleteTags, ID: "a", Keys: []string{"units"}})
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Append(&Record{Type: RecordData, ID: "a"}); err != ErrClosed {
+		t.Errorf("append to a closed log: expected %v, got %v", ErrClosed, err)
+	}
+
+	// replay the records of the segments starting at seq, the records were
+	// written to the file before Append returned
+	w, err = Open(dir, SyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	recs := make([]*Record, 0)
+	n, err := w.Replay(seq, func(rec *Record) { recs = append(recs, rec) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || recs[0].Type != RecordData || recs[1].Keys[0] != "units" {
+		t.Errorf("unexpected replayed records %d %+v", n, recs)
+	}
+
+	if err = w.RemoveBefore(seq); err != nil {
+		t.Fatal(err)
+	}
+	if segments, _ := w.Segments(); len(segments) != 2 || segments[0] != seq {
+		t.Errorf("unexpected segments after remove %v", segments)
+	}
+}